@@ -1,8 +1,13 @@
 package config
 
 import (
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"log"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 // ServerConfig 服务器配置
@@ -13,18 +18,70 @@ type ServerConfig struct {
 	DefaultUser       string
 	DefaultApiTimeout int
 	Environment       string
+
+	MaxInlineFileSize     int64             // 内联（base64/data URI）文件解码后的最大字节数
+	ArchiveMaxEntries     int               // 压缩包最大条目数
+	ArchiveMaxTotalSize   int64             // 压缩包最大解压总字节数
+	ArchiveMaxRatio       float64           // 压缩包最大压缩比
+	FileTypeMapping       map[string]string // 扩展名到Dify文件类型的映射
+	ParametersCacheTTL    int               // /v1/parameters 缓存时间（秒）
+	UploadCache           string            // 上传去重缓存类型：memory、disk，为空则不启用
+	UploadCacheDir        string            // 磁盘上传缓存目录
+	UploadCacheTTL        int               // 上传去重缓存时间（秒）
+	ResultCacheTTL        int               // 工作流结果缓存时间（秒），0表示不启用
+	ResultCacheMaxEntries int               // 工作流结果缓存最大条目数
+	UploadRecordTTL       int               // 上传记录保留时间（秒），用于按文件ID引用时确定文件类型
+	StreamRecordTTL       int               // 流式请求事件记录在结束后的保留时间（秒），用于续传事件
+	OutputSchemaDir       string            // 已注册的输出JSON Schema目录，文件名（不含.json）为Schema名称
+	OutputSchemaRetries   int               // 输出不符合Schema时允许的最大重新执行次数
+	ArtifactStore         string            // 输出文件转存类型：local、s3
+	ArtifactDir           string            // 本地转存目录
+	ArtifactBaseURL       string            // 转存文件固定地址的前缀（本服务的外部访问地址），为空时返回相对路径
+	ArtifactS3Endpoint    string            // S3兼容存储的地址（host:port）
+	ArtifactS3Bucket      string            // S3存储桶
+	ArtifactS3Prefix      string            // S3对象键的前缀目录，转存文件只保存和清理该前缀下的对象
+	ArtifactS3AccessKey   string            // S3访问密钥ID
+	ArtifactS3SecretKey   string            // S3访问密钥
+	ArtifactS3Region      string            // S3区域
+	ArtifactS3UseSSL      bool              // 是否使用HTTPS访问S3
+	ArtifactTTL           int               // 转存文件的保留时间（秒），0表示永久保留
+	UsageFile             string            // 用量统计的保存文件（JSON lines，每行一条执行记录），为空时只保存在内存中
+	UsageAdminToken       string            // 查询全部用量的管理令牌，为空时只能按API密钥查询自己的用量
+	WSMaxMessageSize      int64             // WebSocket客户端单条消息的最大字节数
+	WSAllowedOrigins      []string          // 允许建立WebSocket连接的来源（scheme://host[:port]），"*"表示任意来源；未配置时只允许同源和非浏览器客户端
 }
 
 // Config 应用配置
 var Config = &ServerConfig{
-	Port:              "3010",
-	MaxUploadFiles:    10,                // 最多可上传10个文件
-	MaxFileSize:       100 * 1024 * 1024, // 默认最大100MB，实际由Dify接口限制
-	DefaultUser:       "user",
-	DefaultApiTimeout: 120, // 默认API超时时间（秒）
-	Environment:       "development",
+	Port:                  "3010",
+	MaxUploadFiles:        10,                // 最多可上传10个文件
+	MaxFileSize:           100 * 1024 * 1024, // 默认最大100MB，实际由Dify接口限制
+	DefaultUser:           "user",
+	DefaultApiTimeout:     120, // 默认API超时时间（秒）
+	Environment:           "development",
+	MaxInlineFileSize:     20 * 1024 * 1024, // 内联文件默认最大20MB
+	ArchiveMaxEntries:     100,
+	ArchiveMaxTotalSize:   500 * 1024 * 1024, // 解压总大小默认最大500MB
+	ArchiveMaxRatio:       100,
+	FileTypeMapping:       copyFileTypeMapping(model.DefaultFileTypeMapping),
+	ParametersCacheTTL:    300,
+	UploadCacheDir:        "./data/upload_cache",
+	UploadCacheTTL:        86400,
+	ResultCacheMaxEntries: 1000,
+	UploadRecordTTL:       86400,
+	StreamRecordTTL:       3600,
+	OutputSchemaDir:       "./data/schemas",
+	OutputSchemaRetries:   3,
+	ArtifactStore:         "local",
+	ArtifactDir:           "./data/artifacts",
+	ArtifactS3Prefix:      "dify-artifacts",
+	ArtifactS3UseSSL:      true,
+	WSMaxMessageSize:      32 * 1024 * 1024, // 默认最大32MB，可容纳base64编码的内联文件
 }
 
+// fileTypeMappingMu 保护 FileTypeMapping 的并发读写
+var fileTypeMappingMu sync.RWMutex
+
 // GetPort 获取服务端口
 func GetPort() string {
 	if port := os.Getenv("PORT"); port != "" {
@@ -63,4 +120,205 @@ func InitConfig() {
 			Config.DefaultApiTimeout = val
 		}
 	}
+
+	if maxInline := os.Getenv("MAX_INLINE_FILE_SIZE"); maxInline != "" {
+		if val, err := strconv.ParseInt(maxInline, 10, 64); err == nil && val > 0 {
+			Config.MaxInlineFileSize = val
+		}
+	}
+
+	if maxEntries := os.Getenv("ARCHIVE_MAX_ENTRIES"); maxEntries != "" {
+		if val, err := strconv.Atoi(maxEntries); err == nil && val > 0 {
+			Config.ArchiveMaxEntries = val
+		}
+	}
+
+	if maxTotal := os.Getenv("ARCHIVE_MAX_TOTAL_SIZE"); maxTotal != "" {
+		if val, err := strconv.ParseInt(maxTotal, 10, 64); err == nil && val > 0 {
+			Config.ArchiveMaxTotalSize = val
+		}
+	}
+
+	if maxRatio := os.Getenv("ARCHIVE_MAX_RATIO"); maxRatio != "" {
+		if val, err := strconv.ParseFloat(maxRatio, 64); err == nil && val > 0 {
+			Config.ArchiveMaxRatio = val
+		}
+	}
+
+	if ttl := os.Getenv("PARAMETERS_CACHE_TTL"); ttl != "" {
+		if val, err := strconv.Atoi(ttl); err == nil && val >= 0 {
+			Config.ParametersCacheTTL = val
+		}
+	}
+
+	if cache := os.Getenv("UPLOAD_CACHE"); cache != "" {
+		Config.UploadCache = cache
+	}
+
+	if dir := os.Getenv("UPLOAD_CACHE_DIR"); dir != "" {
+		Config.UploadCacheDir = dir
+	}
+
+	if ttl := os.Getenv("UPLOAD_CACHE_TTL"); ttl != "" {
+		if val, err := strconv.Atoi(ttl); err == nil && val > 0 {
+			Config.UploadCacheTTL = val
+		}
+	}
+
+	if ttl := os.Getenv("RESULT_CACHE_TTL"); ttl != "" {
+		if val, err := strconv.Atoi(ttl); err == nil && val >= 0 {
+			Config.ResultCacheTTL = val
+		}
+	}
+
+	if maxEntries := os.Getenv("RESULT_CACHE_MAX_ENTRIES"); maxEntries != "" {
+		if val, err := strconv.Atoi(maxEntries); err == nil && val > 0 {
+			Config.ResultCacheMaxEntries = val
+		}
+	}
+
+	if ttl := os.Getenv("UPLOAD_RECORD_TTL"); ttl != "" {
+		if val, err := strconv.Atoi(ttl); err == nil && val > 0 {
+			Config.UploadRecordTTL = val
+		}
+	}
+
+	if ttl := os.Getenv("STREAM_RECORD_TTL"); ttl != "" {
+		if val, err := strconv.Atoi(ttl); err == nil && val > 0 {
+			Config.StreamRecordTTL = val
+		}
+	}
+
+	if dir := os.Getenv("OUTPUT_SCHEMA_DIR"); dir != "" {
+		Config.OutputSchemaDir = dir
+	}
+
+	if retries := os.Getenv("OUTPUT_SCHEMA_MAX_RETRIES"); retries != "" {
+		if val, err := strconv.Atoi(retries); err == nil && val >= 0 {
+			Config.OutputSchemaRetries = val
+		}
+	}
+
+	if store := os.Getenv("ARTIFACT_STORE"); store != "" {
+		Config.ArtifactStore = store
+	}
+
+	if dir := os.Getenv("ARTIFACT_DIR"); dir != "" {
+		Config.ArtifactDir = dir
+	}
+
+	if baseURL := os.Getenv("ARTIFACT_BASE_URL"); baseURL != "" {
+		Config.ArtifactBaseURL = strings.TrimSuffix(baseURL, "/")
+	}
+
+	Config.ArtifactS3Endpoint = os.Getenv("ARTIFACT_S3_ENDPOINT")
+	Config.ArtifactS3Bucket = os.Getenv("ARTIFACT_S3_BUCKET")
+	if prefix := os.Getenv("ARTIFACT_S3_PREFIX"); prefix != "" {
+		Config.ArtifactS3Prefix = prefix
+	}
+
+	Config.ArtifactS3AccessKey = os.Getenv("ARTIFACT_S3_ACCESS_KEY")
+	Config.ArtifactS3SecretKey = os.Getenv("ARTIFACT_S3_SECRET_KEY")
+	Config.ArtifactS3Region = os.Getenv("ARTIFACT_S3_REGION")
+
+	if useSSL := os.Getenv("ARTIFACT_S3_USE_SSL"); useSSL != "" {
+		if val, err := strconv.ParseBool(useSSL); err == nil {
+			Config.ArtifactS3UseSSL = val
+		}
+	}
+
+	if ttl := os.Getenv("ARTIFACT_TTL"); ttl != "" {
+		if val, err := strconv.Atoi(ttl); err == nil && val >= 0 {
+			Config.ArtifactTTL = val
+		}
+	}
+
+	if file := os.Getenv("USAGE_FILE"); file != "" {
+		Config.UsageFile = file
+	}
+
+	if token := os.Getenv("USAGE_ADMIN_TOKEN"); token != "" {
+		Config.UsageAdminToken = token
+	}
+
+	if maxSize := os.Getenv("WS_MAX_MESSAGE_SIZE"); maxSize != "" {
+		if val, err := strconv.ParseInt(maxSize, 10, 64); err == nil && val > 0 {
+			Config.WSMaxMessageSize = val
+		}
+	}
+
+	if origins := os.Getenv("WS_ALLOWED_ORIGINS"); origins != "" {
+		Config.WSAllowedOrigins = nil
+		for _, origin := range strings.Split(origins, ",") {
+			if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+				Config.WSAllowedOrigins = append(Config.WSAllowedOrigins, origin)
+			}
+		}
+	}
+
+	// 文件类型映射：默认值 <- 映射文件 <- 环境变量
+	if path := os.Getenv("FILE_TYPE_MAPPING_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("读取文件类型映射文件失败: %v", err)
+		} else if err := MergeFileTypeMapping(data); err != nil {
+			log.Printf("解析文件类型映射文件失败: %v", err)
+		}
+	}
+	if mapping := os.Getenv("FILE_TYPE_MAPPING"); mapping != "" {
+		if err := MergeFileTypeMapping([]byte(mapping)); err != nil {
+			log.Printf("解析FILE_TYPE_MAPPING失败: %v", err)
+		}
+	}
+}
+
+// MergeFileTypeMapping 将JSON格式的映射（如 {"heic":"image"}）合并到当前配置
+// 值为空字符串时表示移除该扩展名
+func MergeFileTypeMapping(data []byte) error {
+	var mapping map[string]string
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return err
+	}
+
+	fileTypeMappingMu.Lock()
+	defer fileTypeMappingMu.Unlock()
+
+	for ext, fileType := range mapping {
+		ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+		if ext == "" {
+			continue
+		}
+		if fileType == "" {
+			delete(Config.FileTypeMapping, ext)
+			continue
+		}
+		Config.FileTypeMapping[ext] = strings.ToLower(fileType)
+	}
+	return nil
+}
+
+// LookupFileType 根据扩展名查找配置中的文件类型
+func LookupFileType(ext string) (string, bool) {
+	fileTypeMappingMu.RLock()
+	defer fileTypeMappingMu.RUnlock()
+
+	fileType, ok := Config.FileTypeMapping[ext]
+	return fileType, ok
+}
+
+// GetFileTypeMapping 获取当前文件类型映射的副本
+func GetFileTypeMapping() map[string]string {
+	fileTypeMappingMu.RLock()
+	defer fileTypeMappingMu.RUnlock()
+
+	return copyFileTypeMapping(Config.FileTypeMapping)
+}
+
+// copyFileTypeMapping 复制文件类型映射
+func copyFileTypeMapping(mapping map[string]string) map[string]string {
+	result := make(map[string]string, len(mapping))
+	for ext, fileType := range mapping {
+		result[ext] = fileType
+	}
+	return result
 }
@@ -1,16 +1,23 @@
 package controller
 
 import (
+	"context"
+	"crypto/subtle"
 	"dify-upload-workflow/config"
 	"dify-upload-workflow/model"
 	"dify-upload-workflow/service"
 	"dify-upload-workflow/utils"
 	"encoding/json"
-	"io"
+	"errors"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
 // 从请求头获取API密钥
@@ -31,18 +38,23 @@ func getAPIKeyFromHeader(c *gin.Context) string {
 
 // SingleFileHandler 处理单文件URL格式工作流请求
 func SingleFileHandler(c *gin.Context) {
+	handleJSONFileWorkflow(c, false)
+}
+
+// MultiFilesHandler 处理多文件URL格式工作流请求
+func MultiFilesHandler(c *gin.Context) {
+	handleJSONFileWorkflow(c, true)
+}
+
+// handleJSONFileWorkflow 处理JSON格式的文件工作流请求
+// isList表示 inputs.file 对应单文件（file_url）还是文件列表（file_urls）
+func handleJSONFileWorkflow(c *gin.Context, isList bool) {
 	var request model.SingleFileWorkflowRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "请求格式错误: "+err.Error(), nil))
 		return
 	}
 
-	// 验证域名
-	if request.Domain == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "域名不能为空", nil))
-		return
-	}
-
 	// 从请求头获取API密钥
 	apiKey := getAPIKeyFromHeader(c)
 	if apiKey == "" {
@@ -50,39 +62,46 @@ func SingleFileHandler(c *gin.Context) {
 		return
 	}
 
-	// 检查是否有file字段
-	fileInput, ok := request.Inputs["file"]
-	if !ok {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "未找到file字段", nil))
+	// 校验请求参数并解析文件变量（inputs.file 和 inputs.files）
+	variables, err := service.BuildJSONWorkflowRequest(&request, isList)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, err.Error(), nil))
 		return
 	}
 
-	// 解析file字段
-	fileInputMap, ok := fileInput.(map[string]interface{})
-	if !ok {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "file字段格式错误", nil))
+	dispatchFileWorkflow(c, &request, apiKey, variables)
+}
+
+// handleFormFileWorkflow 处理form-data格式的文件工作流请求
+// fileKey为主文件字段（file或files），isList表示主文件变量是否为文件列表
+func handleFormFileWorkflow(c *gin.Context, fileKey string, isList bool) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "解析表单失败: "+err.Error(), nil))
 		return
 	}
+	// 文件内容在构建请求时已全部读入内存，请求处理完成后即可清理临时文件
+	defer form.RemoveAll()
 
-	// 获取文件URL和映射键
-	var fileSingleInput model.FileSingleInput
-	fileURL, ok := fileInputMap["file_url"].(string)
-	if !ok || fileURL == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件URL不能为空", nil))
+	// 从请求头获取API密钥
+	apiKey := getAPIKeyFromHeader(c)
+	if apiKey == "" {
+		c.JSON(http.StatusUnauthorized, utils.BuildAPIResponse(401, "未提供API密钥", nil))
 		return
 	}
-	fileSingleInput.FileURL = fileURL
 
-	fileValue, ok := fileInputMap["file_value"].(string)
-	if !ok || fileValue == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件映射键不能为空", nil))
+	// 校验请求参数，读取上传的文件并构建请求
+	request, variables, err := service.BuildFormWorkflowRequest(form, fileKey, isList)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, err.Error(), nil))
 		return
 	}
-	fileSingleInput.FileValue = fileValue
 
-	// 移除file字段，避免重复
-	delete(request.Inputs, "file")
+	dispatchFileWorkflow(c, request, apiKey, variables)
+}
 
+// dispatchFileWorkflow 按请求方式（异步、流式、阻塞）执行文件工作流并写出响应
+func dispatchFileWorkflow(c *gin.Context, request *model.SingleFileWorkflowRequest, apiKey string, variables []model.FileVariable) {
 	// 创建Dify服务
 	difyService := service.NewDifyService(request.Domain, apiKey)
 
@@ -91,8 +110,12 @@ func SingleFileHandler(c *gin.Context) {
 		// 创建异步处理器
 		asyncProcessor := service.NewAsyncProcessor(difyService)
 
-		// 异步处理单文件请求
-		asyncResp, err := asyncProcessor.ProcessSingleFileAsync(&request, &fileSingleInput)
+		// 异步处理请求
+		asyncResp, err := asyncProcessor.ProcessFileWorkflowAsync(request, variables)
+		if errors.Is(err, utils.ErrRequestIDConflict) {
+			c.JSON(http.StatusConflict, utils.BuildAPIResponse(409, err.Error(), nil))
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "初始化异步请求失败: "+err.Error(), nil))
 			return
@@ -103,52 +126,26 @@ func SingleFileHandler(c *gin.Context) {
 		return
 	}
 
-	// 如果是流式响应模式，直接调用流式处理端点
-	if strings.ToLower(request.ResponseMode) == "streaming" {
-		// 下载文件
-		fileContent, filename, err := utils.DownloadFile(fileSingleInput.FileURL)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "下载文件失败: "+err.Error(), nil))
-			return
-		}
-
-		// 上传文件到Dify
-		fileResp, err := difyService.UploadFile(fileContent, filename, request.User)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "上传文件到Dify失败: "+err.Error(), nil))
-			return
-		}
-
-		// 获取文件类型
-		fileType := utils.GetFileType(fileResp.Extension)
-
-		// 构建文件映射
-		fileMap := map[string]interface{}{
-			"transfer_method": "local_file",
-			"upload_file_id":  fileResp.ID,
-			"type":            fileType,
-		}
-
-		// 更新inputs中的文件信息
-		request.Inputs[fileSingleInput.FileValue] = fileMap
-
-		// 构建工作流请求
-		workflowRequest := &model.DifyWorkflowRunRequest{
-			Inputs:       request.Inputs,
-			ResponseMode: "streaming", // 强制使用streaming模式
-			User:         request.User,
-		}
-
-		// 直接执行流式工作流并透传响应
-		if err := difyService.StreamWorkflow(workflowRequest, c.Writer); err != nil {
-			// 由于可能已经设置了响应头，这里只能记录错误
+	// 如果是流式响应模式，直接执行流式工作流并透传响应
+	if request.ResponseMode == "streaming" {
+		if err := difyService.StreamFileWorkflow(c.Request.Context(), request, variables, c.Writer); err != nil {
+			if errors.Is(err, service.ErrClientDisconnected) {
+				// 客户端已断开连接，取消情况已单独记录
+				return
+			}
+			if !c.Writer.Written() {
+				// 尚未开始输出流式响应，仍可返回JSON错误
+				c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, err.Error(), nil))
+				return
+			}
+			// 由于已经开始输出响应，这里只能记录错误
 			c.Error(err)
 		}
 		return
 	}
 
-	// 处理单文件工作流
-	resp, err := difyService.ProcessSingleFileWorkflow(&request, &fileSingleInput)
+	// 处理文件工作流
+	resp, err := difyService.ProcessFileWorkflow(request, variables)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "处理工作流失败: "+err.Error(), nil))
 		return
@@ -158,408 +155,425 @@ func SingleFileHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", resp))
 }
 
-// MultiFilesHandler 处理多文件URL格式工作流请求
-func MultiFilesHandler(c *gin.Context) {
-	var request model.SingleFileWorkflowRequest
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "请求格式错误: "+err.Error(), nil))
-		return
-	}
+// SingleFileFormHandler 处理单文件form-data格式工作流请求
+func SingleFileFormHandler(c *gin.Context) {
+	handleFormFileWorkflow(c, "file", false)
+}
 
-	// 验证域名
-	if request.Domain == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "域名不能为空", nil))
-		return
-	}
+// MultiFilesFormHandler 处理多文件表单格式工作流请求
+func MultiFilesFormHandler(c *gin.Context) {
+	handleFormFileWorkflow(c, "files", true)
+}
 
-	// 从请求头获取API密钥
-	apiKey := getAPIKeyFromHeader(c)
-	if apiKey == "" {
-		c.JSON(http.StatusUnauthorized, utils.BuildAPIResponse(401, "未提供API密钥", nil))
+// QueryAsyncStatus 查询异步请求的处理状态，需提供执行请求时使用的API密钥
+// 请求已关联Dify工作流执行ID时，同时返回从Dify实时获取的执行详情
+func QueryAsyncStatus(c *gin.Context) {
+	// 获取请求ID
+	requestID := c.Param("requestID")
+	if requestID == "" {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "请求ID不能为空", nil))
 		return
 	}
 
-	// 检查是否有file字段
-	fileInput, ok := request.Inputs["file"]
-	if !ok {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "未找到file字段", nil))
+	// 查询请求状态
+	status, exists := utils.GetAsyncRequestStatus(requestID)
+	if !exists {
+		c.JSON(http.StatusNotFound, utils.BuildAPIResponse(404, "未找到指定请求ID的处理记录", nil))
 		return
 	}
 
-	// 解析file字段
-	fileInputMap, ok := fileInput.(map[string]interface{})
+	// 校验API密钥，处理结果只返回给发起请求的应用
+	apiKey, ok := authorizeRequestOwner(c, status.APIKeyHash)
 	if !ok {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "file字段格式错误", nil))
 		return
 	}
 
-	// 获取文件URL列表和映射键
-	var filesInput model.FilesInput
-	fileURLs, ok := fileInputMap["file_urls"].([]interface{})
-	if !ok || len(fileURLs) == 0 {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件URL列表不能为空", nil))
-		return
+	// 获取实时执行详情
+	if status.WorkflowRunID != "" {
+		run, err := service.NewDifyService(status.Domain, apiKey).GetWorkflowRun(status.WorkflowRunID)
+		if err != nil {
+			log.Printf("获取工作流执行详情失败: %v", err)
+		} else {
+			status.WorkflowRun = run
+		}
 	}
 
-	// 检查文件数量限制
-	if len(fileURLs) > config.Config.MaxUploadFiles {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件数量超过限制", nil))
-		return
+	// 返回状态信息
+	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", status))
+}
+
+// authorizeRequestOwner 校验请求头中的API密钥与执行请求时使用的密钥一致，不一致时返回401或403
+func authorizeRequestOwner(c *gin.Context, apiKeyHash string) (string, bool) {
+	apiKey := getAPIKeyFromHeader(c)
+	if apiKey == "" {
+		c.JSON(http.StatusUnauthorized, utils.BuildAPIResponse(401, "未提供API密钥", nil))
+		return "", false
 	}
+	if utils.HashAPIKey(apiKey) != apiKeyHash {
+		c.JSON(http.StatusForbidden, utils.BuildAPIResponse(403, "API密钥与发起请求时使用的不一致", nil))
+		return "", false
+	}
+	return apiKey, true
+}
 
-	// 转换文件URL列表
-	for _, urlInterface := range fileURLs {
-		url, ok := urlInterface.(string)
-		if !ok || url == "" {
-			c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件URL列表中包含无效URL", nil))
-			return
+// wsUpgrader WebSocket升级配置
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: checkWebSocketOrigin,
+}
+
+// checkWebSocketOrigin 校验WebSocket连接的来源，避免其他网站的页面借用户浏览器建立连接
+// 没有Origin请求头（非浏览器客户端）或与本服务同源时允许，其他来源需要在WS_ALLOWED_ORIGINS中配置
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range config.Config.WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
 		}
-		filesInput.FileURLs = append(filesInput.FileURLs, url)
 	}
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
 
-	fileValue, ok := fileInputMap["file_value"].(string)
-	if !ok || fileValue == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件映射键不能为空", nil))
+// WebSocketHandler 通过WebSocket执行工作流
+// 客户端发送 {"type":"run",...} 执行工作流，依次收到 accepted、下载/上传进度、files_uploaded、Dify事件和 summary；
+// 执行期间发送 {"type":"stop"} 停止工作流。同一连接同时只能执行一个工作流，结束后可以继续发送run
+func WebSocketHandler(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade已返回错误响应
 		return
 	}
-	filesInput.FileValue = fileValue
+	defer conn.Close()
+	// 超过大小的消息读取失败，连接随之关闭
+	conn.SetReadLimit(config.Config.WSMaxMessageSize)
 
-	// 移除file字段，避免重复
-	delete(request.Inputs, "file")
-
-	// 创建Dify服务
-	difyService := service.NewDifyService(request.Domain, apiKey)
+	out := utils.NewWebSocketWriter(conn)
+	headerAPIKey := getAPIKeyFromHeader(c)
 
-	// 检查是否为异步请求
-	if request.Async != nil && request.Async.CallbackURL != "" {
-		// 创建异步处理器
-		asyncProcessor := service.NewAsyncProcessor(difyService)
+	var cancel context.CancelFunc
+	var done chan struct{}
+	running := func() bool {
+		if done == nil {
+			return false
+		}
+		select {
+		case <-done:
+			return false
+		default:
+			return true
+		}
+	}
+	defer func() {
+		// 连接关闭时停止执行中的工作流并等待结束
+		if running() {
+			cancel()
+			<-done
+		}
+	}()
 
-		// 异步处理多文件请求
-		asyncResp, err := asyncProcessor.ProcessMultiFilesAsync(&request, &filesInput)
+	for {
+		// 读取失败表示连接已关闭
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "初始化异步请求失败: "+err.Error(), nil))
 			return
 		}
 
-		// 返回异步响应
-		c.JSON(http.StatusAccepted, utils.BuildAPIResponse(202, "请求已接受，正在异步处理", asyncResp))
-		return
-	}
+		var message model.WebSocketMessage
+		if err = json.Unmarshal(data, &message); err != nil {
+			writeWebSocketError(out, http.StatusBadRequest, "invalid_message", "消息格式错误: "+err.Error())
+			continue
+		}
 
-	// 如果是流式响应模式，直接调用流式处理
-	if strings.ToLower(request.ResponseMode) == "streaming" {
-		// 处理多个文件
-		var fileMapList []interface{}
+		switch message.Type {
+		case "run":
+			if running() {
+				writeWebSocketError(out, http.StatusConflict, "workflow_running", "已有执行中的工作流")
+				continue
+			}
 
-		for _, fileURL := range filesInput.FileURLs {
-			// 下载文件
-			fileContent, filename, err := utils.DownloadFile(fileURL)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "下载文件失败 ("+fileURL+"): "+err.Error(), nil))
-				return
+			apiKey := message.APIKey
+			if apiKey == "" {
+				apiKey = headerAPIKey
+			}
+			if apiKey == "" {
+				writeWebSocketError(out, http.StatusUnauthorized, "unauthorized", "未提供API密钥")
+				continue
 			}
 
-			// 上传文件到Dify
-			fileResp, err := difyService.UploadFile(fileContent, filename, request.User)
+			request := message.SingleFileWorkflowRequest
+			variables, err := service.BuildMessageWorkflowRequest(&request)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "上传文件到Dify失败 ("+filename+"): "+err.Error(), nil))
-				return
+				writeWebSocketError(out, http.StatusBadRequest, "invalid_param", err.Error())
+				continue
 			}
 
-			// 获取文件类型
-			fileType := utils.GetFileType(fileResp.Extension)
-
-			// 构建文件映射
-			fileMap := map[string]interface{}{
-				"transfer_method": "local_file",
-				"upload_file_id":  fileResp.ID,
-				"type":            fileType,
+			ctx, runCancel := context.WithCancel(c.Request.Context())
+			cancel = runCancel
+			done = make(chan struct{})
+			go runWebSocketWorkflow(ctx, runCancel, out, service.NewDifyService(request.Domain, apiKey), &request, variables, done)
+		case "stop":
+			if !running() {
+				writeWebSocketError(out, http.StatusBadRequest, "no_running_workflow", "当前没有执行中的工作流")
+				continue
 			}
-
-			fileMapList = append(fileMapList, fileMap)
+			cancel()
+		default:
+			writeWebSocketError(out, http.StatusBadRequest, "invalid_message", "不支持的消息类型: "+message.Type)
 		}
+	}
+}
 
-		// 更新inputs中的文件信息列表
-		request.Inputs[filesInput.FileValue] = fileMapList
+// runWebSocketWorkflow 执行工作流并将事件写出到WebSocket，结束时关闭done
+func runWebSocketWorkflow(ctx context.Context, cancel context.CancelFunc, out *utils.WebSocketWriter, difyService *service.DifyService,
+	request *model.SingleFileWorkflowRequest, variables []model.FileVariable, done chan struct{}) {
+	defer close(done)
+	defer cancel()
 
-		// 构建工作流请求
-		workflowRequest := &model.DifyWorkflowRunRequest{
-			Inputs:       request.Inputs,
-			ResponseMode: "streaming", // 强制使用streaming模式
-			User:         request.User,
-		}
+	requestID := utils.GenerateRequestID()
+	out.WriteJSON(map[string]interface{}{"event": "accepted", "request_id": requestID})
 
-		// 直接执行流式工作流并透传响应
-		if err := difyService.StreamWorkflow(workflowRequest, c.Writer); err != nil {
-			// 由于可能已经设置了响应头，这里只能记录错误
-			c.Error(err)
-		}
+	err := difyService.StreamFileWorkflowTo(ctx, requestID, request, variables, out)
+	if errors.Is(err, service.ErrClientDisconnected) {
+		out.WriteJSON(map[string]interface{}{"event": "stopped", "request_id": requestID})
+	}
+}
+
+// writeWebSocketError 以Dify的错误事件格式写出错误
+func writeWebSocketError(out *utils.WebSocketWriter, status int, code string, message string) {
+	out.WriteJSON(map[string]interface{}{
+		"event":   "error",
+		"status":  status,
+		"code":    code,
+		"message": message,
+	})
+}
+
+// ArtifactHandler 下载转存的工作流输出文件
+// 文件ID为不可猜测的UUID，地址本身即访问凭证，不需要API密钥
+func ArtifactHandler(c *gin.Context) {
+	store := utils.GetArtifactStore()
+	if store == nil {
+		c.JSON(http.StatusNotFound, utils.BuildAPIResponse(404, "服务未启用输出文件转存", nil))
 		return
 	}
 
-	// 处理多文件工作流
-	resp, err := difyService.ProcessMultiFilesWorkflow(&request, &filesInput)
+	artifact, reader, err := store.Open(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "处理工作流失败: "+err.Error(), nil))
+		if errors.Is(err, utils.ErrArtifactNotFound) {
+			c.JSON(http.StatusNotFound, utils.BuildAPIResponse(404, "未找到指定的文件", nil))
+			return
+		}
+		log.Printf("读取转存文件失败: %v", err)
+		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "读取文件失败", nil))
 		return
 	}
+	defer reader.Close()
 
-	// 返回响应
-	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", resp))
+	// 文件内容来自工作流输出，一律作为附件下载并禁止浏览器嗅探类型和执行脚本，避免HTML、SVG等文件在本服务域名下运行；
+	// 转存的文件内容不会改变
+	c.DataFromReader(http.StatusOK, artifact.Size, artifact.MimeType, reader, map[string]string{
+		"Content-Disposition":     mime.FormatMediaType("attachment", map[string]string{"filename": artifact.Filename}),
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+		"Cache-Control":           "public, max-age=31536000, immutable",
+	})
 }
 
-// SingleFileFormHandler 处理单文件form-data格式工作流请求
-func SingleFileFormHandler(c *gin.Context) {
-	// 获取域名
-	domain := c.PostForm("domain")
-	if domain == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "域名不能为空", nil))
-		return
-	}
-
-	// 获取响应模式
-	responseMode := c.PostForm("response_mode")
-	if responseMode == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "响应模式不能为空", nil))
+// StreamEventsHandler 续传流式请求的事件，需提供执行请求时使用的API密钥
+// 按 Last-Event-ID 请求头（或 last_event_id 查询参数）重放之后的事件，请求仍在执行时继续推送新事件直到结束
+func StreamEventsHandler(c *gin.Context) {
+	record, ok := utils.GetStreamRecord(c.Param("requestID"))
+	if !ok {
+		c.JSON(http.StatusNotFound, utils.BuildAPIResponse(404, "未找到指定请求ID的流式事件记录", nil))
 		return
 	}
-
-	// 获取用户标识
-	user := c.PostForm("user")
-	if user == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "用户标识不能为空", nil))
+	if _, ok = authorizeRequestOwner(c, record.APIKeyHash()); !ok {
 		return
 	}
 
-	// 获取文件映射键
-	fileValue := c.PostForm("file_value")
-	if fileValue == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件映射键不能为空", nil))
-		return
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
 	}
 
-	// 获取其他输入参数
-	inputs := make(map[string]interface{})
-	for key, values := range c.Request.PostForm {
-		if key != "file_value" && key != "domain" && key != "user" && key != "response_mode" && key != "callback_url" && key != "request_id" && len(values) > 0 {
-			inputs[key] = values[0]
+	sse := utils.NewSSEWriter(c.Writer)
+	sse.Start()
+	for {
+		events, done, updated := record.EventsAfter(lastEventID)
+		for i := range events {
+			if err := sse.WriteEvent(&events[i]); err != nil {
+				return
+			}
+			lastEventID = events[i].ID
+		}
+		if done {
+			return
 		}
-	}
 
-	// 检查是否有异步请求参数
-	var asyncRequest *model.AsyncRequest
-	callbackURL := c.PostForm("callback_url")
-	requestID := c.PostForm("request_id")
-	if callbackURL != "" {
-		asyncRequest = &model.AsyncRequest{
-			CallbackURL: callbackURL,
-			RequestID:   requestID,
+		// 等待新事件或客户端断开连接
+		select {
+		case <-updated:
+		case <-c.Request.Context().Done():
+			return
 		}
 	}
+}
 
-	// 从请求头获取API密钥
-	apiKey := getAPIKeyFromHeader(c)
-	if apiKey == "" {
-		c.JSON(http.StatusUnauthorized, utils.BuildAPIResponse(401, "未提供API密钥", nil))
+// WorkflowRunHandler 查询Dify工作流执行详情
+func WorkflowRunHandler(c *gin.Context) {
+	difyService, ok := newQueryDifyService(c)
+	if !ok {
 		return
 	}
 
-	// 获取上传的文件
-	file, err := c.FormFile("file")
+	run, err := difyService.GetWorkflowRun(c.Param("workflowRunID"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件上传失败: "+err.Error(), nil))
+		respondDifyError(c, "获取工作流执行详情失败", err)
 		return
 	}
 
-	// 打开文件
-	src, err := file.Open()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "打开文件失败: "+err.Error(), nil))
-		return
-	}
-	defer src.Close()
+	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", run))
+}
 
-	// 读取文件内容
-	fileContent, err := io.ReadAll(src)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "读取文件内容失败: "+err.Error(), nil))
+// WorkflowLogsHandler 查询Dify工作流日志，支持 keyword、status、page、limit 查询参数
+func WorkflowLogsHandler(c *gin.Context) {
+	difyService, ok := newQueryDifyService(c)
+	if !ok {
 		return
 	}
 
-	// 构建请求结构体
-	request := &model.SingleFileWorkflowRequest{
-		Domain:       domain,
-		Inputs:       inputs,
-		ResponseMode: responseMode,
-		User:         user,
-		Async:        asyncRequest,
+	query := url.Values{}
+	for _, key := range []string{"keyword", "status", "page", "limit"} {
+		if value := c.Query(key); value != "" {
+			query.Set(key, value)
+		}
 	}
 
-	// 构建文件输入结构体
-	fileSingleInput := &model.FileSingleInput{
-		FileValue: fileValue,
+	logs, err := difyService.GetWorkflowLogs(query)
+	if err != nil {
+		respondDifyError(c, "获取工作流日志失败", err)
+		return
 	}
 
-	// 创建Dify服务
-	difyService := service.NewDifyService(domain, apiKey)
-
-	// 检查是否为异步请求
-	if asyncRequest != nil {
-		// 异步处理单文件请求（使用文件内容而不是URL）
-		asyncResp := utils.InitAsyncRequest(asyncRequest)
-		requestID := asyncResp.RequestID
-
-		// 在goroutine中处理文件上传和工作流
-		go func() {
-			// 上传文件到Dify
-			fileResp, err := difyService.UploadFile(fileContent, file.Filename, request.User)
-			if err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "上传文件到Dify失败: "+err.Error())
-				utils.CallbackResult(asyncRequest.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "上传文件到Dify失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 获取文件类型
-			fileType := utils.GetFileType(fileResp.Extension)
-
-			// 构建文件映射
-			fileMap := map[string]interface{}{
-				"transfer_method": "local_file",
-				"upload_file_id":  fileResp.ID,
-				"type":            fileType,
-			}
-
-			// 更新inputs中的文件信息
-			request.Inputs[fileSingleInput.FileValue] = fileMap
-
-			// 构建工作流请求
-			workflowRequest := &model.DifyWorkflowRunRequest{
-				Inputs:       request.Inputs,
-				ResponseMode: "blocking", // 强制使用blocking模式处理异步请求，即使用户请求streaming
-				User:         request.User,
-			}
-
-			// 执行工作流
-			respBody, err := difyService.RunWorkflow(workflowRequest)
-			if err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "执行工作流失败: "+err.Error())
-				utils.CallbackResult(asyncRequest.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "执行工作流失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 解析工作流响应
-			var workflowResp interface{}
-			if err := json.Unmarshal(respBody, &workflowResp); err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "解析工作流响应失败: "+err.Error())
-				utils.CallbackResult(asyncRequest.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "解析工作流响应失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 构建成功响应
-			result := &model.WorkflowResponse{
-				FileResponse: []model.DifyFileUploadResponse{*fileResp},
-				WorkflowData: workflowResp,
-			}
-
-			// 更新状态为完成
-			utils.UpdateAsyncRequestStatus(requestID, "completed", "处理完成")
-
-			// 回调成功结果
-			utils.CallbackResult(asyncRequest.CallbackURL, requestID, result)
-		}()
+	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", logs))
+}
 
-		// 返回异步响应
-		c.JSON(http.StatusAccepted, utils.BuildAPIResponse(202, "请求已接受，正在异步处理", asyncResp))
+// UsageHandler 查询工作流用量，用于按团队核算费用
+// 使用 USAGE_ADMIN_TOKEN 作为API密钥时可查询全部用量，否则只能查询请求头中API密钥自己的用量；
+// 支持 from、to（YYYY-MM-DD，含当天）、user、domain、api_key_hash 过滤，group_by 指定汇总维度（逗号分隔），
+// format=csv 时导出CSV文件
+func UsageHandler(c *gin.Context) {
+	apiKey := getAPIKeyFromHeader(c)
+	if apiKey == "" {
+		c.JSON(http.StatusUnauthorized, utils.BuildAPIResponse(401, "未提供API密钥", nil))
 		return
 	}
 
-	// 上传文件到Dify
-	fileResp, err := difyService.UploadFile(fileContent, file.Filename, request.User)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "上传文件到Dify失败: "+err.Error(), nil))
-		return
+	query := model.UsageQuery{
+		From:       c.Query("from"),
+		To:         c.Query("to"),
+		User:       c.Query("user"),
+		APIKeyHash: c.Query("api_key_hash"),
+	}
+	if token := config.Config.UsageAdminToken; token == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(token)) != 1 {
+		query.APIKeyHash = utils.HashAPIKey(apiKey)
 	}
 
-	// 获取文件类型
-	fileType := utils.GetFileType(fileResp.Extension)
-
-	// 构建文件映射
-	fileMap := map[string]interface{}{
-		"transfer_method": "local_file",
-		"upload_file_id":  fileResp.ID,
-		"type":            fileType,
+	for _, date := range []string{query.From, query.To} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "日期格式错误，应为YYYY-MM-DD", nil))
+			return
+		}
 	}
 
-	// 更新inputs中的文件信息
-	request.Inputs[fileSingleInput.FileValue] = fileMap
+	if domain := c.Query("domain"); domain != "" {
+		normalized, err := service.NormalizeDomain(domain)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, err.Error(), nil))
+			return
+		}
+		query.Domain = normalized
+	}
 
-	// 如果是流式响应模式，直接调用流式处理端点
-	if strings.ToLower(responseMode) == "streaming" {
-		// 构建工作流请求
-		workflowRequest := &model.DifyWorkflowRunRequest{
-			Inputs:       request.Inputs,
-			ResponseMode: "streaming", // 强制使用streaming模式
-			User:         request.User,
+	if groupBy := c.Query("group_by"); groupBy != "" {
+		for _, dimension := range strings.Split(groupBy, ",") {
+			dimension = strings.TrimSpace(dimension)
+			if !utils.IsUsageDimension(dimension) {
+				c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "group_by只支持 "+strings.Join(utils.UsageDimensions, "、"), nil))
+				return
+			}
+			query.GroupBy = append(query.GroupBy, dimension)
 		}
+	}
 
-		// 直接执行流式工作流并透传响应
-		if err := difyService.StreamWorkflow(workflowRequest, c.Writer); err != nil {
-			// 由于可能已经设置了响应头，这里只能记录错误
-			c.Error(err)
+	records := utils.QueryUsage(query)
+
+	if strings.EqualFold(c.Query("format"), "csv") {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="usage.csv"`)
+		c.Status(http.StatusOK)
+		// 写入BOM，Excel打开时能正确识别UTF-8编码的用户名
+		c.Writer.WriteString("\ufeff")
+		if err := utils.WriteUsageCSV(c.Writer, records); err != nil {
+			log.Printf("写出用量CSV失败: %v", err)
 		}
 		return
 	}
 
-	// 构建工作流请求
-	workflowRequest := &model.DifyWorkflowRunRequest{
-		Inputs:       request.Inputs,
-		ResponseMode: request.ResponseMode,
-		User:         request.User,
-	}
+	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", gin.H{
+		"records": records,
+		"total":   utils.SumUsage(records),
+	}))
+}
 
-	// 执行工作流
-	respBody, err := difyService.RunWorkflow(workflowRequest)
+// newQueryDifyService 根据查询参数domain和请求头中的API密钥创建Dify服务
+func newQueryDifyService(c *gin.Context) (*service.DifyService, bool) {
+	domain, err := service.NormalizeDomain(c.Query("domain"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "执行工作流失败: "+err.Error(), nil))
-		return
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, err.Error(), nil))
+		return nil, false
 	}
 
-	// 解析工作流响应
-	var workflowResp interface{}
-	if err := json.Unmarshal(respBody, &workflowResp); err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "解析工作流响应失败: "+err.Error(), nil))
-		return
+	// 从请求头获取API密钥
+	apiKey := getAPIKeyFromHeader(c)
+	if apiKey == "" {
+		c.JSON(http.StatusUnauthorized, utils.BuildAPIResponse(401, "未提供API密钥", nil))
+		return nil, false
 	}
 
-	// 构建响应
-	result := &model.WorkflowResponse{
-		FileResponse: []model.DifyFileUploadResponse{*fileResp},
-		WorkflowData: workflowResp,
-	}
+	return service.NewDifyService(domain, apiKey), true
+}
 
-	// 返回响应
-	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", result))
+// respondDifyError 返回Dify接口错误，Dify返回的4xx状态码原样透传
+func respondDifyError(c *gin.Context, message string, err error) {
+	var apiErr *service.DifyAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+		c.JSON(apiErr.StatusCode, utils.BuildAPIResponse(apiErr.StatusCode, message+": "+apiErr.Message, nil))
+		return
+	}
+	c.JSON(http.StatusBadGateway, utils.BuildAPIResponse(502, message+": "+err.Error(), nil))
 }
 
-// MultiFilesFormHandler 处理多文件表单格式工作流请求
-func MultiFilesFormHandler(c *gin.Context) {
-	// 解析表单
-	if err := c.Request.ParseMultipartForm(config.Config.MaxFileSize * int64(config.Config.MaxUploadFiles)); err != nil {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "解析表单失败: "+err.Error(), nil))
+// UploadURLFileHandler 处理URL文件上传到Dify，不调用工作流
+func UploadURLFileHandler(c *gin.Context) {
+	var request struct {
+		FileURL model.FileSource    `json:"file_url"`
+		User    string              `json:"user" binding:"required"`
+		Domain  string              `json:"domain" binding:"required"`
+		Async   *model.AsyncRequest `json:"async,omitempty"` // 异步请求配置，为空则为同步请求
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "请求格式错误: "+err.Error(), nil))
 		return
 	}
 
-	// 获取domain参数
-	domain := c.Request.FormValue("domain")
-	if domain == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "域名不能为空", nil))
+	// 验证文件URL
+	if request.FileURL.URL == "" && request.FileURL.Base64 == "" {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件URL不能为空", nil))
 		return
 	}
 
@@ -570,120 +584,103 @@ func MultiFilesFormHandler(c *gin.Context) {
 		return
 	}
 
-	// 获取用户参数
-	user := c.Request.FormValue("user")
-	if user == "" {
-		user = config.Config.DefaultUser
-	}
-
-	// 获取响应模式
-	responseMode := c.Request.FormValue("response_mode")
-	if responseMode == "" {
-		responseMode = "blocking"
+	// 校验域名、用户和回调地址
+	uploadRequest := &model.SingleFileWorkflowRequest{
+		Domain: request.Domain,
+		User:   request.User,
+		Async:  request.Async,
 	}
-
-	// 检查是否有异步请求参数
-	var asyncRequest *model.AsyncRequest
-	callbackURL := c.Request.FormValue("callback_url")
-	requestID := c.Request.FormValue("request_id")
-	if callbackURL != "" {
-		asyncRequest = &model.AsyncRequest{
-			CallbackURL: callbackURL,
-			RequestID:   requestID,
-		}
-	}
-
-	// 如果是异步请求
-	if asyncRequest != nil {
-		// 初始化异步响应
-		asyncResp := utils.InitAsyncRequest(asyncRequest)
-		requestID := asyncResp.RequestID
-
-		// 在goroutine中处理文件上传和工作流
-		go func() {
-			// 创建上传服务
-			uploadService := service.NewUploadService()
-
-			// 处理多文件表单工作流，强制使用blocking模式
-			resp, err := uploadService.ProcessMultiFormFiles(domain, apiKey, c.Request.MultipartForm, user, "blocking")
-			if err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "处理工作流失败: "+err.Error())
-				utils.CallbackResult(asyncRequest.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "处理工作流失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 更新状态为完成
-			utils.UpdateAsyncRequestStatus(requestID, "completed", "处理完成")
-
-			// 回调成功结果
-			utils.CallbackResult(asyncRequest.CallbackURL, requestID, resp)
-		}()
-
-		// 返回异步响应
-		c.JSON(http.StatusAccepted, utils.BuildAPIResponse(202, "请求已接受，正在异步处理", asyncResp))
+	if err := service.NormalizeWorkflowRequest(uploadRequest); err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, err.Error(), nil))
 		return
 	}
 
-	// 创建上传服务
-	uploadService := service.NewUploadService()
+	// 创建Dify服务
+	difyService := service.NewDifyService(uploadRequest.Domain, apiKey)
 
-	// 处理多文件表单工作流
-	if strings.ToLower(responseMode) == "streaming" {
-		// 流式响应
-		err := uploadService.StreamMultiFormFiles(domain, apiKey, c.Request.MultipartForm, user, c.Writer)
+	// 异步上传，完成后回调与同步响应相同格式的上传结果
+	if uploadRequest.Async != nil && uploadRequest.Async.CallbackURL != "" {
+		asyncResp, err := service.NewAsyncProcessor(difyService).ProcessUploadFileAsync(uploadRequest, request.FileURL)
+		if errors.Is(err, utils.ErrRequestIDConflict) {
+			c.JSON(http.StatusConflict, utils.BuildAPIResponse(409, err.Error(), nil))
+			return
+		}
 		if err != nil {
-			// 注意：这里可能已经开始发送响应，所以错误只能记录
-			c.Error(err)
+			c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "初始化异步请求失败: "+err.Error(), nil))
 			return
 		}
+
+		c.JSON(http.StatusAccepted, utils.BuildAPIResponse(202, "请求已接受，正在异步处理", asyncResp))
 		return
 	}
 
-	// 阻塞响应
-	resp, err := uploadService.ProcessMultiFormFiles(domain, apiKey, c.Request.MultipartForm, user, responseMode)
+	// 获取文件并上传到Dify
+	fileResp, err := difyService.UploadFileSource(request.FileURL, uploadRequest.User)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "处理工作流失败: "+err.Error(), nil))
+		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, err.Error(), nil))
 		return
 	}
 
-	// 返回响应
-	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", resp))
+	// 返回上传结果
+	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "上传成功", fileResp))
 }
 
-// QueryAsyncStatus 查询异步请求的处理状态
-func QueryAsyncStatus(c *gin.Context) {
-	// 获取请求ID
-	requestID := c.Param("requestID")
-	if requestID == "" {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "请求ID不能为空", nil))
+// UploadURLsHandler 批量上传URL文件到Dify，不调用工作流
+func UploadURLsHandler(c *gin.Context) {
+	var request model.UploadFilesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "请求格式错误: "+err.Error(), nil))
 		return
 	}
 
-	// 查询请求状态
-	status, exists := utils.GetAsyncRequestStatus(requestID)
-	if !exists {
-		c.JSON(http.StatusNotFound, utils.BuildAPIResponse(404, "未找到指定请求ID的处理记录", nil))
+	// 验证文件URL列表
+	if len(request.FileURLs) == 0 {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件URL列表不能为空", nil))
 		return
 	}
+	for _, source := range request.FileURLs {
+		if source.URL == "" && source.Base64 == "" {
+			c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件URL列表中包含空URL", nil))
+			return
+		}
+	}
 
-	// 返回状态信息
-	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "成功", status))
-}
+	// 从请求头获取API密钥
+	apiKey := getAPIKeyFromHeader(c)
+	if apiKey == "" {
+		c.JSON(http.StatusUnauthorized, utils.BuildAPIResponse(401, "未提供API密钥", nil))
+		return
+	}
 
-// UploadURLFileHandler 处理URL文件上传到Dify，不调用工作流
-func UploadURLFileHandler(c *gin.Context) {
-	var request struct {
-		FileURL string `json:"file_url" binding:"required"`
-		User    string `json:"user" binding:"required"`
-		Domain  string `json:"domain" binding:"required"`
+	variable := model.FileVariable{FileValue: "files", Sources: request.FileURLs, IsList: true, Type: request.Type}
+	if err := utils.ValidateFileVariables([]model.FileVariable{variable}); err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, err.Error(), nil))
+		return
 	}
 
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "请求格式错误: "+err.Error(), nil))
+	uploadRequest := &model.SingleFileWorkflowRequest{
+		Domain:          request.Domain,
+		User:            request.User,
+		Async:           request.Async,
+		ExpandArchives:  request.ExpandArchives,
+		FileTypeMapping: request.FileTypeMapping,
+	}
+	if err := service.NormalizeWorkflowRequest(uploadRequest); err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, err.Error(), nil))
+		return
+	}
+	dispatchUpload(c, uploadRequest, apiKey, variable)
+}
+
+// UploadFormDataHandler 上传form-data中的文件（file或files字段，单个或多个）到Dify，不调用工作流
+func UploadFormDataHandler(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "解析表单失败: "+err.Error(), nil))
 		return
 	}
+	// 文件内容在构建请求时已全部读入内存，请求处理完成后即可清理临时文件
+	defer form.RemoveAll()
 
 	// 从请求头获取API密钥
 	apiKey := getAPIKeyFromHeader(c)
@@ -692,23 +689,46 @@ func UploadURLFileHandler(c *gin.Context) {
 		return
 	}
 
-	// 下载文件
-	fileContent, filename, err := utils.DownloadFile(request.FileURL)
+	// 校验请求参数，读取上传的文件并构建请求
+	uploadService := service.NewUploadService()
+	request, variable, err := uploadService.BuildFormUploadRequest(form)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "下载文件失败: "+err.Error(), nil))
+		c.JSON(http.StatusBadRequest, utils.BuildAPIResponse(400, "文件上传失败: "+err.Error(), nil))
 		return
 	}
 
+	dispatchUpload(c, request, apiKey, variable)
+}
+
+// dispatchUpload 按请求方式（异步、同步）上传文件并写出响应
+func dispatchUpload(c *gin.Context, request *model.SingleFileWorkflowRequest, apiKey string, variable model.FileVariable) {
 	// 创建Dify服务
 	difyService := service.NewDifyService(request.Domain, apiKey)
 
-	// 上传文件到Dify
-	fileResp, err := difyService.UploadFile(fileContent, filename, request.User)
+	// 检查是否为异步请求
+	if request.Async != nil && request.Async.CallbackURL != "" {
+		asyncProcessor := service.NewAsyncProcessor(difyService)
+
+		asyncResp, err := asyncProcessor.ProcessUploadAsync(request, variable)
+		if errors.Is(err, utils.ErrRequestIDConflict) {
+			c.JSON(http.StatusConflict, utils.BuildAPIResponse(409, err.Error(), nil))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "初始化异步请求失败: "+err.Error(), nil))
+			return
+		}
+
+		c.JSON(http.StatusAccepted, utils.BuildAPIResponse(202, "请求已接受，正在异步处理", asyncResp))
+		return
+	}
+
+	// 上传文件
+	resp, err := difyService.UploadFiles(request, variable)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, "上传文件到Dify失败: "+err.Error(), nil))
+		c.JSON(http.StatusInternalServerError, utils.BuildAPIResponse(500, err.Error(), nil))
 		return
 	}
 
-	// 返回上传结果
-	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "上传成功", fileResp))
+	c.JSON(http.StatusOK, utils.BuildAPIResponse(200, "上传成功", resp))
 }
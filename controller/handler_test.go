@@ -0,0 +1,1576 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// fakeDify 模拟Dify接口、文件下载和异步回调
+type fakeDify struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	uploads    int
+	parameters int
+	runs       []map[string]interface{}
+	callbacks  chan map[string]interface{}
+
+	// holdStream 为true时流式响应在workflow_started后保持连接，直到请求被取消或release被关闭
+	holdStream bool
+	release    chan struct{}
+	stops      chan string
+
+	// outputs 依次作为blocking模式响应的outputs（JSON），用完后重复最后一个；为空时返回 {"ok":true}
+	outputs []string
+
+	// fileSuffix 追加到 /files/a.pdf 内容末尾，模拟同一URL的文件内容变化
+	fileSuffix string
+}
+
+func newFakeDify(t *testing.T) *fakeDify {
+	t.Helper()
+
+	f := &fakeDify{callbacks: make(chan map[string]interface{}, 4), release: make(chan struct{}), stops: make(chan string, 4)}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/files/upload", func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, _ := io.ReadAll(file)
+
+		f.mu.Lock()
+		f.uploads++
+		id := fmt.Sprintf("file-%d", f.uploads)
+		f.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":        id,
+			"name":      header.Filename,
+			"size":      len(content),
+			"extension": strings.TrimPrefix(filepath.Ext(header.Filename), "."),
+		})
+	})
+
+	mux.HandleFunc("/v1/parameters", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.parameters++
+		f.mu.Unlock()
+		w.Write([]byte(`{"user_input_form":[{"number":{"variable":"count"}},{"number":{"variable":"zip"}}]}`))
+	})
+
+	mux.HandleFunc("/v1/workflows/run", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		f.mu.Lock()
+		f.runs = append(f.runs, body)
+		f.mu.Unlock()
+
+		if body["response_mode"] == "streaming" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("event: ping\n\n"))
+			w.Write([]byte("data: {\"event\":\"workflow_started\",\"task_id\":\"task-1\",\"workflow_run_id\":\"run-1\"}\n\n"))
+			if f.holdStream {
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-f.release:
+				}
+			}
+			w.Write([]byte("data: {\"event\":\"text_chunk\",\"task_id\":\"task-1\",\"data\":{\"text\":\"ok\"}}\n\n"))
+			w.Write([]byte("data: {\"event\":\"workflow_finished\",\"task_id\":\"task-1\",\"data\":{\"status\":\"succeeded\",\"total_tokens\":100,\"elapsed_time\":1.5}}\n\n"))
+			return
+		}
+		outputs := `{"ok":true}`
+		f.mu.Lock()
+		run := len(f.runs)
+		if len(f.outputs) > 0 {
+			outputs = f.outputs[0]
+			if len(f.outputs) > 1 {
+				f.outputs = f.outputs[1:]
+			}
+		}
+		f.mu.Unlock()
+		// 每次执行使用不同的执行ID
+		fmt.Fprintf(w, `{"task_id":"task-%d","workflow_run_id":"run-%d","data":{"status":"succeeded","total_tokens":100,"elapsed_time":1.5,"outputs":%s}}`, run, run, outputs)
+	})
+
+	mux.HandleFunc("GET /v1/workflows/run/{runID}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer app-key" {
+			http.Error(w, `{"code":"unauthorized","message":"invalid key"}`, http.StatusUnauthorized)
+			return
+		}
+		if !strings.HasPrefix(r.PathValue("runID"), "run-") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"not_found","message":"workflow run not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": r.PathValue("runID"), "status": "succeeded"})
+	})
+
+	mux.HandleFunc("GET /v1/workflows/logs", func(w http.ResponseWriter, r *http.Request) {
+		// 原样返回收到的查询参数
+		query := make(map[string]string)
+		for key := range r.URL.Query() {
+			query[key] = r.URL.Query().Get(key)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": []interface{}{}, "query": query})
+	})
+
+	mux.HandleFunc("POST /v1/workflows/tasks/{taskID}/stop", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.stops <- r.PathValue("taskID") + "|" + fmt.Sprint(body["user"])
+		w.Write([]byte(`{"result":"success"}`))
+	})
+
+	mux.HandleFunc("/files/a.pdf", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		suffix := f.fileSuffix
+		f.mu.Unlock()
+		w.Write([]byte("%PDF-1.4 test" + suffix))
+	})
+
+	mux.HandleFunc("/files/tools/chart.png", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sign") == "" {
+			http.Error(w, "missing sign", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\nchart"))
+	})
+
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.callbacks <- body
+	})
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// lastRun 最近一次工作流请求
+func (f *fakeDify) lastRun(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.runs) == 0 {
+		t.Fatal("未调用工作流")
+	}
+	return f.runs[len(f.runs)-1]
+}
+
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/dify/fileSingle/workflow", SingleFileHandler)
+	r.POST("/dify/files/workflow", MultiFilesHandler)
+	r.POST("/dify/fileSingle/formdata/workflow", SingleFileFormHandler)
+	r.POST("/dify/files/formdata/workflow", MultiFilesFormHandler)
+	r.GET("/dify/async/:requestID", QueryAsyncStatus)
+	r.GET("/dify/workflows/run/:workflowRunID", WorkflowRunHandler)
+	r.GET("/dify/workflows/logs", WorkflowLogsHandler)
+	r.GET("/dify/stream/:requestID", StreamEventsHandler)
+	r.GET("/dify/ws", WebSocketHandler)
+	r.GET("/dify/artifacts/:id", ArtifactHandler)
+	r.GET("/dify/usage", UsageHandler)
+	r.POST("/dify/upload/url", UploadURLFileHandler)
+	r.POST("/dify/upload/urls", UploadURLsHandler)
+	r.POST("/dify/upload/formdata", UploadFormDataHandler)
+	return r
+}
+
+// workflowCall 测试用的一次接口调用
+type workflowCall struct {
+	name        string
+	path        string
+	contentType string
+	body        []byte
+}
+
+// buildCalls 为四个工作流接口构建等价的请求
+// fields为公共参数，JSON请求中额外参数放入inputs，form-data请求中作为普通字段
+func buildCalls(t *testing.T, baseURL string, fields map[string]string) []workflowCall {
+	t.Helper()
+
+	var calls []workflowCall
+	fileURL := baseURL + "/files/a.pdf"
+
+	for _, isList := range []bool{false, true} {
+		// JSON请求
+		payload := map[string]interface{}{}
+		inputs := map[string]interface{}{"count": "3"}
+		for key, value := range fields {
+			switch key {
+			case "callback_url":
+				payload["async"] = map[string]interface{}{"callback_url": value}
+			default:
+				payload[key] = value
+			}
+		}
+		fileSpec := map[string]interface{}{"file_value": "doc"}
+		path := "/dify/fileSingle/workflow"
+		if isList {
+			fileSpec["file_urls"] = []string{fileURL}
+			path = "/dify/files/workflow"
+		} else {
+			fileSpec["file_url"] = fileURL
+		}
+		inputs["file"] = fileSpec
+		payload["inputs"] = inputs
+		data, _ := json.Marshal(payload)
+		calls = append(calls, workflowCall{name: "json " + path, path: path, contentType: "application/json", body: data})
+
+		// form-data请求
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for key, value := range fields {
+			writer.WriteField(key, value)
+		}
+		writer.WriteField("file_value", "doc")
+		writer.WriteField("count", "3")
+		fileKey := "file"
+		path = "/dify/fileSingle/formdata/workflow"
+		if isList {
+			fileKey = "files"
+			path = "/dify/files/formdata/workflow"
+		}
+		part, _ := writer.CreateFormFile(fileKey, "a.pdf")
+		part.Write([]byte("%PDF-1.4 test"))
+		writer.Close()
+		calls = append(calls, workflowCall{name: "form " + path, path: path, contentType: writer.FormDataContentType(), body: body.Bytes()})
+	}
+
+	return calls
+}
+
+// do 发起请求
+func (call workflowCall) do(r *gin.Engine, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, call.path, bytes.NewReader(call.body))
+	req.Header.Set("Content-Type", call.contentType)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// decodeResponse 解析统一响应
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	var resp map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("响应不是JSON: %s", w.Body.String())
+	}
+	return resp
+}
+
+func TestWorkflowHandlersBlocking(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	for _, call := range buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL + "/"}) {
+		t.Run(call.name, func(t *testing.T) {
+			w := call.do(r, "app-key")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			run := dify.lastRun(t)
+			if run["user"] != "user" || run["response_mode"] != "blocking" {
+				t.Errorf("默认值不一致: user=%v response_mode=%v", run["user"], run["response_mode"])
+			}
+			inputs := run["inputs"].(map[string]interface{})
+			if _, ok := inputs["doc"]; !ok {
+				t.Errorf("inputs中缺少文件变量: %v", inputs)
+			}
+			if _, ok := inputs["file"]; ok {
+				t.Errorf("inputs中不应包含file字段: %v", inputs)
+			}
+
+			data := decodeResponse(t, w)["data"].(map[string]interface{})
+			if files, _ := data["file_response"].([]interface{}); len(files) != 1 {
+				t.Errorf("file_response = %v", data["file_response"])
+			}
+		})
+	}
+}
+
+// TestWorkflowHandlersResultCache 命中结果缓存时不下载、不上传文件，也不执行工作流
+func TestWorkflowHandlersResultCache(t *testing.T) {
+	original := config.Config.ResultCacheTTL
+	config.Config.ResultCacheTTL = 60
+	t.Cleanup(func() { config.Config.ResultCacheTTL = original })
+
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	// counts 上传和执行次数
+	counts := func() (int, int) {
+		dify.mu.Lock()
+		defer dify.mu.Unlock()
+		return dify.uploads, len(dify.runs)
+	}
+
+	for _, call := range buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL}) {
+		t.Run(call.name, func(t *testing.T) {
+			if w := call.do(r, "app-key"); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			uploads, runs := counts()
+
+			w := call.do(r, "app-key")
+			data := decodeResponse(t, w)["data"].(map[string]interface{})
+			if data["cache_hit"] != true {
+				t.Fatalf("未命中结果缓存: %v", data)
+			}
+			if gotUploads, gotRuns := counts(); gotUploads != uploads || gotRuns != runs {
+				t.Errorf("命中缓存后仍上传或执行: uploads %d -> %d, runs %d -> %d", uploads, gotUploads, runs, gotRuns)
+			}
+		})
+	}
+
+	// 同一URL的文件内容变化或终端用户不同时不命中
+	tests := []struct {
+		name       string
+		user       string
+		fileSuffix string
+		wantHit    bool
+	}{
+		{"内容相同", "", "", true},
+		{"终端用户不同", "other", "", false},
+		{"同一URL内容变化", "", " v2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dify.mu.Lock()
+			dify.fileSuffix = tt.fileSuffix
+			dify.mu.Unlock()
+
+			payload := map[string]interface{}{
+				"domain": dify.server.URL,
+				"inputs": map[string]interface{}{
+					"count": "3",
+					"file":  map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"},
+				},
+			}
+			if tt.user != "" {
+				payload["user"] = tt.user
+			}
+			body, _ := json.Marshal(payload)
+			w := workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}.do(r, "app-key")
+			if data := decodeResponse(t, w)["data"].(map[string]interface{}); (data["cache_hit"] == true) != tt.wantHit {
+				t.Errorf("cache_hit = %v, want %v", data["cache_hit"], tt.wantHit)
+			}
+		})
+	}
+}
+
+// TestUploadCacheSkipsDifyUpload 开启上传去重缓存后，相同内容第二次上传不再调用Dify上传接口
+func TestUploadCacheSkipsDifyUpload(t *testing.T) {
+	previous := utils.GetUploadCache()
+	utils.SetUploadCache(utils.NewMemoryUploadCache(time.Hour))
+	t.Cleanup(func() { utils.SetUploadCache(previous) })
+
+	dify := newFakeDify(t)
+	r := newTestRouter()
+	body, _ := json.Marshal(map[string]interface{}{
+		"domain": dify.server.URL,
+		"user":   "u1",
+		"inputs": map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+	})
+	call := workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}
+
+	for i, wantHit := range []bool{false, true} {
+		w := call.do(r, "app-key")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		files := decodeResponse(t, w)["data"].(map[string]interface{})["file_response"].([]interface{})
+		file := files[0].(map[string]interface{})
+		if hit, _ := file["cache_hit"].(bool); hit != wantHit || file["id"] != "file-1" {
+			t.Errorf("第%d次上传 file_response = %v", i+1, file)
+		}
+	}
+
+	dify.mu.Lock()
+	uploads := dify.uploads
+	dify.mu.Unlock()
+	if uploads != 1 {
+		t.Errorf("Dify上传次数 = %d, want 1", uploads)
+	}
+}
+
+// TestWorkflowHandlersOutputSpec 按output规则提取字段并只返回提取结果和元数据
+func TestWorkflowHandlersOutputSpec(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	output := `{"select":{"ok":"data.outputs.ok"},"flatten":true}`
+	for _, call := range buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL, "output": output}) {
+		if strings.HasPrefix(call.name, "json") {
+			// JSON请求中output为对象
+			var payload map[string]interface{}
+			json.Unmarshal(call.body, &payload)
+			var spec interface{}
+			json.Unmarshal([]byte(output), &spec)
+			payload["output"] = spec
+			call.body, _ = json.Marshal(payload)
+		}
+
+		t.Run(call.name, func(t *testing.T) {
+			w := call.do(r, "app-key")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			data := decodeResponse(t, w)["data"].(map[string]interface{})
+			if _, ok := data["workflow_data"]; ok {
+				t.Error("flatten时不应返回workflow_data")
+			}
+			if result, _ := data["output"].(map[string]interface{}); result["ok"] != true {
+				t.Errorf("output = %v", data["output"])
+			}
+			if metadata, _ := data["metadata"].(map[string]interface{}); metadata["status"] != "succeeded" {
+				t.Errorf("metadata = %v", data["metadata"])
+			}
+			if inputs := dify.lastRun(t)["inputs"].(map[string]interface{}); inputs["output"] != nil {
+				t.Errorf("output不应作为inputs传递: %v", inputs)
+			}
+		})
+	}
+}
+
+// TestWorkflowHandlersOutputSchema 输出不符合JSON Schema时重新执行，超过次数后返回schema_violation
+func TestWorkflowHandlersOutputSchema(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":       "object",
+		"required":   []string{"score"},
+		"properties": map[string]interface{}{"score": map[string]interface{}{"type": "integer"}},
+	}
+	tests := []struct {
+		name          string
+		maxRetries    int
+		wantRuns      int
+		wantViolation bool
+	}{
+		{"重试后通过", 1, 2, false},
+		{"不重试", 0, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dify := newFakeDify(t)
+			dify.outputs = []string{`{"result":"无法解析"}`, `{"result":"{\"score\": 90}"}`}
+			r := newTestRouter()
+
+			body, _ := json.Marshal(map[string]interface{}{
+				"domain":        dify.server.URL,
+				"output_schema": map[string]interface{}{"field": "result", "schema": schema, "max_retries": tt.maxRetries},
+				"inputs": map[string]interface{}{
+					"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"},
+				},
+			})
+			w := workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}.do(r, "app-key")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			dify.mu.Lock()
+			runs := len(dify.runs)
+			dify.mu.Unlock()
+			if runs != tt.wantRuns {
+				t.Errorf("执行次数 = %d, want %d", runs, tt.wantRuns)
+			}
+
+			data := decodeResponse(t, w)["data"].(map[string]interface{})
+			violation, _ := data["schema_violation"].(map[string]interface{})
+			if (violation != nil) != tt.wantViolation {
+				t.Fatalf("schema_violation = %v", data["schema_violation"])
+			}
+			if tt.wantViolation && (violation["code"] != "schema_violation" || violation["attempts"] != float64(1) || data["error_message"] == nil) {
+				t.Errorf("data = %v", data)
+			}
+		})
+	}
+
+	// Schema错误在执行前返回
+	dify := newFakeDify(t)
+	body, _ := json.Marshal(map[string]interface{}{
+		"domain":        dify.server.URL,
+		"output_schema": map[string]interface{}{"field": "result", "schema_ref": "not-registered"},
+		"inputs":        map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+	})
+	if w := (workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}).do(newTestRouter(), "app-key"); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+// TestWorkflowHandlersRehostFiles 输出中的Dify文件被转存，响应和回调中的地址改写为 /dify/artifacts/:id
+func TestWorkflowHandlersRehostFiles(t *testing.T) {
+	store, err := utils.NewLocalArtifactStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.SetArtifactStore(store)
+
+	dify := newFakeDify(t)
+	dify.outputs = []string{`{"images":[{"dify_model_identity":"__dify__file__","filename":"chart.png","mime_type":"image/png",
+		"url":"/files/tools/chart.png?timestamp=1&sign=abc"}]}`}
+	r := newTestRouter()
+
+	// 检查响应中的文件地址并下载转存的文件
+	checkRehosted := func(t *testing.T, result map[string]interface{}) {
+		t.Helper()
+		outputs := result["workflow_data"].(map[string]interface{})["data"].(map[string]interface{})["outputs"].(map[string]interface{})
+		file := outputs["images"].([]interface{})[0].(map[string]interface{})
+		fileURL, _ := file["url"].(string)
+		if !strings.HasPrefix(fileURL, "/dify/artifacts/") || file["artifact_id"] == nil {
+			t.Fatalf("file = %v", file)
+		}
+		if artifacts, _ := result["artifacts"].([]interface{}); len(artifacts) != 1 {
+			t.Errorf("artifacts = %v", result["artifacts"])
+		}
+
+		req := httptest.NewRequest(http.MethodGet, fileURL, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != "\x89PNG\r\n\x1a\nchart" {
+			t.Fatalf("status = %d, body = %q", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Content-Disposition") != `attachment; filename=chart.png` ||
+			w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("header = %v", w.Header())
+		}
+	}
+
+	payload := map[string]interface{}{
+		"domain":       dify.server.URL,
+		"rehost_files": true,
+		"inputs":       map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+	}
+	body, _ := json.Marshal(payload)
+	w := workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}.do(r, "app-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	checkRehosted(t, decodeResponse(t, w)["data"].(map[string]interface{}))
+
+	// 异步请求的回调
+	payload["async"] = map[string]interface{}{"callback_url": dify.server.URL + "/callback"}
+	body, _ = json.Marshal(payload)
+	w = workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}.do(r, "app-key")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	select {
+	case callback := <-dify.callbacks:
+		checkRehosted(t, callback["result"].(map[string]interface{}))
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待回调超时")
+	}
+
+	// 不存在的文件
+	for _, id := range []string{"00000000-0000-0000-0000-000000000000", "..%2Fsecret"} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dify/artifacts/"+id, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d", id, w.Code)
+		}
+	}
+}
+
+// TestWorkflowHandlersAggregate aggregate模式以streaming调用Dify，返回blocking结构的响应
+func TestWorkflowHandlersAggregate(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	for _, call := range buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL, "response_mode": "aggregate"}) {
+		t.Run(call.name, func(t *testing.T) {
+			w := call.do(r, "app-key")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if run := dify.lastRun(t); run["response_mode"] != "streaming" {
+				t.Errorf("response_mode = %v, want streaming", run["response_mode"])
+			}
+
+			data := decodeResponse(t, w)["data"].(map[string]interface{})
+			workflow := data["workflow_data"].(map[string]interface{})
+			result := workflow["data"].(map[string]interface{})
+			if workflow["workflow_run_id"] != "run-1" || result["status"] != "succeeded" {
+				t.Errorf("workflow_data = %v", workflow)
+			}
+			if _, ok := result["nodes"].([]interface{}); !ok {
+				t.Errorf("缺少nodes: %v", result)
+			}
+		})
+	}
+}
+
+func TestWorkflowHandlersValidation(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		apiKey   string
+		wantCode int
+		wantMsg  string
+	}{
+		{"缺少API密钥", map[string]string{"domain": dify.server.URL}, "", http.StatusUnauthorized, "未提供API密钥"},
+		{"缺少域名", map[string]string{}, "app-key", http.StatusBadRequest, "域名不能为空"},
+		{"无效响应模式", map[string]string{"domain": dify.server.URL, "response_mode": "sync"}, "app-key", http.StatusBadRequest, "响应模式只支持 blocking、streaming 或 aggregate"},
+		{"无效缓存模式", map[string]string{"domain": dify.server.URL, "cache": "always"}, "app-key", http.StatusBadRequest, "cache参数只支持 bypass 或 refresh"},
+	}
+
+	for _, tt := range tests {
+		for _, call := range buildCalls(t, dify.server.URL, tt.fields) {
+			t.Run(tt.name+"/"+call.name, func(t *testing.T) {
+				w := call.do(r, tt.apiKey)
+				if w.Code != tt.wantCode {
+					t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.wantCode, w.Body.String())
+				}
+				if msg := decodeResponse(t, w)["message"]; msg != tt.wantMsg {
+					t.Errorf("message = %v, want %q", msg, tt.wantMsg)
+				}
+			})
+		}
+	}
+}
+
+func TestWorkflowHandlersStreaming(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	for _, call := range buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL, "response_mode": "streaming"}) {
+		t.Run(call.name, func(t *testing.T) {
+			w := call.do(r, "app-key")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Header().Get("Content-Type"), "text/event-stream") {
+				t.Errorf("Content-Type = %s", w.Header().Get("Content-Type"))
+			}
+
+			// 连续的同名进度事件只记录一次
+			var names []string
+			var summary, progress map[string]interface{}
+			reader := utils.NewSSEReader(w.Body)
+			for {
+				event, err := reader.Next()
+				if err != nil {
+					break
+				}
+				name := event.Name()
+				if len(names) == 0 || names[len(names)-1] != name {
+					names = append(names, name)
+				}
+				switch name {
+				case "summary":
+					json.Unmarshal([]byte(event.Data), &summary)
+				case "upload_progress":
+					json.Unmarshal([]byte(event.Data), &progress)
+				}
+			}
+
+			// URL文件先下载再上传，form-data文件直接上传
+			want := []string{"upload_progress", "files_uploaded", "ping", "workflow_started", "text_chunk", "workflow_finished", "summary"}
+			if strings.HasPrefix(call.name, "json") {
+				want = append([]string{"download_progress"}, want...)
+			}
+			if strings.Join(names, ",") != strings.Join(want, ",") {
+				t.Fatalf("事件顺序 = %v, want %v", names, want)
+			}
+			if summary["task_id"] != "task-1" || summary["workflow_run_id"] != "run-1" {
+				t.Errorf("summary = %v", summary)
+			}
+			if data := summary["data"].(map[string]interface{}); data["status"] != "succeeded" || data["file_count"] != float64(1) {
+				t.Errorf("summary data = %v", data)
+			}
+			// 最后一个上传进度事件为100%
+			if data := progress["data"].(map[string]interface{}); data["file_value"] != "doc" || data["percentage"] != float64(100) {
+				t.Errorf("upload_progress data = %v", data)
+			}
+
+			// 执行结果可按X-Request-ID查询
+			requestID := w.Header().Get("X-Request-ID")
+			if requestID == "" {
+				t.Fatal("缺少X-Request-ID响应头")
+			}
+			status := get(r, "/dify/async/"+requestID, map[string]string{"Authorization": "Bearer app-key"})
+			data := decodeResponse(t, status)["data"].(map[string]interface{})
+			result, _ := data["result"].(map[string]interface{})
+			if data["status"] != "completed" || data["workflow_run_id"] != "run-1" || result["text"] != "ok" {
+				t.Errorf("async status = %v", data)
+			}
+		})
+	}
+}
+
+// TestStreamEventsReplay 按Last-Event-ID重放之后的事件
+func TestStreamEventsReplay(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	call := buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL, "response_mode": "streaming"})[0]
+	w := call.do(r, "app-key")
+	all := readEvents(t, w.Body)
+
+	replay := get(r, "/dify/stream/"+w.Header().Get("X-Request-ID"), map[string]string{"Last-Event-ID": "3", "Authorization": "Bearer app-key"})
+	events := readEvents(t, replay.Body)
+	if len(events) != len(all)-3 {
+		t.Fatalf("重放事件数 = %d, want %d", len(events), len(all)-3)
+	}
+	if events[0].ID != "4" || events[0].Data != all[3].Data || events[len(events)-1].Name() != "summary" {
+		t.Errorf("重放事件 = %+v", events)
+	}
+
+	if w := get(r, "/dify/stream/not-exist", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
+
+// TestRequestOwnerAuthorization 查询结果和续传事件需提供发起请求时使用的API密钥
+func TestRequestOwnerAuthorization(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	call := buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL, "response_mode": "streaming"})[0]
+	w := call.do(r, "app-key")
+	readEvents(t, w.Body)
+	requestID := w.Header().Get("X-Request-ID")
+
+	for _, path := range []string{"/dify/async/" + requestID, "/dify/stream/" + requestID} {
+		tests := []struct {
+			name     string
+			headers  map[string]string
+			wantCode int
+		}{
+			{"未提供API密钥", nil, http.StatusUnauthorized},
+			{"其他API密钥", map[string]string{"Authorization": "Bearer other-key"}, http.StatusForbidden},
+			{"同一API密钥", map[string]string{"Authorization": "Bearer app-key"}, http.StatusOK},
+		}
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				w := get(r, path, tt.headers)
+				if w.Code != tt.wantCode {
+					t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+				}
+				if tt.wantCode != http.StatusOK && (strings.Contains(w.Body.String(), "run-1") || strings.Contains(w.Body.String(), "event:")) {
+					t.Errorf("未授权时不应返回结果或事件: %s", w.Body.String())
+				}
+			})
+		}
+	}
+}
+
+// TestAsyncRequestIDOwnership 其他API密钥不能复用已存在的请求ID，关联执行ID后仍只有发起请求的API密钥可以查询
+func TestAsyncRequestIDOwnership(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	submit := func(apiKey string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"domain": dify.server.URL,
+			"async":  map[string]interface{}{"callback_url": dify.server.URL + "/callback", "request_id": "job-owned"},
+			"inputs": map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+		})
+		return workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}.do(r, apiKey)
+	}
+
+	if w := submit("app-key"); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	select {
+	case <-dify.callbacks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待回调超时")
+	}
+
+	if w := submit("other-key"); w.Code != http.StatusConflict {
+		t.Errorf("其他API密钥复用请求ID: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := get(r, "/dify/async/job-owned", map[string]string{"Authorization": "Bearer other-key"}); w.Code != http.StatusForbidden {
+		t.Errorf("其他API密钥查询: status = %d", w.Code)
+	}
+	w := get(r, "/dify/async/job-owned", map[string]string{"Authorization": "Bearer app-key"})
+	if data := decodeResponse(t, w)["data"].(map[string]interface{}); w.Code != http.StatusOK || data["workflow_run_id"] != "run-1" {
+		t.Errorf("发起请求的API密钥查询: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+// TestWorkflowHandlersStreamingResume 开启stream_resume时客户端断开后继续执行，之后可续传剩余事件
+func TestWorkflowHandlersStreamingResume(t *testing.T) {
+	dify := newFakeDify(t)
+	dify.holdStream = true
+	r := newTestRouter()
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"domain":        dify.server.URL,
+		"response_mode": "streaming",
+		"stream_resume": true,
+		"inputs": map[string]interface{}{
+			"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/dify/fileSingle/workflow", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer app-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestID := resp.Header.Get("X-Request-ID")
+
+	// 收到workflow_started后断开连接，再让Dify继续输出
+	var lastEventID string
+	reader := utils.NewSSEReader(resp.Body)
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			t.Fatalf("未收到workflow_started: %v", err)
+		}
+		lastEventID = event.ID
+		if event.Name() == "workflow_started" {
+			break
+		}
+	}
+	cancel()
+	resp.Body.Close()
+	close(dify.release)
+
+	// 续传剩余事件，请求结束后返回
+	replay, err := http.NewRequest(http.MethodGet, server.URL+"/dify/stream/"+requestID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay.Header.Set("Last-Event-ID", lastEventID)
+	replay.Header.Set("Authorization", "Bearer app-key")
+	replayResp, err := http.DefaultClient.Do(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayResp.Body.Close()
+
+	var names []string
+	for _, event := range readEvents(t, replayResp.Body) {
+		names = append(names, event.Name())
+	}
+	if want := "text_chunk,workflow_finished,summary"; strings.Join(names, ",") != want {
+		t.Errorf("续传事件 = %v, want %s", names, want)
+	}
+
+	select {
+	case stop := <-dify.stops:
+		t.Errorf("开启stream_resume时不应停止任务: %s", stop)
+	default:
+	}
+	data := decodeResponse(t, get(r, "/dify/async/"+requestID, map[string]string{"Authorization": "Bearer app-key"}))["data"].(map[string]interface{})
+	if data["status"] != "completed" {
+		t.Errorf("async status = %v", data)
+	}
+}
+
+// get 发起GET请求
+func get(r *gin.Engine, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// readEvents 读取全部SSE事件
+func readEvents(t *testing.T, body io.Reader) []*utils.SSEEvent {
+	t.Helper()
+
+	var events []*utils.SSEEvent
+	reader := utils.NewSSEReader(body)
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+}
+
+// TestWorkflowHandlersStreamingUploadError 流式请求中文件处理失败时返回SSE的error事件
+func TestWorkflowHandlersStreamingUploadError(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"domain":        dify.server.URL,
+		"response_mode": "streaming",
+		"inputs": map[string]interface{}{
+			"file": map[string]interface{}{"file_url": dify.server.URL + "/files/missing.pdf", "file_value": "doc"},
+		},
+	})
+	call := workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}
+	w := call.do(r, "app-key")
+	if !strings.Contains(w.Header().Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("Content-Type = %s, body = %s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	var last *utils.SSEEvent
+	reader := utils.NewSSEReader(w.Body)
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			break
+		}
+		last = event
+	}
+	if last == nil || last.Name() != "error" {
+		t.Fatalf("最后一个事件应为error: %s", w.Body.String())
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(last.Data), &payload)
+	if payload["code"] != "file_upload_failed" || payload["message"] == "" {
+		t.Errorf("error事件 = %v", payload)
+	}
+	if len(dify.runs) != 0 {
+		t.Error("文件处理失败时不应执行工作流")
+	}
+}
+
+// TestWorkflowHandlersStreamingClientDisconnect 客户端断开连接时中止上游请求并停止Dify任务
+func TestWorkflowHandlersStreamingClientDisconnect(t *testing.T) {
+	dify := newFakeDify(t)
+	dify.holdStream = true
+	server := httptest.NewServer(newTestRouter())
+	defer server.Close()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"domain":        dify.server.URL,
+		"user":          "u1",
+		"response_mode": "streaming",
+		"inputs": map[string]interface{}{
+			"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/dify/fileSingle/workflow", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer app-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// 收到workflow_started后断开连接
+	reader := utils.NewSSEReader(resp.Body)
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			t.Fatalf("未收到workflow_started: %v", err)
+		}
+		if event.Name() == "workflow_started" {
+			break
+		}
+	}
+	cancel()
+
+	select {
+	case stop := <-dify.stops:
+		if stop != "task-1|u1" {
+			t.Errorf("stop = %s, want task-1|u1", stop)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("客户端断开连接后未停止Dify任务")
+	}
+}
+
+// TestWorkflowHandlersAsync 异步请求在返回后处理，form-data文件在请求返回前已读取
+func TestWorkflowHandlersAsync(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	fields := map[string]string{"domain": dify.server.URL, "callback_url": dify.server.URL + "/callback"}
+	for _, call := range buildCalls(t, dify.server.URL, fields) {
+		t.Run(call.name, func(t *testing.T) {
+			w := call.do(r, "app-key")
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			select {
+			case callback := <-dify.callbacks:
+				result := callback["result"].(map[string]interface{})
+				if msg, ok := result["error_message"]; ok {
+					t.Fatalf("异步处理失败: %v", msg)
+				}
+				if files, _ := result["file_response"].([]interface{}); len(files) != 1 {
+					t.Errorf("file_response = %v", result["file_response"])
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("等待回调超时")
+			}
+		})
+	}
+}
+
+// TestAsyncWorkflowRunLinked 异步请求在得知执行ID时立即关联，按Schema重新执行时保留每次的执行ID
+func TestAsyncWorkflowRunLinked(t *testing.T) {
+	// queryStatus 查询异步请求状态
+	queryStatus := func(t *testing.T, r *gin.Engine, requestID string) map[string]interface{} {
+		t.Helper()
+		w := get(r, "/dify/async/"+requestID, map[string]string{"Authorization": "Bearer app-key"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		return decodeResponse(t, w)["data"].(map[string]interface{})
+	}
+	// submit 提交异步请求，返回请求ID
+	submit := func(t *testing.T, r *gin.Engine, payload map[string]interface{}) string {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		w := workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}.do(r, "app-key")
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		return decodeResponse(t, w)["data"].(map[string]interface{})["request_id"].(string)
+	}
+	// waitCallback 等待回调
+	waitCallback := func(t *testing.T, dify *fakeDify) {
+		t.Helper()
+		select {
+		case <-dify.callbacks:
+		case <-time.After(5 * time.Second):
+			t.Fatal("等待回调超时")
+		}
+	}
+
+	t.Run("aggregate模式执行期间可查询执行ID", func(t *testing.T) {
+		dify := newFakeDify(t)
+		dify.holdStream = true
+		r := newTestRouter()
+
+		requestID := submit(t, r, map[string]interface{}{
+			"domain":        dify.server.URL,
+			"response_mode": "aggregate",
+			"async":         map[string]interface{}{"callback_url": dify.server.URL + "/callback"},
+			"inputs":        map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+		})
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			data := queryStatus(t, r, requestID)
+			if data["workflow_run_id"] == "run-1" {
+				if data["status"] != "processing" || data["task_id"] != "task-1" {
+					t.Errorf("data = %v", data)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("执行期间未关联执行ID: %v", data)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		close(dify.release)
+		waitCallback(t, dify)
+	})
+
+	t.Run("重新执行时保留每次的执行ID", func(t *testing.T) {
+		dify := newFakeDify(t)
+		dify.outputs = []string{`{"result":"无法解析"}`, `{"result":"{\"score\": 90}"}`}
+		r := newTestRouter()
+
+		requestID := submit(t, r, map[string]interface{}{
+			"domain": dify.server.URL,
+			"async":  map[string]interface{}{"callback_url": dify.server.URL + "/callback"},
+			"output_schema": map[string]interface{}{
+				"field":       "result",
+				"schema":      map[string]interface{}{"type": "object", "required": []string{"score"}},
+				"max_retries": 1,
+			},
+			"inputs": map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+		})
+		waitCallback(t, dify)
+
+		data := queryStatus(t, r, requestID)
+		if ids := fmt.Sprint(data["workflow_run_ids"]); ids != "[run-1 run-2]" {
+			t.Errorf("workflow_run_ids = %s", ids)
+		}
+		if data["workflow_run_id"] != "run-2" || data["task_id"] != "task-2" {
+			t.Errorf("data = %v", data)
+		}
+	})
+}
+
+// TestWorkflowRunAndLogsHandlers 代理Dify的执行详情和日志接口，异步请求按关联的执行ID获取实时详情
+func TestWorkflowRunAndLogsHandlers(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+	auth := map[string]string{"Authorization": "Bearer app-key"}
+	domain := url.QueryEscape(dify.server.URL)
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  map[string]string
+		wantCode int
+		want     string // data中应包含的内容
+	}{
+		{"执行详情", "/dify/workflows/run/run-7?domain=" + domain, auth, http.StatusOK, `"id":"run-7"`},
+		{"执行ID不存在时透传404", "/dify/workflows/run/missing?domain=" + domain, auth, http.StatusNotFound, ""},
+		{"未提供API密钥", "/dify/workflows/run/run-7?domain=" + domain, nil, http.StatusUnauthorized, ""},
+		{"缺少域名", "/dify/workflows/logs", auth, http.StatusBadRequest, ""},
+		{
+			"日志只转发支持的查询参数",
+			"/dify/workflows/logs?domain=" + domain + "&keyword=" + url.QueryEscape("合同") + "&status=succeeded&page=2&limit=5&user=x",
+			auth, http.StatusOK, `"query":{"keyword":"合同","limit":"5","page":"2","status":"succeeded"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(r, tt.path, tt.headers)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.want == "" {
+				return
+			}
+			data, _ := json.Marshal(decodeResponse(t, w)["data"])
+			if !strings.Contains(string(data), tt.want) {
+				t.Errorf("data = %s, want %s", data, tt.want)
+			}
+		})
+	}
+
+	// 异步请求完成后按关联的执行ID获取实时详情
+	body, _ := json.Marshal(map[string]interface{}{
+		"domain": dify.server.URL,
+		"async":  map[string]interface{}{"callback_url": dify.server.URL + "/callback"},
+		"inputs": map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+	})
+	w := workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}.do(r, "app-key")
+	requestID := decodeResponse(t, w)["data"].(map[string]interface{})["request_id"].(string)
+	select {
+	case <-dify.callbacks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待回调超时")
+	}
+
+	data := decodeResponse(t, get(r, "/dify/async/"+requestID, auth))["data"].(map[string]interface{})
+	run, _ := data["workflow_run"].(map[string]interface{})
+	if data["workflow_run_id"] != "run-1" || run["id"] != "run-1" || run["status"] != "succeeded" {
+		t.Errorf("data = %v", data)
+	}
+}
+
+// TestFormInputsCoercedBySchema form-data字段按应用参数转换类型，JSON请求保持原值
+func TestFormInputsCoercedBySchema(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	for _, call := range buildCalls(t, dify.server.URL, map[string]string{"domain": dify.server.URL}) {
+		t.Run(call.name, func(t *testing.T) {
+			if w := call.do(r, "app-key"); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			count := dify.lastRun(t)["inputs"].(map[string]interface{})["count"]
+			want := interface{}("3")
+			if strings.HasPrefix(call.name, "form") {
+				want = float64(3)
+			}
+			if count != want {
+				t.Errorf("count = %#v, want %#v", count, want)
+			}
+		})
+	}
+
+	// 带类型后缀的字段保持客户端指定的类型；所有字段都已指定类型时不获取应用参数
+	tests := []struct {
+		name           string
+		fields         map[string]string
+		wantInputs     map[string]interface{}
+		wantParameters int
+	}{
+		{
+			name:           "类型后缀优先于应用参数",
+			fields:         map[string]string{"zip:string": "00123", "count": "3"},
+			wantInputs:     map[string]interface{}{"zip": "00123", "count": float64(3)},
+			wantParameters: 1,
+		},
+		{
+			name:           "全部指定类型时不获取应用参数",
+			fields:         map[string]string{"zip:string": "00123", "count:number": "3"},
+			wantInputs:     map[string]interface{}{"zip": "00123", "count": float64(3)},
+			wantParameters: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dify := newFakeDify(t)
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			writer.WriteField("domain", dify.server.URL)
+			writer.WriteField("file_value", "doc")
+			for key, value := range tt.fields {
+				writer.WriteField(key, value)
+			}
+			part, _ := writer.CreateFormFile("file", "a.pdf")
+			part.Write([]byte("%PDF-1.4 test"))
+			writer.Close()
+
+			call := workflowCall{path: "/dify/fileSingle/formdata/workflow", contentType: writer.FormDataContentType(), body: body.Bytes()}
+			if w := call.do(r, "app-key"); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			inputs := dify.lastRun(t)["inputs"].(map[string]interface{})
+			for key, want := range tt.wantInputs {
+				if inputs[key] != want {
+					t.Errorf("%s = %#v, want %#v", key, inputs[key], want)
+				}
+			}
+			dify.mu.Lock()
+			defer dify.mu.Unlock()
+			if dify.parameters != tt.wantParameters {
+				t.Errorf("获取应用参数 %d 次, want %d", dify.parameters, tt.wantParameters)
+			}
+		})
+	}
+}
+
+// dialWebSocket 连接测试服务的WebSocket接口
+func dialWebSocket(t *testing.T, serverURL string) *websocket.Conn {
+	t.Helper()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer app-key")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(serverURL, "http")+"/dify/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readFrames 读取WebSocket消息直到指定事件（含），返回事件名称列表和最后一条消息
+func readFrames(t *testing.T, conn *websocket.Conn, until string) ([]string, map[string]interface{}) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var names []string
+	for {
+		var frame map[string]interface{}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("读取消息失败: %v, 已收到 %v", err, names)
+		}
+		name, _ := frame["event"].(string)
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+		if name == until {
+			return names, frame
+		}
+	}
+}
+
+func TestWebSocketWorkflow(t *testing.T) {
+	dify := newFakeDify(t)
+	server := httptest.NewServer(newTestRouter())
+	defer server.Close()
+	conn := dialWebSocket(t, server.URL)
+
+	// 参数错误返回error消息，连接保持可用
+	conn.WriteJSON(map[string]interface{}{"type": "run", "inputs": map[string]interface{}{}})
+	if _, frame := readFrames(t, conn, "error"); frame["code"] != "invalid_param" {
+		t.Errorf("error = %v", frame)
+	}
+
+	// 同一连接执行两次，分别使用文件URL和base64内联文件
+	for _, file := range []map[string]interface{}{
+		{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"},
+		{"file_base64": "JVBERi0xLjQ=", "filename": "b.pdf", "file_value": "doc"},
+	} {
+		conn.WriteJSON(map[string]interface{}{
+			"type":   "run",
+			"domain": dify.server.URL,
+			"inputs": map[string]interface{}{"file": file, "count": "3"},
+		})
+
+		names, summary := readFrames(t, conn, "summary")
+		if names[0] != "accepted" || !strings.Contains(strings.Join(names, ","), "upload_progress,files_uploaded,ping,workflow_started,text_chunk,workflow_finished,summary") {
+			t.Errorf("消息顺序 = %v", names)
+		}
+		if data := summary["data"].(map[string]interface{}); data["status"] != "succeeded" {
+			t.Errorf("summary = %v", summary)
+		}
+	}
+}
+
+func TestWebSocketStop(t *testing.T) {
+	// WebSocket不支持stream_resume，指定时stop消息仍然停止任务
+	for _, streamResume := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream_resume=%v", streamResume), func(t *testing.T) {
+			dify := newFakeDify(t)
+			dify.holdStream = true
+			server := httptest.NewServer(newTestRouter())
+			defer server.Close()
+			conn := dialWebSocket(t, server.URL)
+
+			conn.WriteJSON(map[string]interface{}{
+				"type":          "run",
+				"domain":        dify.server.URL,
+				"user":          "u1",
+				"stream_resume": streamResume,
+				"inputs":        map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+			})
+			readFrames(t, conn, "workflow_started")
+
+			conn.WriteJSON(map[string]interface{}{"type": "stop"})
+			if _, frame := readFrames(t, conn, "stopped"); frame["request_id"] == "" {
+				t.Errorf("stopped = %v", frame)
+			}
+			select {
+			case stop := <-dify.stops:
+				if stop != "task-1|u1" {
+					t.Errorf("stop = %s, want task-1|u1", stop)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("未停止Dify任务")
+			}
+		})
+	}
+}
+
+// TestWebSocketOriginAndReadLimit 校验连接来源，超过大小的消息关闭连接
+func TestWebSocketOriginAndReadLimit(t *testing.T) {
+	server := httptest.NewServer(newTestRouter())
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/dify/ws"
+
+	originalOrigins, originalSize := config.Config.WSAllowedOrigins, config.Config.WSMaxMessageSize
+	config.Config.WSAllowedOrigins = []string{"https://app.example.com"}
+	config.Config.WSMaxMessageSize = 1024
+	t.Cleanup(func() {
+		config.Config.WSAllowedOrigins, config.Config.WSMaxMessageSize = originalOrigins, originalSize
+	})
+
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{server.URL, true},
+		{"https://APP.example.com", true},
+		{"https://evil.example.com", false},
+	} {
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if tc.ok != (err == nil) {
+			t.Errorf("origin %q: err = %v", tc.origin, err)
+		}
+		if !tc.ok && resp != nil && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q: status = %d, want 403", tc.origin, resp.StatusCode)
+		}
+		if conn != nil {
+			// 收到回复后再关闭，确保服务端已完成连接设置
+			conn.WriteMessage(websocket.TextMessage, []byte("{"))
+			readFrames(t, conn, "error")
+			conn.Close()
+		}
+	}
+
+	conn := dialWebSocket(t, server.URL)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"run","inputs":{"text":"`+strings.Repeat("a", 2048)+`"}}`))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("err = %v, want close 1009", err)
+	}
+}
+
+// TestUploadHandlersNormalizeRequest 仅上传接口与工作流接口一样规范化和校验domain等参数
+func TestUploadHandlersNormalizeRequest(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+	fileURL := dify.server.URL + "/files/a.pdf"
+
+	jsonCall := func(path string, payload map[string]interface{}) workflowCall {
+		body, _ := json.Marshal(payload)
+		return workflowCall{path: path, contentType: "application/json", body: body}
+	}
+	formCall := func(fields map[string]string) workflowCall {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for key, value := range fields {
+			writer.WriteField(key, value)
+		}
+		part, _ := writer.CreateFormFile("file", "a.pdf")
+		part.Write([]byte("%PDF-1.4 test"))
+		writer.Close()
+		return workflowCall{path: "/dify/upload/formdata", contentType: writer.FormDataContentType(), body: body.Bytes()}
+	}
+
+	tests := []struct {
+		name     string
+		call     workflowCall
+		wantCode int
+	}{
+		{"url 末尾带/的域名", jsonCall("/dify/upload/url", map[string]interface{}{"domain": dify.server.URL + "/", "user": "u1", "file_url": fileURL}), http.StatusOK},
+		{"url 域名格式错误", jsonCall("/dify/upload/url", map[string]interface{}{"domain": "api.dify.ai", "user": "u1", "file_url": fileURL}), http.StatusBadRequest},
+		{"urls 末尾带/的域名", jsonCall("/dify/upload/urls", map[string]interface{}{"domain": dify.server.URL + "/", "user": "u1", "file_urls": []string{fileURL}}), http.StatusOK},
+		{"urls 回调地址格式错误", jsonCall("/dify/upload/urls", map[string]interface{}{"domain": dify.server.URL, "user": "u1", "file_urls": []string{fileURL}, "async": map[string]string{"callback_url": "ftp://x"}}), http.StatusBadRequest},
+		{"formdata 末尾带/的域名", formCall(map[string]string{"domain": " " + dify.server.URL + "/", "user": "u1"}), http.StatusOK},
+		{"formdata 域名格式错误", formCall(map[string]string{"domain": "api.dify.ai", "user": "u1"}), http.StatusBadRequest},
+		{"formdata 缺少用户", formCall(map[string]string{"domain": dify.server.URL}), http.StatusBadRequest},
+		{"formdata file_type_mapping格式错误", formCall(map[string]string{"domain": dify.server.URL, "user": "u1", "file_type_mapping": "{"}), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := tt.call.do(r, "app-key"); w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d, body = %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestUploadURLResultShape 同步和异步上传单个URL文件返回相同格式的上传结果
+func TestUploadURLResultShape(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	upload := func(async bool) *httptest.ResponseRecorder {
+		payload := map[string]interface{}{"domain": dify.server.URL, "user": "u1", "file_url": dify.server.URL + "/files/a.pdf"}
+		if async {
+			payload["async"] = map[string]interface{}{"callback_url": dify.server.URL + "/callback"}
+		}
+		body, _ := json.Marshal(payload)
+		return workflowCall{path: "/dify/upload/url", contentType: "application/json", body: body}.do(r, "app-key")
+	}
+
+	w := upload(false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	syncResult := decodeResponse(t, w)["data"].(map[string]interface{})
+
+	if w = upload(true); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var asyncResult map[string]interface{}
+	select {
+	case callback := <-dify.callbacks:
+		asyncResult = callback["result"].(map[string]interface{})
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待回调超时")
+	}
+
+	for _, result := range []map[string]interface{}{syncResult, asyncResult} {
+		if _, ok := result["file_response"]; ok || result["id"] == nil || result["name"] != "a.pdf" {
+			t.Errorf("result = %v", result)
+		}
+	}
+}
+
+// TestUsageHandler blocking和streaming执行的用量按用户和API密钥汇总，只能查询自己API密钥的用量
+func TestUsageHandler(t *testing.T) {
+	dify := newFakeDify(t)
+	r := newTestRouter()
+
+	for _, run := range []struct{ user, mode string }{{"alice", "blocking"}, {"bob", "streaming"}, {"alice", "aggregate"}} {
+		body, _ := json.Marshal(map[string]interface{}{
+			"domain":        dify.server.URL,
+			"user":          run.user,
+			"response_mode": run.mode,
+			"inputs":        map[string]interface{}{"file": map[string]interface{}{"file_url": dify.server.URL + "/files/a.pdf", "file_value": "doc"}},
+		})
+		if w := (workflowCall{path: "/dify/fileSingle/workflow", contentType: "application/json", body: body}).do(r, "usage-key"); w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", run.mode, w.Code, w.Body.String())
+		}
+	}
+
+	get := func(query string, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/dify/usage"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("?user=alice", "usage-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	data := decodeResponse(t, w)["data"].(map[string]interface{})
+	records := data["records"].([]interface{})
+	if len(records) != 1 {
+		t.Fatalf("records = %v", records)
+	}
+	record := records[0].(map[string]interface{})
+	if record["runs"] != float64(2) || record["total_tokens"] != float64(200) || record["api_key_hash"] != utils.HashAPIKey("usage-key") {
+		t.Errorf("record = %v", record)
+	}
+
+	// 按API密钥汇总
+	w = get("?group_by=api_key_hash", "usage-key")
+	total := decodeResponse(t, w)["data"].(map[string]interface{})["total"].(map[string]interface{})
+	if total["runs"] != float64(3) || total["total_tokens"] != float64(300) {
+		t.Errorf("total = %v", total)
+	}
+
+	// 其他API密钥看不到这些用量，管理令牌可以按api_key_hash查询
+	if records := decodeResponse(t, get("", "other-key"))["data"].(map[string]interface{})["records"].([]interface{}); len(records) != 0 {
+		t.Errorf("其他API密钥查询到了用量: %v", records)
+	}
+	config.Config.UsageAdminToken = "admin-token"
+	t.Cleanup(func() { config.Config.UsageAdminToken = "" })
+	w = get("?format=csv&group_by=user&api_key_hash="+utils.HashAPIKey("usage-key"), "admin-token")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || len(lines) != 3 || !strings.Contains(lines[0], "date,user,api_key_hash") || !strings.HasPrefix(lines[1], ",alice,,,2,0,200") {
+		t.Errorf("status = %d, csv = %q", w.Code, w.Body.String())
+	}
+
+	for _, query := range []string{"?from=2026/01/01", "?group_by=team", "?domain=example.com"} {
+		if w := get(query, "usage-key"); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d", query, w.Code)
+		}
+	}
+}
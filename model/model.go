@@ -1,5 +1,11 @@
 package model
 
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
 // DifyFileUploadResponse Dify文件上传响应
 type DifyFileUploadResponse struct {
 	ID        string `json:"id"`
@@ -9,6 +15,27 @@ type DifyFileUploadResponse struct {
 	MimeType  string `json:"mime_type"`
 	CreatedBy string `json:"created_by"`
 	CreatedAt int64  `json:"created_at"`
+
+	DeclaredMimeType string `json:"declared_mime_type,omitempty"` // 下载时响应头声明的类型
+	DetectedMimeType string `json:"detected_mime_type,omitempty"` // 根据文件内容检测出的类型
+	SourceArchive    string `json:"source_archive,omitempty"`     // 从压缩包展开时的压缩包文件名
+	SHA256           string `json:"sha256,omitempty"`             // 文件内容的SHA-256
+	CacheHit         bool   `json:"cache_hit"`                    // 是否复用了上传去重缓存中的文件
+}
+
+// FileTypeDetection 文件类型检测结果
+type FileTypeDetection struct {
+	Filename         string // 补全扩展名后的文件名
+	DeclaredMimeType string // 声明的MIME类型（Content-Type）
+	DetectedMimeType string // 内容嗅探得到的MIME类型
+}
+
+// DownloadedFile 下载得到的文件
+type DownloadedFile struct {
+	Content          []byte
+	Filename         string
+	DeclaredMimeType string
+	DetectedMimeType string
 }
 
 // DifyWorkflowRunRequest Dify工作流运行请求
@@ -31,23 +58,171 @@ type DifyWorkflowRunResponse struct {
 
 // SingleFileWorkflowRequest 单文件工作流请求
 type SingleFileWorkflowRequest struct {
-	Domain       string                 `json:"domain" binding:"required"`
-	Inputs       map[string]interface{} `json:"inputs" binding:"required"`
-	ResponseMode string                 `json:"response_mode" binding:"required"`
-	User         string                 `json:"user" binding:"required"`
+	Domain       string                 `json:"domain"`
+	Inputs       map[string]interface{} `json:"inputs"`
+	ResponseMode string                 `json:"response_mode"`   // 默认blocking
+	User         string                 `json:"user"`            // 默认DEFAULT_USER
 	Async        *AsyncRequest          `json:"async,omitempty"` // 异步请求配置，为空则为同步请求
+
+	ExpandArchives   *ArchiveOptions   `json:"expand_archives,omitempty"`    // 展开文件列表中的压缩包
+	FileTypeMapping  map[string]string `json:"file_type_mapping,omitempty"`  // 请求级扩展名到文件类型的映射
+	RefreshFileTypes bool              `json:"refresh_file_types,omitempty"` // 是否从目标应用的 /v1/parameters 获取允许的文件类型
+	Cache            string            `json:"cache,omitempty"`              // 结果缓存模式：bypass（跳过缓存）、refresh（重新执行并更新缓存）
+	CoerceInputs     bool              `json:"coerce_inputs,omitempty"`      // 是否按应用参数定义转换inputs中的字符串值（form-data请求默认开启）
+	StreamResume     bool              `json:"stream_resume,omitempty"`      // 流式请求的客户端断开连接后是否继续执行，之后可通过Last-Event-ID续传事件
+	Output           *OutputSpec       `json:"output,omitempty"`             // 输出提取规则（blocking、aggregate及异步请求）
+	OutputSchema     *OutputSchemaSpec `json:"output_schema,omitempty"`      // 输出JSON Schema校验规则（blocking、aggregate及异步请求）
+	RehostFiles      bool              `json:"rehost_files,omitempty"`       // 是否转存工作流输出中的文件，并将地址改写为 /dify/artifacts/:id（blocking、aggregate及异步请求）
+
+	TypedInputs []string `json:"-"` // form-data中已显式指定类型的变量名（带类型后缀或来自inputs JSON字段），不按应用参数转换
+}
+
+// OutputSchemaSpec 工作流输出的JSON Schema校验规则，schema和schema_ref二选一
+type OutputSchemaSpec struct {
+	Field      string          `json:"field"`                 // 校验的输出变量名（data.outputs中的字段，字符串按JSON解析）
+	Schema     json.RawMessage `json:"schema,omitempty"`      // JSON Schema
+	SchemaRef  string          `json:"schema_ref,omitempty"`  // 已注册的Schema名称（OUTPUT_SCHEMA_DIR中的 名称.json）
+	MaxRetries int             `json:"max_retries,omitempty"` // 校验失败时重新执行工作流的次数，默认0
+}
+
+// SchemaViolation 输出不符合JSON Schema的详情
+type SchemaViolation struct {
+	Code     string        `json:"code"`     // 固定为 schema_violation
+	Field    string        `json:"field"`    // 校验的输出变量名
+	Errors   []SchemaError `json:"errors"`   // 校验错误
+	Attempts int           `json:"attempts"` // 工作流执行次数
+}
+
+// SchemaError 单个JSON Schema校验错误
+type SchemaError struct {
+	Location string `json:"location"` // 出错位置（JSON Pointer）
+	Message  string `json:"message"`
+}
+
+// OutputSpec 工作流输出提取规则
+type OutputSpec struct {
+	Select    map[string]string `json:"select,omitempty"`     // 字段名到gjson路径，路径相对于Dify响应（如 data.outputs.text），可带 $. 前缀
+	ParseJSON []string          `json:"parse_json,omitempty"` // 按JSON解析的输出变量名（data.outputs中的字符串，允许被```json包裹）
+	Flatten   bool              `json:"flatten,omitempty"`    // 只返回提取的字段和元数据，不返回原始workflow_data
+}
+
+// WorkflowMetadata 工作流执行元数据
+type WorkflowMetadata struct {
+	TaskID        string  `json:"task_id,omitempty"`
+	WorkflowRunID string  `json:"workflow_run_id,omitempty"`
+	Status        string  `json:"status,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	ElapsedTime   float64 `json:"elapsed_time"`
+	TotalTokens   int64   `json:"total_tokens"`
+	TotalSteps    int64   `json:"total_steps"`
+}
+
+// WebSocketMessage WebSocket客户端消息
+// type为run时其余字段与JSON工作流请求相同（inputs.file 可以是单文件或文件列表），type为stop时停止执行中的工作流
+type WebSocketMessage struct {
+	Type   string `json:"type"`              // run：执行工作流；stop：停止执行中的工作流
+	APIKey string `json:"api_key,omitempty"` // 未在请求头中提供API密钥时使用
+	SingleFileWorkflowRequest
+}
+
+// UploadFilesRequest 仅上传文件请求（不执行工作流）
+type UploadFilesRequest struct {
+	Domain          string            `json:"domain" binding:"required"`
+	User            string            `json:"user" binding:"required"`
+	FileURLs        []FileSource      `json:"file_urls"`                   // 文件来源列表，元素可以是URL字符串或对象
+	Type            string            `json:"type,omitempty"`              // 可选，强制指定文件类型
+	FileTypeMapping map[string]string `json:"file_type_mapping,omitempty"` // 请求级扩展名到文件类型的映射
+	ExpandArchives  *ArchiveOptions   `json:"expand_archives,omitempty"`   // 展开压缩包
+	Async           *AsyncRequest     `json:"async,omitempty"`             // 异步请求配置，为空则为同步请求
+}
+
+// UploadFilesResponse 仅上传文件响应
+// FileMappings 与 FileResponse 一一对应，可直接作为后续工作流调用中文件变量的值
+type UploadFilesResponse struct {
+	FileResponse []DifyFileUploadResponse `json:"file_response"`
+	FileMappings []map[string]interface{} `json:"file_mappings"`
+	ErrorMessage string                   `json:"error_message,omitempty"`
+}
+
+// FileSource 文件来源，JSON中可以是URL字符串（含data URI），也可以是带请求参数的对象
+type FileSource struct {
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`    // 自定义请求头，如 Authorization、Cookie
+	BasicAuth *BasicAuth        `json:"basic_auth,omitempty"` // HTTP Basic 认证
+	Method    string            `json:"method,omitempty"`     // 请求方法，默认GET
+	Timeout   int               `json:"timeout,omitempty"`    // 下载超时（秒），默认60
+
+	Base64   string `json:"file_base64,omitempty"` // 内联文件内容（base64或data URI），与URL二选一
+	Filename string `json:"filename,omitempty"`    // 内联文件的文件名
+
+	UploadFileID string `json:"upload_file_id,omitempty"` // 已上传到Dify的文件ID，直接引用，不再下载上传
+	Type         string `json:"type,omitempty"`           // 可选，引用已上传文件时指定的文件类型
+
+	Content     []byte `json:"-"` // 已读取的文件内容（form-data上传）
+	ContentType string `json:"-"` // 上传时声明的Content-Type
 }
 
-// FileSingleInput 单文件输入结构
-type FileSingleInput struct {
-	FileURL   string `json:"file_url"`
-	FileValue string `json:"file_value" binding:"required"`
+// IsInline 是否为内联文件（已读取的内容、base64或data URI）
+func (f *FileSource) IsInline() bool {
+	return f.Content != nil || f.Base64 != "" || strings.HasPrefix(strings.ToLower(f.URL), "data:")
 }
 
-// FilesInput 多文件输入结构
-type FilesInput struct {
-	FileURLs  []string `json:"file_urls"`
-	FileValue string   `json:"file_value" binding:"required"`
+// FileVariable 工作流文件变量及其文件来源
+type FileVariable struct {
+	FileValue string       // 工作流中的变量名
+	Sources   []FileSource // 文件来源，按顺序上传
+	IsList    bool         // 是否为文件列表变量
+	Type      string       // 可选，强制指定文件类型
+}
+
+// BasicAuth HTTP Basic 认证信息
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// UnmarshalJSON 支持字符串和对象两种格式
+func (f *FileSource) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*f = FileSource{URL: url}
+		return nil
+	}
+
+	type fileSource FileSource
+	var source fileSource
+	if err := json.Unmarshal(data, &source); err != nil {
+		return err
+	}
+	*f = FileSource(source)
+	return nil
+}
+
+// ArchiveOptions 压缩包展开选项，JSON中可以是布尔值或对象
+type ArchiveOptions struct {
+	Enabled      bool     `json:"enabled"`
+	Include      []string `json:"include,omitempty"`        // 条目glob过滤，如 *.pdf
+	Types        []string `json:"types,omitempty"`          // 条目文件类型过滤，如 document、image
+	MaxEntries   int      `json:"max_entries,omitempty"`    // 最大条目数
+	MaxTotalSize int64    `json:"max_total_size,omitempty"` // 最大解压总字节数
+	MaxRatio     float64  `json:"max_ratio,omitempty"`      // 最大压缩比
+}
+
+// UnmarshalJSON 支持 true/false 和对象两种格式，对象格式默认启用
+func (a *ArchiveOptions) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*a = ArchiveOptions{Enabled: enabled}
+		return nil
+	}
+
+	type archiveOptions ArchiveOptions
+	options := archiveOptions{Enabled: true}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return err
+	}
+	*a = ArchiveOptions(options)
+	return nil
 }
 
 // ApiResponse API统一响应格式
@@ -62,26 +237,85 @@ type WorkflowResponse struct {
 	FileResponse []DifyFileUploadResponse `json:"file_response,omitempty"`
 	WorkflowData interface{}              `json:"workflow_data,omitempty"`
 	ErrorMessage string                   `json:"error_message,omitempty"`
+	CacheHit     bool                     `json:"cache_hit,omitempty"` // 工作流结果是否来自结果缓存
+	Output       map[string]interface{}   `json:"output,omitempty"`    // 按output规则提取的字段
+	Metadata     *WorkflowMetadata        `json:"metadata,omitempty"`  // 执行元数据（指定output规则时返回）
+
+	SchemaViolation *SchemaViolation `json:"schema_violation,omitempty"` // 输出不符合JSON Schema时的详情
+	Artifacts       []Artifact       `json:"artifacts,omitempty"`        // 本次转存的输出文件（指定rehost_files时返回）
+}
+
+// WorkflowUsage 单次工作流执行的用量
+type WorkflowUsage struct {
+	Status           string  // 执行状态，未结束时为空
+	TotalTokens      int64   // 消耗的总Token数
+	PromptTokens     int64   // 输入Token数（响应中包含usage时）
+	CompletionTokens int64   // 输出Token数（响应中包含usage时）
+	TotalPrice       float64 // 费用（响应中包含usage或节点执行元数据中有价格时）
+	Currency         string  // 费用币种
+	ElapsedTime      float64 // 执行耗时（秒）
+}
+
+// UsageRecord 按日期、终端用户、API密钥和域名汇总的用量
+type UsageRecord struct {
+	Date             string  `json:"date"`         // 日期（服务器本地时区，YYYY-MM-DD）
+	User             string  `json:"user"`         // 终端用户
+	APIKeyHash       string  `json:"api_key_hash"` // API密钥的SHA-256摘要
+	Domain           string  `json:"domain"`       // Dify域名
+	Runs             int64   `json:"runs"`         // 执行次数
+	FailedRuns       int64   `json:"failed_runs"`  // 未执行成功的次数
+	TotalTokens      int64   `json:"total_tokens"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalPrice       float64 `json:"total_price"`
+	Currency         string  `json:"currency,omitempty"`
+	ElapsedTime      float64 `json:"elapsed_time"` // 累计执行耗时（秒）
 }
 
-// FileTypeMapping 文件类型映射
-var FileTypeMapping = map[string]string{
+// UsageQuery 用量查询条件，字段为空表示不过滤
+type UsageQuery struct {
+	From       string   // 开始日期（含）
+	To         string   // 结束日期（含）
+	User       string   // 终端用户
+	APIKeyHash string   // API密钥摘要
+	Domain     string   // Dify域名
+	GroupBy    []string // 汇总维度：date、user、api_key_hash、domain，为空时按全部维度
+}
+
+// Artifact 转存的工作流输出文件
+type Artifact struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	Size      int64     `json:"size"`
+	URL       string    `json:"url"` // 固定访问地址
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DefaultFileTypeMapping 默认文件类型映射，与Dify支持的扩展名保持一致
+// 可通过配置追加或覆盖，参见 config.InitConfig
+var DefaultFileTypeMapping = map[string]string{
 	// document
-	"txt":      "document",
-	"md":       "document",
-	"markdown": "document",
-	"pdf":      "document",
-	"html":     "document",
-	"xlsx":     "document",
-	"xls":      "document",
-	"docx":     "document",
-	"csv":      "document",
-	"eml":      "document",
-	"msg":      "document",
-	"pptx":     "document",
-	"ppt":      "document",
-	"xml":      "document",
-	"epub":     "document",
+	"txt":        "document",
+	"md":         "document",
+	"mdx":        "document",
+	"markdown":   "document",
+	"pdf":        "document",
+	"html":       "document",
+	"htm":        "document",
+	"xlsx":       "document",
+	"xls":        "document",
+	"vtt":        "document",
+	"properties": "document",
+	"doc":        "document",
+	"docx":       "document",
+	"csv":        "document",
+	"eml":        "document",
+	"msg":        "document",
+	"pptx":       "document",
+	"ppt":        "document",
+	"xml":        "document",
+	"epub":       "document",
 
 	// image
 	"jpg":  "image",
@@ -95,14 +329,58 @@ var FileTypeMapping = map[string]string{
 	"mp3":  "audio",
 	"m4a":  "audio",
 	"wav":  "audio",
-	"webm": "audio",
 	"amr":  "audio",
+	"mpga": "audio",
 
 	// video
 	"mp4":  "video",
 	"mov":  "video",
 	"mpeg": "video",
-	"mpga": "video",
+	"webm": "video",
+}
+
+// FileTypeOptions 文件类型解析选项（请求级）
+type FileTypeOptions struct {
+	Type              string            // 强制指定的文件类型，优先级最高
+	Mapping           map[string]string // 请求级扩展名映射，覆盖全局配置
+	AllowedTypes      []string          // 目标应用允许的文件类型（来自 /v1/parameters）
+	AllowedExtensions []string          // 目标应用允许的自定义扩展名（来自 /v1/parameters）
+}
+
+// DifyAppParameters Dify应用参数（/v1/parameters）
+type DifyAppParameters struct {
+	UserInputForm []map[string]DifyInputFormItem `json:"user_input_form"`
+	FileUpload    *DifyFileUploadSetting         `json:"file_upload,omitempty"`
+}
+
+// DifyInputFormItem Dify应用输入表单项
+type DifyInputFormItem struct {
+	Label                 string      `json:"label"`
+	Variable              string      `json:"variable"`
+	Required              bool        `json:"required"`
+	Default               interface{} `json:"default,omitempty"`
+	Options               []string    `json:"options,omitempty"`
+	AllowedFileTypes      []string    `json:"allowed_file_types,omitempty"`
+	AllowedFileExtensions []string    `json:"allowed_file_extensions,omitempty"`
+}
+
+// DifyFileUploadSetting Dify应用文件上传设置
+type DifyFileUploadSetting struct {
+	Enabled               bool     `json:"enabled"`
+	AllowedFileTypes      []string `json:"allowed_file_types,omitempty"`
+	AllowedFileExtensions []string `json:"allowed_file_extensions,omitempty"`
+}
+
+// FindInput 根据变量名查找输入表单项，返回表单项类型（如 file、file-list、number）
+func (p *DifyAppParameters) FindInput(variable string) (string, *DifyInputFormItem) {
+	for _, entry := range p.UserInputForm {
+		for kind, item := range entry {
+			if item.Variable == variable {
+				return kind, &item
+			}
+		}
+	}
+	return "", nil
 }
 
 // AsyncRequest 异步请求结构体
@@ -116,4 +394,13 @@ type AsyncResponse struct {
 	RequestID string `json:"request_id"`        // 请求ID
 	Status    string `json:"status"`            // 状态: pending, processing, completed, failed
 	Message   string `json:"message,omitempty"` // 可选的消息
+
+	WorkflowRunID  string      `json:"workflow_run_id,omitempty"`  // 关联的Dify工作流执行ID（最近一次执行）
+	WorkflowRunIDs []string    `json:"workflow_run_ids,omitempty"` // 每次执行的Dify工作流执行ID，按执行顺序
+	TaskID         string      `json:"task_id,omitempty"`          // 最近一次执行的Dify任务ID
+	WorkflowRun    interface{} `json:"workflow_run,omitempty"`     // 从Dify实时获取的执行详情（查询时提供API密钥）
+	Result         interface{} `json:"result,omitempty"`           // 流式请求记录的执行结果
+	Domain         string      `json:"-"`                          // 执行工作流的Dify域名
+	APIKeyHash     string      `json:"-"`                          // 执行工作流的API密钥哈希，查询详情时校验
+	Streaming      bool        `json:"-"`                          // 是否为流式请求创建的记录，随事件记录一起过期清理
 }
@@ -3,6 +3,7 @@ package router
 import (
 	"dify-upload-workflow/config"
 	"dify-upload-workflow/controller"
+	"dify-upload-workflow/utils"
 	"log"
 	"net/http"
 	"os"
@@ -40,10 +41,16 @@ func SetupRouter() *gin.Engine {
 			"numGoroutine": runtime.NumGoroutine(),
 			"serverTime":   time.Now().Format(time.RFC3339),
 			"config": gin.H{
-				"maxUploadFiles": config.Config.MaxUploadFiles,
-				"maxFileSize":    config.Config.MaxFileSize,
-				"defaultTimeout": config.Config.DefaultApiTimeout,
+				"maxUploadFiles":    config.Config.MaxUploadFiles,
+				"maxFileSize":       config.Config.MaxFileSize,
+				"defaultTimeout":    config.Config.DefaultApiTimeout,
+				"maxInlineFileSize": config.Config.MaxInlineFileSize,
+				"fileTypeMapping":   config.GetFileTypeMapping(),
+				"uploadCache":       config.Config.UploadCache,
+				"uploadCacheTTL":    config.Config.UploadCacheTTL,
+				"artifactStore":     config.Config.ArtifactStore,
 			},
+			"resultCache": utils.GetResultCacheStats(),
 		})
 	})
 
@@ -65,8 +72,32 @@ func SetupRouter() *gin.Engine {
 		// 仅上传文件到dify
 		dify.POST("/upload/url", controller.UploadURLFileHandler)
 
+		// 批量上传URL文件到dify
+		dify.POST("/upload/urls", controller.UploadURLsHandler)
+
+		// 上传form-data文件到dify
+		dify.POST("/upload/formdata", controller.UploadFormDataHandler)
+
 		// 异步请求状态查询
 		dify.GET("/async/:requestID", controller.QueryAsyncStatus)
+
+		// WebSocket执行工作流
+		dify.GET("/ws", controller.WebSocketHandler)
+
+		// 续传流式请求的事件
+		dify.GET("/stream/:requestID", controller.StreamEventsHandler)
+
+		// 下载转存的工作流输出文件
+		dify.GET("/artifacts/:id", controller.ArtifactHandler)
+
+		// 工作流执行详情
+		dify.GET("/workflows/run/:workflowRunID", controller.WorkflowRunHandler)
+
+		// 工作流日志
+		dify.GET("/workflows/logs", controller.WorkflowLogsHandler)
+
+		// 工作流用量统计
+		dify.GET("/usage", controller.UsageHandler)
 	}
 
 	return r
@@ -115,7 +146,8 @@ func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Last-Event-ID")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
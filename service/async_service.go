@@ -3,9 +3,7 @@ package service
 import (
 	"dify-upload-workflow/model"
 	"dify-upload-workflow/utils"
-	"encoding/json"
 	"log"
-	"strings"
 )
 
 // AsyncProcessor 异步处理器
@@ -20,10 +18,14 @@ func NewAsyncProcessor(difyService *DifyService) *AsyncProcessor {
 	}
 }
 
-// ProcessSingleFileAsync 异步处理单文件请求
-func (p *AsyncProcessor) ProcessSingleFileAsync(request *model.SingleFileWorkflowRequest, fileInput *model.FileSingleInput) (model.AsyncResponse, error) {
+// ProcessFileWorkflowAsync 异步处理文件工作流请求，处理完成后回调结果
+// 文件来源需在调用前准备好（form-data上传的文件内容需已读取），因为处理发生在请求返回之后
+func (p *AsyncProcessor) ProcessFileWorkflowAsync(request *model.SingleFileWorkflowRequest, variables []model.FileVariable) (model.AsyncResponse, error) {
 	// 初始化异步请求
-	asyncResp := utils.InitAsyncRequest(request.Async)
+	asyncResp, err := utils.InitAsyncRequest(request.Async, p.DifyService.ApiKey)
+	if err != nil {
+		return asyncResp, err
+	}
 	requestID := asyncResp.RequestID
 
 	// 更新状态为处理中
@@ -31,91 +33,18 @@ func (p *AsyncProcessor) ProcessSingleFileAsync(request *model.SingleFileWorkflo
 
 	// 启动goroutine处理请求
 	go func() {
-		// 检查是否为streaming模式
-		if strings.ToLower(request.ResponseMode) == "streaming" {
-			// 对于streaming模式，我们需要特殊处理
-			// 1. 下载文件
-			fileContent, filename, err := utils.DownloadFile(fileInput.FileURL)
-			if err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "下载文件失败: "+err.Error())
-				utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "下载文件失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 2. 上传文件到Dify
-			fileResp, err := p.DifyService.UploadFile(fileContent, filename, request.User)
-			if err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "上传文件到Dify失败: "+err.Error())
-				utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "上传文件到Dify失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 3. 获取文件类型
-			fileType := utils.GetFileType(fileResp.Extension)
-
-			// 4. 构建文件映射
-			fileMap := map[string]interface{}{
-				"transfer_method": "local_file",
-				"upload_file_id":  fileResp.ID,
-				"type":            fileType,
-			}
-
-			// 5. 更新inputs中的文件信息
-			// 如果用户指定的变量名存在于inputs中，先移除它
-			delete(request.Inputs, fileInput.FileValue)
-			request.Inputs[fileInput.FileValue] = fileMap
-
-			// 6. 构建工作流请求，但强制使用blocking模式
-			workflowRequest := &model.DifyWorkflowRunRequest{
-				Inputs:       request.Inputs,
-				ResponseMode: "blocking", // 强制使用blocking模式处理异步请求
-				User:         request.User,
-			}
-
-			// 7. 执行工作流
-			respBody, err := p.DifyService.RunWorkflow(workflowRequest)
-			if err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "执行工作流失败: "+err.Error())
-				utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "执行工作流失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 8. 解析工作流响应
-			var workflowResp interface{}
-			if err = json.Unmarshal(respBody, &workflowResp); err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "解析工作流响应失败: "+err.Error())
-				utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "解析工作流响应失败: " + err.Error(),
-				})
-				return
-			}
-
-			// 9. 构建成功响应
-			result := &model.WorkflowResponse{
-				FileResponse: []model.DifyFileUploadResponse{*fileResp},
-				WorkflowData: workflowResp,
-			}
-
-			// 更新状态为完成
-			utils.UpdateAsyncRequestStatus(requestID, "completed", "处理完成")
-
-			// 回调成功结果
-			callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, result)
-			if callbackError != nil {
-				log.Printf("回调成功结果失败: %v", callbackError)
-			}
-			return
+		// 异步请求无法透传流式响应，使用blocking模式（aggregate模式保持不变）
+		if request.ResponseMode == "streaming" {
+			request.ResponseMode = "blocking"
 		}
 
-		// 对于非streaming模式，使用原有的处理逻辑
-		resp, err := p.DifyService.ProcessSingleFileWorkflow(request, fileInput)
+		// 得知工作流执行ID时立即关联，执行期间和回调失败时仍可通过状态查询接口获取执行详情；
+		// 按Schema重新执行时每次执行的ID都会记录
+		p.DifyService.OnWorkflowRun = func(workflowRunID string, taskID string) {
+			utils.LinkAsyncWorkflowRun(requestID, workflowRunID, taskID, p.DifyService.BaseURL)
+		}
 
+		resp, err := p.DifyService.ProcessFileWorkflow(request, variables)
 		if err != nil {
 			// 更新状态为失败
 			utils.UpdateAsyncRequestStatus(requestID, "failed", "处理失败: "+err.Error())
@@ -124,155 +53,98 @@ func (p *AsyncProcessor) ProcessSingleFileAsync(request *model.SingleFileWorkflo
 			callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
 				ErrorMessage: err.Error(),
 			})
-
 			if callbackError != nil {
 				log.Printf("回调错误结果失败: %v", callbackError)
 			}
 			return
 		}
 
-		// 更新状态为完成
-		utils.UpdateAsyncRequestStatus(requestID, "completed", "处理完成")
+		if resp.ErrorMessage != "" {
+			// 文件已上传但工作流执行失败
+			utils.UpdateAsyncRequestStatus(requestID, "failed", "执行工作流失败: "+resp.ErrorMessage)
+		} else {
+			// 更新状态为完成
+			utils.UpdateAsyncRequestStatus(requestID, "completed", "处理完成")
+		}
 
-		// 回调成功结果
+		// 回调结果
 		callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, resp)
 		if callbackError != nil {
-			log.Printf("回调成功结果失败: %v", callbackError)
+			log.Printf("回调结果失败: %v", callbackError)
 		}
 	}()
 
 	return asyncResp, nil
 }
 
-// ProcessMultiFilesAsync 异步处理多文件请求
-func (p *AsyncProcessor) ProcessMultiFilesAsync(request *model.SingleFileWorkflowRequest, filesInput *model.FilesInput) (model.AsyncResponse, error) {
+// ProcessUploadAsync 异步上传文件，上传完成后回调上传结果和文件映射
+func (p *AsyncProcessor) ProcessUploadAsync(request *model.SingleFileWorkflowRequest, variable model.FileVariable) (model.AsyncResponse, error) {
 	// 初始化异步请求
-	asyncResp := utils.InitAsyncRequest(request.Async)
+	asyncResp, err := utils.InitAsyncRequest(request.Async, p.DifyService.ApiKey)
+	if err != nil {
+		return asyncResp, err
+	}
 	requestID := asyncResp.RequestID
 
 	// 更新状态为处理中
 	utils.UpdateAsyncRequestStatus(requestID, "processing", "请求正在处理中")
 
-	// 启动goroutine处理请求
 	go func() {
-		// 检查是否为streaming模式
-		if strings.ToLower(request.ResponseMode) == "streaming" {
-			// 对于streaming模式，我们需要特殊处理
-			// 处理多个文件
-			var fileResponses []model.DifyFileUploadResponse
-			var fileMapList []interface{}
-
-			for _, fileURL := range filesInput.FileURLs {
-				// 下载文件
-				fileContent, filename, err := utils.DownloadFile(fileURL)
-				if err != nil {
-					utils.UpdateAsyncRequestStatus(requestID, "failed", "下载文件失败 ("+fileURL+"): "+err.Error())
-					utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-						ErrorMessage: "下载文件失败 (" + fileURL + "): " + err.Error(),
-					})
-					return
-				}
-
-				// 上传文件到Dify
-				fileResp, err := p.DifyService.UploadFile(fileContent, filename, request.User)
-				if err != nil {
-					utils.UpdateAsyncRequestStatus(requestID, "failed", "上传文件到Dify失败 ("+filename+"): "+err.Error())
-					utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-						ErrorMessage: "上传文件到Dify失败 (" + filename + "): " + err.Error(),
-					})
-					return
-				}
-
-				// 添加文件上传响应
-				fileResponses = append(fileResponses, *fileResp)
-
-				// 获取文件类型
-				fileType := utils.GetFileType(fileResp.Extension)
-
-				// 构建文件映射
-				fileMap := map[string]interface{}{
-					"transfer_method": "local_file",
-					"upload_file_id":  fileResp.ID,
-					"type":            fileType,
-				}
-
-				fileMapList = append(fileMapList, fileMap)
-			}
-
-			// 更新inputs中的文件信息列表
-			// 如果用户指定的变量名存在于inputs中，先移除它
-			delete(request.Inputs, filesInput.FileValue)
-			request.Inputs[filesInput.FileValue] = fileMapList
-
-			// 构建工作流请求，但强制使用blocking模式
-			workflowRequest := &model.DifyWorkflowRunRequest{
-				Inputs:       request.Inputs,
-				ResponseMode: "blocking", // 强制使用blocking模式处理异步请求
-				User:         request.User,
-			}
+		resp, err := p.DifyService.UploadFiles(request, variable)
+		if err != nil {
+			utils.UpdateAsyncRequestStatus(requestID, "failed", "上传失败: "+err.Error())
 
-			// 执行工作流
-			respBody, err := p.DifyService.RunWorkflow(workflowRequest)
-			if err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "执行工作流失败: "+err.Error())
-				utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "执行工作流失败: " + err.Error(),
-				})
-				return
+			callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, model.UploadFilesResponse{
+				ErrorMessage: err.Error(),
+			})
+			if callbackError != nil {
+				log.Printf("回调错误结果失败: %v", callbackError)
 			}
+			return
+		}
 
-			// 解析工作流响应
-			var workflowResp interface{}
-			if err = json.Unmarshal(respBody, &workflowResp); err != nil {
-				utils.UpdateAsyncRequestStatus(requestID, "failed", "解析工作流响应失败: "+err.Error())
-				utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-					ErrorMessage: "解析工作流响应失败: " + err.Error(),
-				})
-				return
-			}
+		utils.UpdateAsyncRequestStatus(requestID, "completed", "上传完成")
 
-			// 构建成功响应
-			result := &model.WorkflowResponse{
-				FileResponse: fileResponses,
-				WorkflowData: workflowResp,
-			}
+		callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, resp)
+		if callbackError != nil {
+			log.Printf("回调结果失败: %v", callbackError)
+		}
+	}()
 
-			// 更新状态为完成
-			utils.UpdateAsyncRequestStatus(requestID, "completed", "处理完成")
+	return asyncResp, nil
+}
 
-			// 回调成功结果
-			callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, result)
-			if callbackError != nil {
-				log.Printf("回调成功结果失败: %v", callbackError)
-			}
-			return
-		}
+// ProcessUploadFileAsync 异步上传单个文件，上传完成后回调与同步接口相同格式的上传结果
+func (p *AsyncProcessor) ProcessUploadFileAsync(request *model.SingleFileWorkflowRequest, source model.FileSource) (model.AsyncResponse, error) {
+	// 初始化异步请求
+	asyncResp, err := utils.InitAsyncRequest(request.Async, p.DifyService.ApiKey)
+	if err != nil {
+		return asyncResp, err
+	}
+	requestID := asyncResp.RequestID
 
-		// 对于非streaming模式，使用原有的处理逻辑
-		resp, err := p.DifyService.ProcessMultiFilesWorkflow(request, filesInput)
+	// 更新状态为处理中
+	utils.UpdateAsyncRequestStatus(requestID, "processing", "请求正在处理中")
 
+	go func() {
+		fileResp, err := p.DifyService.UploadFileSource(source, request.User)
 		if err != nil {
-			// 更新状态为失败
-			utils.UpdateAsyncRequestStatus(requestID, "failed", "处理失败: "+err.Error())
-
-			// 回调错误结果
-			callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, model.WorkflowResponse{
-				ErrorMessage: err.Error(),
-			})
+			utils.UpdateAsyncRequestStatus(requestID, "failed", "上传失败: "+err.Error())
 
+			callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, struct {
+				ErrorMessage string `json:"error_message"`
+			}{err.Error()})
 			if callbackError != nil {
 				log.Printf("回调错误结果失败: %v", callbackError)
 			}
 			return
 		}
 
-		// 更新状态为完成
-		utils.UpdateAsyncRequestStatus(requestID, "completed", "处理完成")
+		utils.UpdateAsyncRequestStatus(requestID, "completed", "上传完成")
 
-		// 回调成功结果
-		callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, resp)
+		callbackError := utils.CallbackResult(request.Async.CallbackURL, requestID, fileResp)
 		if callbackError != nil {
-			log.Printf("回调成功结果失败: %v", callbackError)
+			log.Printf("回调结果失败: %v", callbackError)
 		}
 	}()
 
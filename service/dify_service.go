@@ -2,21 +2,36 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"dify-upload-workflow/config"
 	"dify-upload-workflow/model"
 	"dify-upload-workflow/utils"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // DifyService Dify接口服务
 type DifyService struct {
 	BaseURL string
 	ApiKey  string
+
+	// Progress 文件下载/上传进度回调，流式请求中用于推送进度事件，为nil时不回调
+	Progress func(event string, data map[string]interface{})
+
+	// OnWorkflowRun 得知工作流执行ID时回调（流式为首个事件，blocking为每次执行后），为nil时不回调
+	OnWorkflowRun func(workflowRunID string, taskID string)
 }
 
 // NewDifyService 创建新的Dify服务实例
@@ -30,7 +45,43 @@ func NewDifyService(domain string, apiKey string) *DifyService {
 }
 
 // UploadFile 上传文件到Dify
+// 启用上传去重缓存时，相同内容在缓存有效期内直接复用已上传的文件ID
 func (s *DifyService) UploadFile(fileContent []byte, filename string, user string) (*model.DifyFileUploadResponse, error) {
+	return s.uploadFileWithProgress(context.Background(), fileContent, filename, user, nil)
+}
+
+// uploadFileWithProgress 上传文件到Dify并回调上传进度，ctx取消时中止上传
+func (s *DifyService) uploadFileWithProgress(ctx context.Context, fileContent []byte, filename string, user string, onProgress utils.ProgressFunc) (*model.DifyFileUploadResponse, error) {
+	cache := utils.GetUploadCache()
+	var cacheKey string
+	if cache != nil {
+		cacheKey = utils.UploadCacheKey(s.BaseURL, s.ApiKey, user, fileContent)
+		if cached, ok := cache.Get(cacheKey); ok {
+			cached.CacheHit = true
+			utils.SaveUploadRecord(s.BaseURL, s.ApiKey, cached)
+			if onProgress != nil {
+				size := int64(len(fileContent))
+				onProgress(size, size)
+			}
+			return cached, nil
+		}
+	}
+
+	fileResp, err := s.uploadFile(ctx, fileContent, filename, user, onProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		cache.Set(cacheKey, fileResp)
+	}
+	// 记录上传结果，后续按文件ID引用时可据此确定文件类型
+	utils.SaveUploadRecord(s.BaseURL, s.ApiKey, fileResp)
+	return fileResp, nil
+}
+
+// uploadFile 调用 /v1/files/upload 上传文件，onProgress按请求体字节数回调上传进度
+func (s *DifyService) uploadFile(ctx context.Context, fileContent []byte, filename string, user string, onProgress utils.ProgressFunc) (*model.DifyFileUploadResponse, error) {
 	url := fmt.Sprintf("%s/v1/files/upload", s.BaseURL)
 
 	// 创建multipart表单
@@ -57,10 +108,12 @@ func (s *DifyService) UploadFile(fileContent []byte, filename string, user strin
 	}
 
 	// 创建请求
-	req, err := http.NewRequest("POST", url, body)
+	bodySize := int64(body.Len())
+	req, err := http.NewRequestWithContext(ctx, "POST", url, utils.NewProgressReader(body, bodySize, onProgress))
 	if err != nil {
 		return nil, fmt.Errorf("创建HTTP请求失败: %w", err)
 	}
+	req.ContentLength = bodySize
 
 	// 设置请求头
 	req.Header.Set("Content-Type", writer.FormDataContentType())
@@ -101,6 +154,275 @@ func (s *DifyService) UploadFile(fileContent []byte, filename string, user strin
 	return &fileResponse, nil
 }
 
+// UploadFileSource 获取文件来源（URL下载或内联解码）并上传到Dify，响应中附带声明类型与检测类型
+func (s *DifyService) UploadFileSource(source model.FileSource, user string) (*model.DifyFileUploadResponse, error) {
+	downloaded, err := loadFileSource(context.Background(), source, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.UploadDownloadedFile(downloaded, user)
+}
+
+// UploadDownloadedFile 上传已获取内容的文件到Dify
+func (s *DifyService) UploadDownloadedFile(downloaded *model.DownloadedFile, user string) (*model.DifyFileUploadResponse, error) {
+	return s.uploadDownloadedFile(context.Background(), downloaded, user, nil)
+}
+
+// uploadDownloadedFile 上传已获取内容的文件到Dify并回调上传进度
+func (s *DifyService) uploadDownloadedFile(ctx context.Context, downloaded *model.DownloadedFile, user string, onProgress utils.ProgressFunc) (*model.DifyFileUploadResponse, error) {
+	fileResp, err := s.uploadFileWithProgress(ctx, downloaded.Content, downloaded.Filename, user, onProgress)
+	if err != nil {
+		return nil, fmt.Errorf("上传文件到Dify失败 (%s): %w", downloaded.Filename, err)
+	}
+
+	fileResp.DeclaredMimeType = downloaded.DeclaredMimeType
+	fileResp.DetectedMimeType = downloaded.DetectedMimeType
+	contentSum := sha256.Sum256(downloaded.Content)
+	fileResp.SHA256 = hex.EncodeToString(contentSum[:])
+
+	return fileResp, nil
+}
+
+// loadFileSource 获取文件内容（错误信息已脱敏），typeOpts用于补全扩展名，onProgress回调下载进度
+func loadFileSource(ctx context.Context, source model.FileSource, typeOpts *model.FileTypeOptions, onProgress utils.ProgressFunc) (*model.DownloadedFile, error) {
+	downloaded, err := utils.LoadFileSourceWithProgress(ctx, source, typeOpts, onProgress)
+	if err != nil {
+		return nil, fmt.Errorf("获取文件失败 (%s): %w", utils.DescribeFileSource(source), err)
+	}
+	return downloaded, nil
+}
+
+// progressFunc 构建文件进度回调，事件数据包含变量名、文件描述、已传输字节数、总字节数和百分比
+// 未设置Progress时返回nil
+func (s *DifyService) progressFunc(event string, fileValue string, file string) utils.ProgressFunc {
+	if s.Progress == nil {
+		return nil
+	}
+	return func(read int64, total int64) {
+		data := map[string]interface{}{
+			"file_value": fileValue,
+			"file":       file,
+			"bytes":      read,
+			"total":      total,
+		}
+		if percentage := utils.ProgressPercentage(read, total); percentage >= 0 {
+			data["percentage"] = percentage
+		}
+		s.Progress(event, data)
+	}
+}
+
+// appParametersCache 应用参数缓存，键为 域名+API密钥哈希
+var appParametersCache = struct {
+	sync.RWMutex
+	items map[string]appParametersCacheItem
+}{
+	items: make(map[string]appParametersCacheItem),
+}
+
+// appParametersCacheItem 应用参数缓存项
+type appParametersCacheItem struct {
+	params    *model.DifyAppParameters
+	expiresAt time.Time
+}
+
+// GetParameters 获取应用参数（/v1/parameters），结果按配置的TTL缓存
+func (s *DifyService) GetParameters() (*model.DifyAppParameters, error) {
+	cacheKey := s.BaseURL + "|" + utils.HashAPIKey(s.ApiKey)
+
+	appParametersCache.RLock()
+	item, ok := appParametersCache.items[cacheKey]
+	appParametersCache.RUnlock()
+	if ok && time.Now().Before(item.expiresAt) {
+		return item.params, nil
+	}
+
+	respBody, err := s.get("/v1/parameters", nil)
+	if err != nil {
+		return nil, fmt.Errorf("获取应用参数失败: %w", err)
+	}
+
+	var params model.DifyAppParameters
+	if err = json.Unmarshal(respBody, &params); err != nil {
+		return nil, fmt.Errorf("解析应用参数失败: %w", err)
+	}
+
+	appParametersCache.Lock()
+	appParametersCache.items[cacheKey] = appParametersCacheItem{
+		params:    &params,
+		expiresAt: time.Now().Add(time.Duration(config.Config.ParametersCacheTTL) * time.Second),
+	}
+	appParametersCache.Unlock()
+
+	return &params, nil
+}
+
+// DifyAPIError Dify接口返回的错误，保留状态码以便透传给调用方
+type DifyAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+// Error 实现error接口
+func (e *DifyAPIError) Error() string {
+	return fmt.Sprintf("状态码: %d, 响应: %s", e.StatusCode, e.Message)
+}
+
+// get 以GET方式调用Dify接口，返回响应内容
+func (s *DifyService) get(path string, query url.Values) ([]byte, error) {
+	requestURL := s.BaseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	// 创建请求
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建HTTP请求失败: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.ApiKey)
+
+	// 发送请求
+	client := &http.Client{Timeout: time.Duration(config.Config.DefaultApiTimeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("发送HTTP请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// 读取响应内容
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取响应内容失败: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &DifyAPIError{StatusCode: resp.StatusCode, Message: string(respBody)}
+	}
+	return respBody, nil
+}
+
+// GetWorkflowRun 获取工作流执行详情（/v1/workflows/run/:workflow_run_id）
+func (s *DifyService) GetWorkflowRun(workflowRunID string) (interface{}, error) {
+	respBody, err := s.get("/v1/workflows/run/"+url.PathEscape(workflowRunID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var run interface{}
+	if err = json.Unmarshal(respBody, &run); err != nil {
+		return nil, fmt.Errorf("解析工作流执行详情失败: %w", err)
+	}
+	return run, nil
+}
+
+// GetWorkflowLogs 获取工作流日志（/v1/workflows/logs），支持 keyword、status、page、limit 等查询参数
+func (s *DifyService) GetWorkflowLogs(query url.Values) (interface{}, error) {
+	respBody, err := s.get("/v1/workflows/logs", query)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs interface{}
+	if err = json.Unmarshal(respBody, &logs); err != nil {
+		return nil, fmt.Errorf("解析工作流日志失败: %w", err)
+	}
+	return logs, nil
+}
+
+// StopWorkflowTask 停止流式执行中的工作流任务（/v1/workflows/tasks/:task_id/stop）
+// 客户端断开连接后请求上下文已取消，这里使用独立的超时控制
+func (s *DifyService) StopWorkflowTask(taskID string, user string) error {
+	requestBody, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return fmt.Errorf("请求体序列化失败: %w", err)
+	}
+
+	// 创建请求
+	requestURL := fmt.Sprintf("%s/v1/workflows/tasks/%s/stop", s.BaseURL, url.PathEscape(taskID))
+	req, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return fmt.Errorf("创建HTTP请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.ApiKey)
+
+	// 发送请求
+	client := &http.Client{Timeout: time.Duration(config.Config.DefaultApiTimeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("发送HTTP请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return &DifyAPIError{StatusCode: resp.StatusCode, Message: string(respBody)}
+	}
+	return nil
+}
+
+// ExtractWorkflowRunID 从blocking模式的工作流响应中提取workflow_run_id
+func ExtractWorkflowRunID(workflowResp interface{}) string {
+	respMap, ok := workflowResp.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if runID, ok := respMap["workflow_run_id"].(string); ok && runID != "" {
+		return runID
+	}
+	if data, ok := respMap["data"].(map[string]interface{}); ok {
+		if runID, ok := data["id"].(string); ok {
+			return runID
+		}
+	}
+	return ""
+}
+
+// extractTaskID 从blocking模式的工作流响应中提取task_id
+func extractTaskID(workflowResp interface{}) string {
+	respMap, ok := workflowResp.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	taskID, _ := respMap["task_id"].(string)
+	return taskID
+}
+
+// BuildFileTypeOptions 构建文件类型解析选项
+// fileType为强制指定的类型；refresh为true时从目标应用获取该变量允许的文件类型
+func (s *DifyService) BuildFileTypeOptions(fileValue string, fileType string, mapping map[string]string, refresh bool) *model.FileTypeOptions {
+	opts := &model.FileTypeOptions{
+		Type:    strings.ToLower(fileType),
+		Mapping: make(map[string]string, len(mapping)),
+	}
+	for ext, t := range mapping {
+		opts.Mapping[strings.TrimPrefix(strings.ToLower(ext), ".")] = strings.ToLower(t)
+	}
+
+	if !refresh || opts.Type != "" {
+		return opts
+	}
+
+	params, err := s.GetParameters()
+	if err != nil {
+		// 获取失败时退回到本地映射，不影响主流程
+		log.Printf("获取应用参数失败，使用本地文件类型映射: %v", err)
+		return opts
+	}
+
+	// 优先使用变量级配置，其次使用应用级文件上传配置
+	if _, item := params.FindInput(fileValue); item != nil && len(item.AllowedFileTypes) > 0 {
+		opts.AllowedTypes = item.AllowedFileTypes
+		opts.AllowedExtensions = item.AllowedFileExtensions
+	} else if params.FileUpload != nil {
+		opts.AllowedTypes = params.FileUpload.AllowedFileTypes
+		opts.AllowedExtensions = params.FileUpload.AllowedFileExtensions
+	}
+
+	return opts
+}
+
 // RunWorkflow 执行工作流
 func (s *DifyService) RunWorkflow(request *model.DifyWorkflowRunRequest) ([]byte, error) {
 	url := fmt.Sprintf("%s/v1/workflows/run", s.BaseURL)
@@ -150,8 +472,9 @@ func (s *DifyService) RunWorkflow(request *model.DifyWorkflowRunRequest) ([]byte
 	return respBody, nil
 }
 
-// StreamWorkflow 流式执行工作流
-func (s *DifyService) StreamWorkflow(request *model.DifyWorkflowRunRequest, writer http.ResponseWriter) error {
+// postWorkflowStream 以streaming模式发起工作流请求，返回状态码为200的流式响应
+// 失败时返回错误和对应的HTTP状态码（Dify拒绝请求时为Dify返回的状态码）
+func (s *DifyService) postWorkflowStream(ctx context.Context, request *model.DifyWorkflowRunRequest) (*http.Response, int, error) {
 	url := fmt.Sprintf("%s/v1/workflows/run", s.BaseURL)
 
 	// 强制设置为streaming模式
@@ -160,13 +483,13 @@ func (s *DifyService) StreamWorkflow(request *model.DifyWorkflowRunRequest, writ
 	// 将请求对象转为JSON
 	requestBody, err := json.Marshal(request)
 	if err != nil {
-		return fmt.Errorf("请求体序列化失败: %w", err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("请求体序列化失败: %w", err)
 	}
 
 	// 创建请求
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
-		return fmt.Errorf("创建HTTP请求失败: %w", err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("创建HTTP请求失败: %w", err)
 	}
 
 	// 设置请求头
@@ -177,73 +500,385 @@ func (s *DifyService) StreamWorkflow(request *model.DifyWorkflowRunRequest, writ
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("发送HTTP请求失败: %w", err)
+		return nil, http.StatusBadGateway, fmt.Errorf("发送HTTP请求失败: %w", err)
 	}
-	defer resp.Body.Close()
 
 	// 处理错误响应
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		respBody, _ := io.ReadAll(resp.Body)
 		// 尝试解析错误响应
 		var errorResp struct {
 			Error string `json:"error"`
 		}
 		if err = json.Unmarshal(respBody, &errorResp); err == nil && errorResp.Error != "" {
-			return errors.New(errorResp.Error)
+			return nil, resp.StatusCode, errors.New(errorResp.Error)
 		}
-		return fmt.Errorf("执行工作流失败，状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+		return nil, resp.StatusCode, fmt.Errorf("执行工作流失败，状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
 	}
 
-	// 设置响应头
-	writer.Header().Set("Content-Type", "text/event-stream")
-	writer.Header().Set("Cache-Control", "no-cache")
-	writer.Header().Set("Connection", "keep-alive")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	return resp, http.StatusOK, nil
+}
 
-	// 直接透传Dify API的流式响应
-	_, err = io.Copy(writer, resp.Body)
+// RunWorkflowAggregate 以streaming模式执行工作流并在服务端消费全部事件，返回与blocking模式结构相同的响应
+// 用于避免长时间运行的工作流在blocking模式下超时；data中额外包含各节点的耗时（nodes）
+func (s *DifyService) RunWorkflowAggregate(request *model.DifyWorkflowRunRequest) ([]byte, error) {
+	resp, _, err := s.postWorkflowStream(context.Background(), request)
 	if err != nil {
-		return fmt.Errorf("流式传输响应失败: %w", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	return nil
+	aggregator := newStreamAggregator()
+	reader := utils.NewSSEReader(resp.Body)
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("读取流式响应失败: %w", err)
+		}
+		started := aggregator.workflowRunID != ""
+		aggregator.observe(event)
+		if !started {
+			s.notifyWorkflowRun(aggregator.workflowRunID, aggregator.taskID)
+		}
+	}
+
+	result, err := aggregator.response()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
 }
 
-// ProcessSingleFileWorkflow 处理单文件工作流
-func (s *DifyService) ProcessSingleFileWorkflow(request *model.SingleFileWorkflowRequest, fileInput *model.FileSingleInput) (*model.WorkflowResponse, error) {
-	response := &model.WorkflowResponse{}
+// ErrClientDisconnected 流式请求的客户端已断开连接，上游工作流已取消
+var ErrClientDisconnected = errors.New("客户端已断开连接，工作流已取消")
+
+// StreamWorkflow 流式执行工作流，逐个事件转发Dify的SSE响应
+// 先发送 files_uploaded 事件（上传的文件列表），再转发Dify的所有事件（ping、node_started、text_chunk、workflow_finished等），
+// 最后发送 summary 事件汇总本次执行；工作流启动失败时发送 error 事件。
+// ctx为客户端请求的上下文，客户端断开连接时中止上游请求并停止Dify任务，返回ErrClientDisconnected
+func (s *DifyService) StreamWorkflow(ctx context.Context, request *model.DifyWorkflowRunRequest, fileResponses []model.DifyFileUploadResponse, out utils.EventWriter) error {
+	return s.streamWorkflow(ctx, request, fileResponses, out, newStreamSummary(len(fileResponses)), false)
+}
 
-	// 下载文件
-	fileContent, filename, err := utils.DownloadFile(fileInput.FileURL)
+// streamWorkflow 流式执行工作流并将事件汇总到summary
+// keepRunning为true时客户端无法接收事件后继续读取Dify的事件，直到工作流结束
+func (s *DifyService) streamWorkflow(ctx context.Context, request *model.DifyWorkflowRunRequest, fileResponses []model.DifyFileUploadResponse,
+	out utils.EventWriter, summary *streamSummary, keepRunning bool) error {
+	// 发起请求，写出失败时也通过cancel中止上游请求
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, status, err := s.postWorkflowStream(ctx, request)
 	if err != nil {
-		return nil, fmt.Errorf("下载文件失败: %w", err)
+		if ctx.Err() != nil {
+			// 尚未收到任何事件，没有task_id可以停止
+			return s.cancelStream(summary, request.User)
+		}
+		writeStreamError(out, status, "workflow_run_failed", err)
+		return err
+	}
+	defer resp.Body.Close()
+	defer s.recordStreamUsage(request.User, summary)
+
+	// 上传的文件列表
+	if err = out.WriteJSON(map[string]interface{}{
+		"event": "files_uploaded",
+		"data":  fileResponses,
+	}); err != nil && !keepRunning {
+		cancel()
+		return s.cancelStream(summary, request.User)
+	}
+
+	// 逐个事件转发Dify的流式响应
+	reader := utils.NewSSEReader(resp.Body)
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return s.cancelStream(summary, request.User)
+			}
+			summary.Error = "读取流式响应失败: " + err.Error()
+			out.WriteJSON(summary.payload())
+			return fmt.Errorf("读取流式响应失败: %w", err)
+		}
+
+		started := summary.WorkflowRunID != ""
+		summary.observe(event)
+		if !started {
+			s.notifyWorkflowRun(summary.WorkflowRunID, summary.TaskID)
+		}
+		if err = out.WriteEvent(event); err != nil && !keepRunning {
+			// 客户端已无法接收事件，中止上游请求
+			cancel()
+			return s.cancelStream(summary, request.User)
+		}
+	}
+
+	// 汇总事件
+	if err = out.WriteJSON(summary.payload()); err != nil && !keepRunning {
+		return fmt.Errorf("流式传输响应失败: %w", err)
+	}
+	return nil
+}
+
+// notifyWorkflowRun 回调工作流执行ID，执行ID为空或未设置回调时忽略
+func (s *DifyService) notifyWorkflowRun(workflowRunID string, taskID string) {
+	if workflowRunID != "" && s.OnWorkflowRun != nil {
+		s.OnWorkflowRun(workflowRunID, taskID)
 	}
+}
+
+// recordStreamUsage 记录流式执行的用量，未收到Dify事件（工作流未开始执行）时不记录
+func (s *DifyService) recordStreamUsage(user string, summary *streamSummary) {
+	if summary.TaskID == "" && summary.WorkflowRunID == "" {
+		return
+	}
+	utils.RecordUsage(s.BaseURL, s.ApiKey, user, summary.usage())
+}
+
+// loadFileVariables 获取所有文件来源的内容，返回以已读取内容代替URL和base64的文件变量，引用的已上传文件保持不变
+// 用于在上传前按文件内容计算结果缓存键，上传时不再重复下载
+func (s *DifyService) loadFileVariables(request *model.SingleFileWorkflowRequest, variables []model.FileVariable) ([]model.FileVariable, error) {
+	loaded := make([]model.FileVariable, len(variables))
+	for i, variable := range variables {
+		typeOpts := s.BuildFileTypeOptions(variable.FileValue, variable.Type, request.FileTypeMapping, request.RefreshFileTypes)
+
+		loaded[i] = variable
+		loaded[i].Sources = make([]model.FileSource, len(variable.Sources))
+		for j, source := range variable.Sources {
+			if source.UploadFileID != "" || source.Content != nil {
+				loaded[i].Sources[j] = source
+				continue
+			}
+
+			downloaded, err := loadFileSource(context.Background(), source, typeOpts, s.progressFunc("download_progress", variable.FileValue, utils.DescribeFileSource(source)))
+			if err != nil {
+				return nil, err
+			}
+			loaded[i].Sources[j] = model.FileSource{
+				Content:     downloaded.Content,
+				Filename:    downloaded.Filename,
+				ContentType: downloaded.DeclaredMimeType,
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// UploadFileVariables 上传所有文件变量的文件，并将文件映射写入request.Inputs
+// 单文件变量写入映射对象，文件列表变量写入映射列表；
+// 开启expand_archives时，文件列表中的压缩包会被展开为多个文件；展开后的文件和引用的已上传文件合计受MaxUploadFiles限制
+// ctx取消时中止正在进行的下载和上传
+func (s *DifyService) UploadFileVariables(ctx context.Context, request *model.SingleFileWorkflowRequest, variables []model.FileVariable) ([]model.DifyFileUploadResponse, error) {
+	var fileResponses []model.DifyFileUploadResponse
+
+	if request.Inputs == nil {
+		request.Inputs = make(map[string]interface{})
+	}
+
+	archiveOpts := utils.ResolveArchiveOptions(request.ExpandArchives)
+	uploaded := 0
+
+	for _, variable := range variables {
+		typeOpts := s.BuildFileTypeOptions(variable.FileValue, variable.Type, request.FileTypeMapping, request.RefreshFileTypes)
+
+		var fileMapList []interface{}
+
+		// countFile 计入一个文件，超过数量限制时返回错误
+		countFile := func() error {
+			uploaded++
+			if uploaded > config.Config.MaxUploadFiles {
+				return fmt.Errorf("文件数量超过限制，最多 %d 个", config.Config.MaxUploadFiles)
+			}
+			return nil
+		}
+
+		// upload 上传单个文件并记录响应和映射
+		upload := func(downloaded *model.DownloadedFile, sourceArchive string) error {
+			if err := countFile(); err != nil {
+				return err
+			}
+			if err := utils.CheckFileType(filepath.Ext(downloaded.Filename), typeOpts); err != nil {
+				return fmt.Errorf("%s (%s): %w", variable.FileValue, downloaded.Filename, err)
+			}
 
-	// 上传文件到Dify
-	fileResp, err := s.UploadFile(fileContent, filename, request.User)
+			fileResp, err := s.uploadDownloadedFile(ctx, downloaded, request.User, s.progressFunc("upload_progress", variable.FileValue, downloaded.Filename))
+			if err != nil {
+				return err
+			}
+			fileResp.SourceArchive = sourceArchive
+
+			// 添加文件上传响应
+			fileResponses = append(fileResponses, *fileResp)
+
+			// 构建文件映射
+			fileMapList = append(fileMapList, utils.BuildFileMapping(fileResp, typeOpts))
+			return nil
+		}
+
+		for _, source := range variable.Sources {
+			// 引用已上传的文件，直接构建映射
+			if source.UploadFileID != "" {
+				if err := countFile(); err != nil {
+					return fileResponses, err
+				}
+				fileMap, err := s.BuildUploadedFileMapping(source, typeOpts)
+				if err != nil {
+					return fileResponses, fmt.Errorf("%s: %w", variable.FileValue, err)
+				}
+				fileMapList = append(fileMapList, fileMap)
+				continue
+			}
+
+			// 获取文件内容
+			downloaded, err := loadFileSource(ctx, source, typeOpts, s.progressFunc("download_progress", variable.FileValue, utils.DescribeFileSource(source)))
+			if err != nil {
+				return fileResponses, err
+			}
+
+			// 文件列表中的压缩包逐个展开上传
+			if variable.IsList && archiveOpts.Enabled && utils.IsArchive(downloaded) {
+				err = utils.ExpandArchive(downloaded, archiveOpts, typeOpts, func(entry *model.DownloadedFile) error {
+					return upload(entry, downloaded.Filename)
+				})
+				if err != nil {
+					return fileResponses, fmt.Errorf("展开压缩包失败 (%s): %w", downloaded.Filename, err)
+				}
+				continue
+			}
+
+			if err = upload(downloaded, ""); err != nil {
+				return fileResponses, err
+			}
+		}
+
+		if variable.IsList && len(fileMapList) == 0 {
+			return fileResponses, fmt.Errorf("%s: 没有可上传的文件", variable.FileValue)
+		}
+
+		// 严格使用用户提供的文件变量名
+		// 如果用户指定的变量名存在于inputs中，先移除它
+		delete(request.Inputs, variable.FileValue)
+
+		// 添加文件信息到用户指定的变量名
+		if variable.IsList {
+			request.Inputs[variable.FileValue] = fileMapList
+		} else if len(fileMapList) > 0 {
+			request.Inputs[variable.FileValue] = fileMapList[0]
+		}
+	}
+
+	return fileResponses, nil
+}
+
+// UploadFiles 仅上传文件列表变量中的文件，返回上传结果和对应的文件映射
+func (s *DifyService) UploadFiles(request *model.SingleFileWorkflowRequest, variable model.FileVariable) (*model.UploadFilesResponse, error) {
+	variable.IsList = true
+	fileResponses, err := s.UploadFileVariables(context.Background(), request, []model.FileVariable{variable})
 	if err != nil {
-		return nil, fmt.Errorf("上传文件到Dify失败: %w", err)
+		return nil, err
 	}
 
-	// 添加文件上传响应
-	response.FileResponse = append(response.FileResponse, *fileResp)
+	response := &model.UploadFilesResponse{FileResponse: fileResponses}
+	fileMapList, _ := request.Inputs[variable.FileValue].([]interface{})
+	for _, fileMap := range fileMapList {
+		if mapping, ok := fileMap.(map[string]interface{}); ok {
+			response.FileMappings = append(response.FileMappings, mapping)
+		}
+	}
+	return response, nil
+}
+
+// CoerceInputs 按应用参数定义转换inputs中的字符串值，获取应用参数失败时保持原值
+// 只有存在未显式指定类型的字符串值时才获取应用参数
+func (s *DifyService) CoerceInputs(request *model.SingleFileWorkflowRequest) {
+	if !request.CoerceInputs || !utils.HasUntypedStringInputs(request.Inputs, request.TypedInputs) {
+		return
+	}
+	params, err := s.GetParameters()
+	if err != nil {
+		log.Printf("获取应用参数失败，跳过inputs类型转换: %v", err)
+		return
+	}
+	utils.CoerceInputsBySchema(request.Inputs, params, request.TypedInputs)
+}
 
-	// 获取文件类型
-	fileType := utils.GetFileType(fileResp.Extension)
+// BuildUploadedFileMapping 为已上传到Dify的文件构建映射，不重新下载上传
+// 文件类型优先使用来源中指定的type，其次是变量级type，最后根据上传记录中的扩展名解析
+func (s *DifyService) BuildUploadedFileMapping(source model.FileSource, opts *model.FileTypeOptions) (map[string]interface{}, error) {
+	fileType := strings.ToLower(source.Type)
+	if fileType == "" && opts != nil {
+		fileType = opts.Type
+	}
+	if fileType == "" {
+		record, ok := utils.GetUploadRecord(s.BaseURL, s.ApiKey, source.UploadFileID)
+		if !ok {
+			return nil, fmt.Errorf("未找到文件 %s 的上传记录，请通过type指定文件类型", source.UploadFileID)
+		}
+		if err := utils.CheckFileType(record.Extension, opts); err != nil {
+			return nil, fmt.Errorf("文件 %s: %w", source.UploadFileID, err)
+		}
+		fileType = utils.ResolveFileType(record.Extension, opts)
+	}
 
-	// 构建文件映射
-	fileMap := map[string]interface{}{
+	return map[string]interface{}{
 		"transfer_method": "local_file",
-		"upload_file_id":  fileResp.ID,
+		"upload_file_id":  source.UploadFileID,
 		"type":            fileType,
+	}, nil
+}
+
+// ProcessFileWorkflow 上传文件变量并以blocking（或aggregate）模式执行工作流
+func (s *DifyService) ProcessFileWorkflow(request *model.SingleFileWorkflowRequest, variables []model.FileVariable) (*model.WorkflowResponse, error) {
+	response := &model.WorkflowResponse{}
+
+	// 查询结果缓存，缓存键按文件内容计算，因此先获取文件内容，命中时不再上传文件
+	var cacheKey string
+	if utils.ResultCacheEnabled() && request.Cache != utils.ResultCacheBypass {
+		var err error
+		if variables, err = s.loadFileVariables(request, variables); err != nil {
+			return nil, err
+		}
+		if cacheKey, err = utils.ResultCacheKey(s.BaseURL, s.ApiKey, request, variables); err != nil {
+			log.Printf("计算结果缓存键失败，跳过缓存: %v", err)
+		} else if request.Cache != utils.ResultCacheRefresh {
+			// 缓存的结果不符合本次请求的JSON Schema时重新执行
+			if cached, ok := utils.GetCachedResult(cacheKey); ok && checkOutputSchema(request.OutputSchema, cached) == nil {
+				// 缓存中有未转存的文件时在副本上转存，并更新缓存
+				if request.RehostFiles && utils.HasPendingOutputFiles(cached) {
+					if copied, err := copyWorkflowData(cached); err != nil {
+						log.Printf("复制缓存结果失败，跳过文件转存: %v", err)
+					} else {
+						s.rehostOutputFiles(response, copied)
+						utils.SetCachedResult(cacheKey, copied)
+						cached = copied
+					}
+				}
+				response.WorkflowData = cached
+				response.CacheHit = true
+				applyOutputSpec(response, request.Output)
+				return response, nil
+			}
+		}
 	}
 
-	// 严格使用用户提供的文件变量名
-	// 如果用户指定的变量名存在于inputs中，先移除它
-	delete(request.Inputs, fileInput.FileValue)
+	// 上传文件并写入inputs
+	fileResponses, err := s.UploadFileVariables(context.Background(), request, variables)
+	if err != nil {
+		return nil, err
+	}
 
-	// 添加文件信息到用户指定的变量名
-	request.Inputs[fileInput.FileValue] = fileMap
+	// 更新response的文件上传响应
+	response.FileResponse = fileResponses
+
+	// 按应用参数转换inputs类型
+	s.CoerceInputs(request)
 
 	// 构建工作流请求
 	workflowRequest := &model.DifyWorkflowRunRequest{
@@ -252,92 +887,258 @@ func (s *DifyService) ProcessSingleFileWorkflow(request *model.SingleFileWorkflo
 		User:         request.User,
 	}
 
-	// 执行工作流
-	respBody, err := s.RunWorkflow(workflowRequest)
-	if err != nil {
-		response.ErrorMessage = err.Error()
-		return response, nil
-	}
-
-	// 解析工作流响应
+	// 执行工作流，输出不符合JSON Schema时按max_retries重新执行
 	var workflowResp interface{}
-	if err = json.Unmarshal(respBody, &workflowResp); err != nil {
-		response.ErrorMessage = "解析工作流响应失败: " + err.Error()
-		return response, nil
+	var violation *model.SchemaViolation
+	for attempt := 1; ; attempt++ {
+		// aggregate模式在服务端消费流式响应
+		var respBody []byte
+		if request.ResponseMode == "aggregate" {
+			respBody, err = s.RunWorkflowAggregate(workflowRequest)
+		} else {
+			respBody, err = s.RunWorkflow(workflowRequest)
+		}
+		if err != nil {
+			response.ErrorMessage = err.Error()
+			return response, nil
+		}
+
+		// 解析工作流响应
+		workflowResp = nil
+		if err = json.Unmarshal(respBody, &workflowResp); err != nil {
+			response.ErrorMessage = "解析工作流响应失败: " + err.Error()
+			return response, nil
+		}
+
+		// aggregate模式已在收到首个事件时回调
+		if request.ResponseMode != "aggregate" {
+			s.notifyWorkflowRun(ExtractWorkflowRunID(workflowResp), extractTaskID(workflowResp))
+		}
+
+		// 记录用量，重新执行同样消耗Token，每次执行分别记录
+		utils.RecordUsage(s.BaseURL, s.ApiKey, request.User, utils.ExtractWorkflowUsage(workflowResp))
+
+		violation = checkOutputSchema(request.OutputSchema, workflowResp)
+		if violation == nil {
+			break
+		}
+		violation.Attempts = attempt
+		if attempt > request.OutputSchema.MaxRetries {
+			break
+		}
+		log.Printf("输出字段 %s 不符合JSON Schema，重新执行工作流（第%d次重试）", request.OutputSchema.Field, attempt)
 	}
 
 	response.WorkflowData = workflowResp
+	if violation != nil {
+		response.SchemaViolation = violation
+		response.ErrorMessage = fmt.Sprintf("输出字段 %s 不符合JSON Schema（共执行%d次）", violation.Field, violation.Attempts)
+	}
+
+	// 转存输出文件，结果缓存中保存改写后的地址
+	if request.RehostFiles && workflowSucceeded(workflowResp) {
+		s.rehostOutputFiles(response, workflowResp)
+	}
+
+	// 仅缓存执行成功且符合Schema的结果
+	if cacheKey != "" && workflowSucceeded(workflowResp) && violation == nil {
+		utils.SetCachedResult(cacheKey, workflowResp)
+	}
+
+	applyOutputSpec(response, request.Output)
 	return response, nil
 }
 
-// ProcessMultiFilesWorkflow 处理多文件工作流
-func (s *DifyService) ProcessMultiFilesWorkflow(request *model.SingleFileWorkflowRequest, filesInput *model.FilesInput) (*model.WorkflowResponse, error) {
-	response := &model.WorkflowResponse{}
+// checkOutputSchema 按请求的JSON Schema校验工作流输出，未指定Schema或工作流未执行成功时不校验
+func checkOutputSchema(spec *model.OutputSchemaSpec, workflowResp interface{}) *model.SchemaViolation {
+	if spec == nil || !workflowSucceeded(workflowResp) {
+		return nil
+	}
 
-	// 处理多个文件
-	var fileResponses []model.DifyFileUploadResponse
-	var fileMapList []interface{}
+	schema, err := utils.CompileOutputSchema(spec)
+	if err != nil {
+		// 请求校验时已编译过Schema，这里通常不会失败
+		return &model.SchemaViolation{Code: "schema_violation", Field: spec.Field, Errors: []model.SchemaError{{Message: err.Error()}}}
+	}
+	return utils.ValidateWorkflowOutput(workflowResp, spec.Field, schema)
+}
 
-	for _, fileURL := range filesInput.FileURLs {
-		// 下载文件
-		fileContent, filename, err := utils.DownloadFile(fileURL)
-		if err != nil {
-			return nil, fmt.Errorf("下载文件失败 (%s): %w", fileURL, err)
-		}
+// rehostOutputFiles 转存工作流输出中的文件并记录到响应，转存失败的文件保留原地址，错误信息写入响应
+func (s *DifyService) rehostOutputFiles(response *model.WorkflowResponse, workflowResp interface{}) {
+	store := utils.GetArtifactStore()
+	if store == nil {
+		return
+	}
 
-		// 上传文件到Dify
-		fileResp, err := s.UploadFile(fileContent, filename, request.User)
-		if err != nil {
-			return nil, fmt.Errorf("上传文件到Dify失败 (%s): %w", filename, err)
+	artifacts, err := utils.RehostOutputFiles(workflowResp, s.BaseURL, store)
+	response.Artifacts = append(response.Artifacts, artifacts...)
+	if err != nil {
+		log.Printf("转存输出文件失败: %v", err)
+		if response.ErrorMessage == "" {
+			response.ErrorMessage = err.Error()
 		}
+	}
+}
+
+// copyWorkflowData 深拷贝工作流响应（结果缓存中的数据按引用共享，修改前需要复制）
+func copyWorkflowData(workflowResp interface{}) (interface{}, error) {
+	raw, err := json.Marshal(workflowResp)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	if err = json.Unmarshal(raw, &copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// applyOutputSpec 按请求的输出规则提取字段和执行元数据，flatten时不再返回原始workflow_data
+// 解析失败时保留原始workflow_data并返回错误信息
+func applyOutputSpec(response *model.WorkflowResponse, spec *model.OutputSpec) {
+	if spec == nil || response.WorkflowData == nil {
+		return
+	}
+
+	output, metadata, err := utils.ShapeWorkflowOutput(response.WorkflowData, spec)
+	response.Metadata = metadata
+	if err != nil {
+		response.ErrorMessage = err.Error()
+		return
+	}
+	response.Output = output
+	if spec.Flatten {
+		response.WorkflowData = nil
+	}
+}
 
-		// 添加文件上传响应
-		fileResponses = append(fileResponses, *fileResp)
+// workflowSucceeded 判断blocking模式的工作流响应是否执行成功（data.status为succeeded）
+func workflowSucceeded(workflowResp interface{}) bool {
+	respMap, ok := workflowResp.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	data, ok := respMap["data"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	status, _ := data["status"].(string)
+	return status == "succeeded"
+}
+
+// StreamFileWorkflow 上传文件变量并以streaming模式执行工作流，逐个事件转发流式响应
+// 立即开始输出SSE响应，下载和上传文件期间发送 download_progress、upload_progress 事件，
+// 文件处理失败时发送 error 事件；客户端断开连接时不再执行或中止执行工作流（开启stream_resume时继续执行）。
+// 发送的事件和执行结果按响应头 X-Request-ID 记录，可通过异步状态接口查询结果或按Last-Event-ID续传事件
+func (s *DifyService) StreamFileWorkflow(ctx context.Context, request *model.SingleFileWorkflowRequest, variables []model.FileVariable, writer http.ResponseWriter) error {
+	requestID := utils.GenerateRequestID()
+	writer.Header().Set("X-Request-ID", requestID)
+
+	sse := utils.NewSSEWriter(writer)
+	sse.Start()
+	return s.StreamFileWorkflowTo(ctx, requestID, request, variables, sse)
+}
+
+// StreamFileWorkflowTo 与StreamFileWorkflow相同，但将事件写出到指定的输出（SSE或WebSocket），
+// 事件和执行结果按requestID记录
+func (s *DifyService) StreamFileWorkflowTo(ctx context.Context, requestID string, request *model.SingleFileWorkflowRequest, variables []model.FileVariable, out utils.EventWriter) error {
+	utils.InitStreamRequest(requestID, s.ApiKey)
+	record := utils.NewStreamRecord(requestID, s.ApiKey)
+	out.SetRecorder(record)
 
-		// 获取文件类型
-		fileType := utils.GetFileType(fileResp.Extension)
+	// 收到首个事件时关联工作流执行ID，执行期间即可查询执行详情
+	s.OnWorkflowRun = func(workflowRunID string, taskID string) {
+		utils.LinkAsyncWorkflowRun(requestID, workflowRunID, taskID, s.BaseURL)
+	}
+	defer func() { s.OnWorkflowRun = nil }()
 
-		// 构建文件映射
-		fileMap := map[string]interface{}{
-			"transfer_method": "local_file",
-			"upload_file_id":  fileResp.ID,
-			"type":            fileType,
+	summary := newStreamSummary(0)
+	err := s.streamFileWorkflow(ctx, request, variables, out, summary)
+
+	// 记录执行结果
+	status, message := "completed", "流式请求处理完成"
+	switch {
+	case errors.Is(err, ErrClientDisconnected):
+		status, message = "cancelled", err.Error()
+	case err != nil:
+		status, message = "failed", err.Error()
+	case summary.Status != "succeeded":
+		status, message = "failed", fmt.Sprintf("工作流执行未成功，状态: %s", summary.Status)
+		if summary.Error != "" {
+			message = summary.Error
 		}
+	}
+	utils.UpdateAsyncRequestResult(requestID, status, message, summary.result())
+	record.Finish()
 
-		fileMapList = append(fileMapList, fileMap)
+	return err
+}
+
+// streamFileWorkflow 上传文件并流式执行工作流，事件汇总到summary
+func (s *DifyService) streamFileWorkflow(ctx context.Context, request *model.SingleFileWorkflowRequest, variables []model.FileVariable,
+	out utils.EventWriter, summary *streamSummary) error {
+	// 开启续传时客户端断开连接后继续执行，不再随请求取消
+	if request.StreamResume {
+		ctx = context.WithoutCancel(ctx)
 	}
 
-	// 更新response的文件上传响应
-	response.FileResponse = fileResponses
+	// 推送文件下载/上传进度
+	s.Progress = func(event string, data map[string]interface{}) {
+		out.WriteJSON(map[string]interface{}{
+			"event": event,
+			"data":  data,
+		})
+	}
+	defer func() { s.Progress = nil }()
 
-	// 严格使用用户提供的文件变量名
-	// 如果用户指定的变量名存在于inputs中，先移除它
-	delete(request.Inputs, filesInput.FileValue)
+	// 上传文件并写入inputs，客户端断开连接或停止时中止下载和上传
+	fileResponses, err := s.UploadFileVariables(ctx, request, variables)
+	if err != nil {
+		if ctx.Err() != nil {
+			return s.cancelStream(summary, request.User)
+		}
+		writeStreamError(out, http.StatusInternalServerError, "file_upload_failed", err)
+		return err
+	}
+	summary.FileCount = len(fileResponses)
 
-	// 添加文件信息到用户指定的变量名
-	request.Inputs[filesInput.FileValue] = fileMapList
+	// 按应用参数转换inputs类型
+	s.CoerceInputs(request)
 
 	// 构建工作流请求
 	workflowRequest := &model.DifyWorkflowRunRequest{
 		Inputs:       request.Inputs,
-		ResponseMode: request.ResponseMode,
+		ResponseMode: "streaming", // 强制使用streaming模式
 		User:         request.User,
 	}
 
-	// 执行工作流
-	respBody, err := s.RunWorkflow(workflowRequest)
-	if err != nil {
-		response.ErrorMessage = err.Error()
-		return response, nil
+	// 上传期间客户端已断开连接
+	if ctx.Err() != nil {
+		return s.cancelStream(summary, request.User)
 	}
 
-	// 解析工作流响应
-	var workflowResp interface{}
-	if err = json.Unmarshal(respBody, &workflowResp); err != nil {
-		response.ErrorMessage = "解析工作流响应失败: " + err.Error()
-		return response, nil
+	return s.streamWorkflow(ctx, workflowRequest, fileResponses, out, summary, request.StreamResume)
+}
+
+// cancelStream 客户端断开连接后停止Dify任务，工作流已结束时无需停止
+func (s *DifyService) cancelStream(summary *streamSummary, user string) error {
+	log.Printf("[CANCEL] 流式请求已取消（客户端断开连接或主动停止） | task_id=%s | workflow_run_id=%s | 已转发事件=%d | 耗时=%.1fs",
+		summary.TaskID, summary.WorkflowRunID, summary.EventCount, time.Since(summary.StartedAt).Seconds())
+
+	if summary.TaskID != "" && summary.Status == "" {
+		if err := s.StopWorkflowTask(summary.TaskID, user); err != nil {
+			log.Printf("[CANCEL] 停止工作流任务失败 | task_id=%s | %v", summary.TaskID, err)
+		}
 	}
+	return ErrClientDisconnected
+}
 
-	response.WorkflowData = workflowResp
-	return response, nil
+// writeStreamError 以Dify的错误事件格式写出 error 事件
+func writeStreamError(out utils.EventWriter, status int, code string, err error) {
+	out.WriteJSON(map[string]interface{}{
+		"event":   "error",
+		"status":  status,
+		"code":    code,
+		"message": err.Error(),
+	})
 }
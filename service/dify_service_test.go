@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestUploadFileVariablesCountsUploadFileIDs 引用已上传的文件同样计入文件数量限制
+func TestUploadFileVariablesCountsUploadFileIDs(t *testing.T) {
+	original := config.Config.MaxUploadFiles
+	config.Config.MaxUploadFiles = 2
+	t.Cleanup(func() { config.Config.MaxUploadFiles = original })
+
+	var sources []model.FileSource
+	for _, id := range []string{"file-1", "file-2", "file-3"} {
+		sources = append(sources, model.FileSource{UploadFileID: id, Type: "document"})
+	}
+	variables := []model.FileVariable{{FileValue: "docs", IsList: true, Sources: sources}}
+
+	_, err := NewDifyService("https://api.dify.ai", "app-key").UploadFileVariables(context.Background(), &model.SingleFileWorkflowRequest{}, variables)
+	if err == nil || !strings.Contains(err.Error(), "文件数量超过限制") {
+		t.Errorf("err = %v, want 文件数量超过限制", err)
+	}
+}
+
+// TestUploadFileVariablesCancel ctx取消时中止正在进行的下载和上传
+func TestUploadFileVariablesCancel(t *testing.T) {
+	for _, hang := range []string{"download", "upload"} {
+		t.Run(hang, func(t *testing.T) {
+			started := make(chan struct{})
+			var uploads atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// 挂起的请求读完请求体后等待客户端取消
+				if (hang == "download") == (r.URL.Path == "/files/a.pdf") {
+					io.Copy(io.Discard, r.Body)
+					close(started)
+					<-r.Context().Done()
+					return
+				}
+				if r.URL.Path == "/v1/files/upload" {
+					uploads.Add(1)
+					w.Write([]byte(`{"id":"file-1","name":"a.pdf"}`))
+					return
+				}
+				w.Write([]byte("%PDF-1.4"))
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-started
+				cancel()
+			}()
+			variables := []model.FileVariable{{FileValue: "doc", Sources: []model.FileSource{{URL: server.URL + "/files/a.pdf"}}}}
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := NewDifyService(server.URL, "app-key").UploadFileVariables(ctx, &model.SingleFileWorkflowRequest{}, variables)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("err = %v, want context.Canceled", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("取消后未中止")
+			}
+			if n := uploads.Load(); n != 0 {
+				t.Errorf("uploads = %d, want 0", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package service
+
+import (
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"dify-upload-workflow/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 四个文件工作流接口（JSON单文件/多文件、form-data单文件/多文件）通过本文件构建请求，
+// 共用同一套参数校验、默认值和规范化逻辑，保证各接口行为一致
+
+// BuildJSONWorkflowRequest 规范化JSON工作流请求，并从inputs中解析文件变量
+// isList表示 inputs.file 对应单文件（file_url）还是文件列表（file_urls）
+func BuildJSONWorkflowRequest(request *model.SingleFileWorkflowRequest, isList bool) ([]model.FileVariable, error) {
+	if err := NormalizeWorkflowRequest(request); err != nil {
+		return nil, err
+	}
+	return parseJSONFileVariables(request.Inputs, isList)
+}
+
+// BuildMessageWorkflowRequest 规范化消息形式（WebSocket）的工作流请求并解析文件变量
+// 不区分单文件和多文件接口，inputs.file 按内容判断是单文件还是文件列表；始终以streaming模式执行，不支持异步回调；
+// 也不支持stream_resume，执行由连接上的stop消息或断开连接取消
+func BuildMessageWorkflowRequest(request *model.SingleFileWorkflowRequest) ([]model.FileVariable, error) {
+	request.ResponseMode = "streaming"
+	request.Async = nil
+	request.StreamResume = false
+
+	isList := false
+	if fileInput, ok := request.Inputs["file"].(map[string]interface{}); ok {
+		if variable, err := utils.ParseFileVariable(fileInput, ""); err == nil {
+			isList = variable.IsList
+		}
+	}
+	return BuildJSONWorkflowRequest(request, isList)
+}
+
+// BuildFormWorkflowRequest 根据表单构建工作流请求和文件变量
+// fileKey为主文件字段（file或files），对应的变量名由file_value指定；
+// 另外支持 file[变量名]、files[变量名] 形式的多个文件变量。所有文件内容在此读取完毕，
+// 之后不再访问表单，调用方可以立即清理表单临时文件。
+// 表单中的 file_urls 默认与上传的文件按顺序合并为 file_value 对应的文件列表（上传的文件在前），
+// 指定 file_urls_value 时则作为单独的文件列表变量
+func BuildFormWorkflowRequest(form *multipart.Form, fileKey string, isList bool) (*model.SingleFileWorkflowRequest, []model.FileVariable, error) {
+	if form == nil {
+		return nil, nil, errors.New("没有文件上传")
+	}
+
+	request := &model.SingleFileWorkflowRequest{
+		Domain:       formValue(form, "domain"),
+		ResponseMode: formValue(form, "response_mode"),
+		User:         formValue(form, "user"),
+		CoerceInputs: true, // form-data字段都是字符串，默认按应用参数转换类型
+	}
+
+	// 检查是否有异步请求参数
+	if callbackURL := formValue(form, "callback_url"); callbackURL != "" {
+		request.Async = &model.AsyncRequest{
+			CallbackURL: callbackURL,
+			RequestID:   formValue(form, "request_id"),
+		}
+	}
+	if err := applyFormOptions(request, form); err != nil {
+		return nil, nil, err
+	}
+
+	if err := NormalizeWorkflowRequest(request); err != nil {
+		return nil, nil, err
+	}
+
+	variables, err := parseFormFileVariables(form, fileKey, isList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 构建工作流inputs，按类型后缀或JSON inputs字段转换其他表单参数
+	if request.Inputs, request.TypedInputs, err = utils.BuildFormInputs(form); err != nil {
+		return nil, nil, err
+	}
+
+	return request, variables, nil
+}
+
+// NormalizeWorkflowRequest 校验并规范化工作流请求的公共参数
+// domain必填且必须是http(s)地址；user默认为DEFAULT_USER；response_mode默认为blocking，
+// aggregate表示以streaming模式调用Dify并在服务端汇总为blocking模式的响应
+func NormalizeWorkflowRequest(request *model.SingleFileWorkflowRequest) error {
+	// 验证域名
+	domain, err := NormalizeDomain(request.Domain)
+	if err != nil {
+		return err
+	}
+	request.Domain = domain
+
+	// 用户标识
+	request.User = strings.TrimSpace(request.User)
+	if request.User == "" {
+		request.User = config.Config.DefaultUser
+	}
+
+	// 响应模式
+	request.ResponseMode = strings.ToLower(strings.TrimSpace(request.ResponseMode))
+	if request.ResponseMode == "" {
+		request.ResponseMode = "blocking"
+	}
+	if request.ResponseMode != "blocking" && request.ResponseMode != "streaming" && request.ResponseMode != "aggregate" {
+		return errors.New("响应模式只支持 blocking、streaming 或 aggregate")
+	}
+
+	// 结果缓存模式
+	request.Cache = strings.ToLower(strings.TrimSpace(request.Cache))
+	if !utils.IsValidResultCacheMode(request.Cache) {
+		return errors.New("cache参数只支持 bypass 或 refresh")
+	}
+
+	// 异步回调地址
+	if request.Async != nil {
+		request.Async.CallbackURL = strings.TrimSpace(request.Async.CallbackURL)
+		if !isHTTPURL(request.Async.CallbackURL) {
+			return errors.New("回调地址格式错误，应以 http:// 或 https:// 开头")
+		}
+	}
+
+	// 输出提取规则
+	if request.Output != nil {
+		for name, path := range request.Output.Select {
+			if strings.TrimSpace(name) == "" || strings.TrimSpace(path) == "" {
+				return errors.New("output.select中的字段名和路径不能为空")
+			}
+		}
+	}
+
+	// 输出JSON Schema校验规则，Schema在此编译以便尽早返回错误
+	if request.OutputSchema != nil {
+		request.OutputSchema.Field = strings.TrimSpace(request.OutputSchema.Field)
+		if request.OutputSchema.Field == "" {
+			return errors.New("output_schema中需要指定校验的输出字段field")
+		}
+		if request.OutputSchema.MaxRetries < 0 || request.OutputSchema.MaxRetries > config.Config.OutputSchemaRetries {
+			return fmt.Errorf("output_schema.max_retries应在0到%d之间", config.Config.OutputSchemaRetries)
+		}
+		if _, err := utils.CompileOutputSchema(request.OutputSchema); err != nil {
+			return err
+		}
+	}
+
+	// 输出文件转存
+	if request.RehostFiles && utils.GetArtifactStore() == nil {
+		return errors.New("服务未启用输出文件转存，请检查ARTIFACT_STORE配置")
+	}
+
+	if request.Inputs == nil {
+		request.Inputs = make(map[string]interface{})
+	}
+	return nil
+}
+
+// NormalizeDomain 校验Dify域名并去掉末尾的 /
+func NormalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), "/")
+	if domain == "" {
+		return "", errors.New("域名不能为空")
+	}
+	if !isHTTPURL(domain) {
+		return "", errors.New("域名格式错误，应以 http:// 或 https:// 开头")
+	}
+	return domain, nil
+}
+
+// isHTTPURL 判断是否为http(s)地址
+func isHTTPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// formValue 获取表单字段的第一个值
+func formValue(form *multipart.Form, key string) string {
+	if values := form.Value[key]; len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// parseJSONFileVariables 从inputs中解析文件变量，并移除 file、files 字段避免重复
+func parseJSONFileVariables(inputs map[string]interface{}, isList bool) ([]model.FileVariable, error) {
+	var variables []model.FileVariable
+
+	// 检查是否有file字段
+	if fileInput, ok := inputs["file"]; ok {
+		// 解析file字段
+		fileInputMap, ok := fileInput.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("file字段格式错误")
+		}
+
+		variable, err := utils.ParseFileVariable(fileInputMap, "")
+		if err != nil {
+			return nil, err
+		}
+		if variable.IsList != isList {
+			if isList {
+				return nil, errors.New("文件URL列表不能为空")
+			}
+			return nil, errors.New("文件URL不能为空")
+		}
+		variables = append(variables, variable)
+	}
+
+	// 检查是否有files字段（多个文件变量）
+	if filesInput, ok := inputs["files"]; ok {
+		namedVariables, err := utils.ParseFilesSpec(filesInput)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, namedVariables...)
+	}
+
+	if err := utils.ValidateFileVariables(variables); err != nil {
+		return nil, err
+	}
+
+	// 移除file、files字段，避免重复
+	delete(inputs, "file")
+	delete(inputs, "files")
+
+	return variables, nil
+}
+
+// parseFormFileVariables 解析表单中的文件变量（主文件字段、file_urls 及 file[变量名]/files[变量名]）
+func parseFormFileVariables(form *multipart.Form, fileKey string, isList bool) ([]model.FileVariable, error) {
+	var variables []model.FileVariable
+
+	// 表单中的文件URL
+	urlSources, err := parseFormFileURLs(form.Value["file_urls"])
+	if err != nil {
+		return nil, err
+	}
+	urlsValue := formValue(form, "file_urls_value")
+	mergeURLs := len(urlSources) > 0 && urlsValue == ""
+
+	// 主文件字段
+	if files := form.File[fileKey]; len(files) > 0 || mergeURLs {
+		if !isList && !mergeURLs && len(files) > 1 {
+			return nil, errors.New("单文件模式只支持上传一个文件")
+		}
+
+		// 获取文件映射键
+		fileValue := formValue(form, "file_value")
+		if fileValue == "" {
+			return nil, errors.New("未指定文件映射键")
+		}
+
+		// 合并URL后变量始终为文件列表
+		variable := model.FileVariable{FileValue: fileValue, IsList: isList || mergeURLs, Type: formValue(form, "file_type")}
+		for _, fileHeader := range files {
+			source, err := utils.ReadFormFileSource(fileHeader)
+			if err != nil {
+				return nil, err
+			}
+			variable.Sources = append(variable.Sources, source)
+		}
+		if mergeURLs {
+			variable.Sources = append(variable.Sources, urlSources...)
+		}
+		variables = append(variables, variable)
+	}
+
+	// 单独的URL文件列表变量
+	if len(urlSources) > 0 && urlsValue != "" {
+		variables = append(variables, model.FileVariable{FileValue: urlsValue, Sources: urlSources, IsList: true})
+	}
+
+	// file[变量名] / files[变量名] 形式的其他文件变量
+	namedVariables, err := utils.ParseFormFileVariables(form)
+	if err != nil {
+		return nil, err
+	}
+	variables = append(variables, namedVariables...)
+
+	if len(variables) == 0 {
+		return nil, fmt.Errorf("未找到名为 %s 的文件", fileKey)
+	}
+	if err = utils.ValidateFileVariables(variables); err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+// applyFormOptions 从表单参数读取请求选项
+// 支持 file_type_mapping（JSON映射）、refresh_file_types（从应用参数获取允许类型）、
+// expand_archives（展开压缩包）及其过滤条件 archive_include、archive_types（逗号分隔）、cache（结果缓存模式）、
+// coerce_inputs（是否按应用参数转换inputs类型）、stream_resume（流式客户端断开后继续执行）、output（输出提取规则JSON）、
+// output_schema（输出JSON Schema校验规则JSON）、rehost_files（是否转存输出文件）；
+// JSON格式的选项无法解析时返回错误，与JSON请求的行为一致
+func applyFormOptions(request *model.SingleFileWorkflowRequest, form *multipart.Form) error {
+	if values := form.Value["file_type_mapping"]; len(values) > 0 && values[0] != "" {
+		if err := json.Unmarshal([]byte(values[0]), &request.FileTypeMapping); err != nil {
+			return fmt.Errorf("file_type_mapping不是有效的JSON: %w", err)
+		}
+	}
+
+	if values := form.Value["refresh_file_types"]; len(values) > 0 {
+		request.RefreshFileTypes, _ = strconv.ParseBool(values[0])
+	}
+
+	if values := form.Value["expand_archives"]; len(values) > 0 {
+		if enabled, _ := strconv.ParseBool(values[0]); enabled {
+			request.ExpandArchives = &model.ArchiveOptions{
+				Enabled: true,
+				Include: splitFormList(form.Value["archive_include"]),
+				Types:   splitFormList(form.Value["archive_types"]),
+			}
+		}
+	}
+
+	if values := form.Value["coerce_inputs"]; len(values) > 0 {
+		if coerce, err := strconv.ParseBool(values[0]); err == nil {
+			request.CoerceInputs = coerce
+		}
+	}
+
+	if values := form.Value["output"]; len(values) > 0 && values[0] != "" {
+		if err := json.Unmarshal([]byte(values[0]), &request.Output); err != nil {
+			return fmt.Errorf("output不是有效的JSON: %w", err)
+		}
+	}
+
+	if values := form.Value["output_schema"]; len(values) > 0 && values[0] != "" {
+		if err := json.Unmarshal([]byte(values[0]), &request.OutputSchema); err != nil {
+			return fmt.Errorf("output_schema不是有效的JSON: %w", err)
+		}
+	}
+
+	if values := form.Value["stream_resume"]; len(values) > 0 {
+		request.StreamResume, _ = strconv.ParseBool(values[0])
+	}
+
+	if values := form.Value["rehost_files"]; len(values) > 0 {
+		request.RehostFiles, _ = strconv.ParseBool(values[0])
+	}
+
+	if values := form.Value["cache"]; len(values) > 0 {
+		request.Cache = strings.ToLower(strings.TrimSpace(values[0]))
+	}
+	return nil
+}
+
+// parseFormFileURLs 解析表单中的 file_urls 字段
+// 每个值可以是单个URL（可重复出现），也可以是JSON数组（元素为URL字符串或带请求参数的对象）
+func parseFormFileURLs(values []string) ([]model.FileSource, error) {
+	var sources []model.FileSource
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if strings.HasPrefix(value, "[") {
+			var items []interface{}
+			if err := json.Unmarshal([]byte(value), &items); err != nil {
+				return nil, fmt.Errorf("file_urls格式错误: %w", err)
+			}
+			for _, item := range items {
+				source, err := utils.ParseFileSource(item)
+				if err != nil {
+					return nil, fmt.Errorf("file_urls中包含无效URL: %w", err)
+				}
+				sources = append(sources, source)
+			}
+			continue
+		}
+		sources = append(sources, model.FileSource{URL: value})
+	}
+	return sources, nil
+}
+
+// splitFormList 将逗号分隔或重复出现的表单值拆分为列表
+func splitFormList(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,421 @@
+package service
+
+import (
+	"bytes"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// formFile 测试用表单文件
+type formFile struct {
+	field    string
+	filename string
+	content  []byte
+}
+
+// buildMultipartForm 构建并解析multipart表单，maxMemory较小时文件会写入临时文件
+func buildMultipartForm(t *testing.T, values map[string][]string, files []formFile, maxMemory int64) *multipart.Form {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, items := range values {
+		for _, value := range items {
+			if err := writer.WriteField(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, file := range files {
+		part, err := writer.CreateFormFile(file.field, file.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = part.Write(file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if err = req.ParseMultipartForm(maxMemory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { req.MultipartForm.RemoveAll() })
+	return req.MultipartForm
+}
+
+// buildJSONRequest 解析JSON请求体
+func buildJSONRequest(t *testing.T, body string) *model.SingleFileWorkflowRequest {
+	t.Helper()
+
+	var request model.SingleFileWorkflowRequest
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		t.Fatal(err)
+	}
+	return &request
+}
+
+func TestNormalizeWorkflowRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request model.SingleFileWorkflowRequest
+		want    model.SingleFileWorkflowRequest
+		wantErr string
+	}{
+		{
+			name:    "默认值",
+			request: model.SingleFileWorkflowRequest{Domain: "https://api.dify.ai"},
+			want:    model.SingleFileWorkflowRequest{Domain: "https://api.dify.ai", User: config.Config.DefaultUser, ResponseMode: "blocking"},
+		},
+		{
+			name:    "规范化",
+			request: model.SingleFileWorkflowRequest{Domain: " https://api.dify.ai/ ", User: " u1 ", ResponseMode: "Streaming", Cache: "REFRESH"},
+			want:    model.SingleFileWorkflowRequest{Domain: "https://api.dify.ai", User: "u1", ResponseMode: "streaming", Cache: "refresh"},
+		},
+		{name: "缺少域名", request: model.SingleFileWorkflowRequest{}, wantErr: "域名不能为空"},
+		{name: "域名缺少协议", request: model.SingleFileWorkflowRequest{Domain: "api.dify.ai"}, wantErr: "域名格式错误"},
+		{name: "无效响应模式", request: model.SingleFileWorkflowRequest{Domain: "https://api.dify.ai", ResponseMode: "sync"}, wantErr: "响应模式只支持"},
+		{name: "无效缓存模式", request: model.SingleFileWorkflowRequest{Domain: "https://api.dify.ai", Cache: "always"}, wantErr: "cache参数只支持"},
+		{
+			name:    "无效回调地址",
+			request: model.SingleFileWorkflowRequest{Domain: "https://api.dify.ai", Async: &model.AsyncRequest{CallbackURL: "ftp://example.com"}},
+			wantErr: "回调地址格式错误",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := tt.request
+			err := NormalizeWorkflowRequest(&request)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if request.Domain != tt.want.Domain || request.User != tt.want.User ||
+				request.ResponseMode != tt.want.ResponseMode || request.Cache != tt.want.Cache {
+				t.Errorf("got %+v, want %+v", request, tt.want)
+			}
+			if request.Inputs == nil {
+				t.Error("inputs未初始化")
+			}
+		})
+	}
+}
+
+// TestFormAndJSONRequestsMatch 同一请求通过JSON和form-data构建，公共参数应一致
+func TestFormAndJSONRequestsMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		isList bool
+		json   string
+		form   map[string][]string
+	}{
+		{
+			name:   "单文件默认值",
+			isList: false,
+			json:   `{"domain":"https://api.dify.ai/","inputs":{"file":{"file_url":"https://example.com/a.pdf","file_value":"doc"},"lang":"zh"}}`,
+			form:   map[string][]string{"domain": {"https://api.dify.ai/"}, "file_value": {"doc"}, "lang": {"zh"}},
+		},
+		{
+			name:   "多文件异步",
+			isList: true,
+			json: `{"domain":"https://api.dify.ai","user":"u1","response_mode":"STREAMING","cache":"bypass",
+				"async":{"callback_url":"https://cb.example.com/hook","request_id":"r1"},
+				"inputs":{"file":{"file_urls":["https://example.com/a.pdf"],"file_value":"docs"}}}`,
+			form: map[string][]string{
+				"domain": {"https://api.dify.ai"}, "user": {"u1"}, "response_mode": {"STREAMING"}, "cache": {"bypass"},
+				"callback_url": {"https://cb.example.com/hook"}, "request_id": {"r1"}, "file_value": {"docs"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonRequest := buildJSONRequest(t, tt.json)
+			jsonVariables, err := BuildJSONWorkflowRequest(jsonRequest, tt.isList)
+			if err != nil {
+				t.Fatalf("JSON: %v", err)
+			}
+
+			fileKey := "file"
+			if tt.isList {
+				fileKey = "files"
+			}
+			form := buildMultipartForm(t, tt.form, []formFile{{fileKey, "a.pdf", []byte("%PDF-1.4")}}, 1<<20)
+			formRequest, formVariables, err := BuildFormWorkflowRequest(form, fileKey, tt.isList)
+			if err != nil {
+				t.Fatalf("form: %v", err)
+			}
+
+			if jsonRequest.Domain != formRequest.Domain || jsonRequest.User != formRequest.User ||
+				jsonRequest.ResponseMode != formRequest.ResponseMode || jsonRequest.Cache != formRequest.Cache {
+				t.Errorf("公共参数不一致: json=%+v form=%+v", jsonRequest, formRequest)
+			}
+			if (jsonRequest.Async == nil) != (formRequest.Async == nil) ||
+				(jsonRequest.Async != nil && *jsonRequest.Async != *formRequest.Async) {
+				t.Errorf("异步参数不一致: json=%+v form=%+v", jsonRequest.Async, formRequest.Async)
+			}
+			if len(jsonVariables) != 1 || len(formVariables) != 1 ||
+				jsonVariables[0].FileValue != formVariables[0].FileValue || jsonVariables[0].IsList != formVariables[0].IsList {
+				t.Errorf("文件变量不一致: json=%+v form=%+v", jsonVariables, formVariables)
+			}
+			if jsonRequest.Inputs["lang"] != formRequest.Inputs["lang"] {
+				t.Errorf("inputs不一致: json=%v form=%v", jsonRequest.Inputs, formRequest.Inputs)
+			}
+			if _, ok := jsonRequest.Inputs["file"]; ok {
+				t.Error("JSON inputs中未移除file字段")
+			}
+		})
+	}
+}
+
+// TestFormAndJSONErrorsMatch 同样的参数错误在JSON和form-data请求中返回相同的错误
+func TestFormAndJSONErrorsMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		form map[string][]string
+	}{
+		{
+			name: "缺少域名",
+			json: `{"inputs":{"file":{"file_url":"https://example.com/a.pdf","file_value":"doc"}}}`,
+			form: map[string][]string{"file_value": {"doc"}},
+		},
+		{
+			name: "无效响应模式",
+			json: `{"domain":"https://api.dify.ai","response_mode":"sync","inputs":{"file":{"file_url":"https://example.com/a.pdf","file_value":"doc"}}}`,
+			form: map[string][]string{"domain": {"https://api.dify.ai"}, "response_mode": {"sync"}, "file_value": {"doc"}},
+		},
+		{
+			name: "无效回调地址",
+			json: `{"domain":"https://api.dify.ai","async":{"callback_url":"not-a-url"},"inputs":{"file":{"file_url":"https://example.com/a.pdf","file_value":"doc"}}}`,
+			form: map[string][]string{"domain": {"https://api.dify.ai"}, "callback_url": {"not-a-url"}, "file_value": {"doc"}},
+		},
+		{
+			name: "output_schema缺少field",
+			json: `{"domain":"https://api.dify.ai","output_schema":{"schema":{"type":"object"}},"inputs":{"file":{"file_url":"https://example.com/a.pdf","file_value":"doc"}}}`,
+			form: map[string][]string{"domain": {"https://api.dify.ai"}, "output_schema": {`{"schema":{"type":"object"}}`}, "file_value": {"doc"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, jsonErr := BuildJSONWorkflowRequest(buildJSONRequest(t, tt.json), false)
+			form := buildMultipartForm(t, tt.form, []formFile{{"file", "a.pdf", []byte("%PDF-1.4")}}, 1<<20)
+			_, _, formErr := BuildFormWorkflowRequest(form, "file", false)
+			if jsonErr == nil || formErr == nil {
+				t.Fatalf("应返回错误: json=%v form=%v", jsonErr, formErr)
+			}
+			if jsonErr.Error() != formErr.Error() {
+				t.Errorf("错误不一致: json=%q form=%q", jsonErr, formErr)
+			}
+		})
+	}
+}
+
+// TestBuildFormWorkflowRequestInvalidOptions 表单中JSON格式的选项无法解析时返回错误，不忽略后继续执行
+func TestBuildFormWorkflowRequestInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   string
+		value   string
+		wantErr string
+	}{
+		{name: "output_schema格式错误", field: "output_schema", value: `{"field":"text",`, wantErr: "output_schema不是有效的JSON"},
+		{name: "output格式错误", field: "output", value: `{"fields":["text"]`, wantErr: "output不是有效的JSON"},
+		{name: "file_type_mapping格式错误", field: "file_type_mapping", value: `{"dwg":`, wantErr: "file_type_mapping不是有效的JSON"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := buildMultipartForm(t, map[string][]string{
+				"domain":     {"https://api.dify.ai"},
+				"file_value": {"doc"},
+				tt.field:     {tt.value},
+			}, []formFile{{"file", "a.pdf", []byte("%PDF-1.4")}}, 1<<20)
+			if _, _, err := BuildFormWorkflowRequest(form, "file", false); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestBuildFormWorkflowRequestReadsWholeFile 写入临时文件的大文件应被完整读取，且读取后不再依赖表单
+func TestBuildFormWorkflowRequestReadsWholeFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1MB
+	form := buildMultipartForm(t, map[string][]string{
+		"domain":     {"https://api.dify.ai"},
+		"file_value": {"docs"},
+	}, []formFile{
+		{"files", "a.txt", content},
+		{"files", "b.txt", []byte("b")},
+	}, 1024)
+
+	_, variables, err := BuildFormWorkflowRequest(form, "files", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟请求结束后清理临时文件，已读取的内容不受影响
+	if err = form.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := variables[0].Sources
+	if len(sources) != 2 {
+		t.Fatalf("文件数 = %d, want 2", len(sources))
+	}
+	if !bytes.Equal(sources[0].Content, content) {
+		t.Errorf("文件内容长度 = %d, want %d", len(sources[0].Content), len(content))
+	}
+	if sources[0].Filename != "a.txt" || string(sources[1].Content) != "b" {
+		t.Errorf("文件顺序或内容错误: %+v", sources)
+	}
+}
+
+func TestBuildFormWorkflowRequestSingleFileLimit(t *testing.T) {
+	form := buildMultipartForm(t, map[string][]string{
+		"domain":     {"https://api.dify.ai"},
+		"file_value": {"doc"},
+	}, []formFile{
+		{"file", "a.txt", []byte("a")},
+		{"file", "b.txt", []byte("b")},
+	}, 1<<20)
+
+	if _, _, err := BuildFormWorkflowRequest(form, "file", false); err == nil {
+		t.Error("单文件接口上传多个文件应返回错误")
+	}
+}
+
+// TestBuildFormWorkflowRequestFileURLs 表单中的file_urls：未指定file_urls_value时按上传文件在前、URL在后合并为文件列表，
+// 指定时作为单独的文件列表变量
+func TestBuildFormWorkflowRequestFileURLs(t *testing.T) {
+	// describe 将文件变量描述为 "变量名[]:来源,来源;..."
+	describe := func(variables []model.FileVariable) string {
+		var parts []string
+		for _, variable := range variables {
+			name := variable.FileValue
+			if variable.IsList {
+				name += "[]"
+			}
+			var sources []string
+			for _, source := range variable.Sources {
+				if source.Content != nil {
+					sources = append(sources, source.Filename)
+				} else {
+					sources = append(sources, source.URL)
+				}
+			}
+			parts = append(parts, name+":"+strings.Join(sources, ","))
+		}
+		return strings.Join(parts, ";")
+	}
+
+	uploads := []formFile{{"files", "a.pdf", []byte("a")}, {"files", "b.pdf", []byte("b")}}
+	tests := []struct {
+		name    string
+		values  map[string][]string
+		files   []formFile
+		fileKey string
+		isList  bool
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "文件列表合并URL，多个字段和JSON数组按顺序",
+			values:  map[string][]string{"file_value": {"docs"}, "file_urls": {"https://x/1.pdf", `["https://x/2.pdf",{"url":"https://x/3.pdf"}]`}},
+			files:   uploads,
+			fileKey: "files", isList: true,
+			want: "docs[]:a.pdf,b.pdf,https://x/1.pdf,https://x/2.pdf,https://x/3.pdf",
+		},
+		{
+			name:    "单文件接口合并URL后变为文件列表",
+			values:  map[string][]string{"file_value": {"doc"}, "file_urls": {"https://x/1.pdf"}},
+			files:   []formFile{{"file", "a.pdf", []byte("a")}},
+			fileKey: "file",
+			want:    "doc[]:a.pdf,https://x/1.pdf",
+		},
+		{
+			name:    "只有URL",
+			values:  map[string][]string{"file_value": {"docs"}, "file_urls": {" https://x/1.pdf ", ""}},
+			fileKey: "files", isList: true,
+			want: "docs[]:https://x/1.pdf",
+		},
+		{
+			name:    "file_urls_value指定单独的变量",
+			values:  map[string][]string{"file_value": {"doc"}, "file_urls": {"https://x/1.pdf"}, "file_urls_value": {"links"}},
+			files:   []formFile{{"file", "a.pdf", []byte("a")}},
+			fileKey: "file",
+			want:    "doc:a.pdf;links[]:https://x/1.pdf",
+		},
+		{
+			name:    "file_urls_value且没有上传文件",
+			values:  map[string][]string{"file_urls": {"https://x/1.pdf"}, "file_urls_value": {"links"}},
+			fileKey: "files", isList: true,
+			want: "links[]:https://x/1.pdf",
+		},
+		{
+			name:    "与file[变量名]组合",
+			values:  map[string][]string{"file_value": {"docs"}, "file_urls": {"https://x/1.pdf"}},
+			files:   []formFile{{"files", "a.pdf", []byte("a")}, {"file[cover]", "c.png", []byte("c")}},
+			fileKey: "files", isList: true,
+			want: "docs[]:a.pdf,https://x/1.pdf;cover:c.png",
+		},
+		{
+			name:    "合并时缺少file_value",
+			values:  map[string][]string{"file_urls": {"https://x/1.pdf"}},
+			fileKey: "files", isList: true,
+			wantErr: "未指定文件映射键",
+		},
+		{
+			name:    "file_urls JSON格式错误",
+			values:  map[string][]string{"file_value": {"docs"}, "file_urls": {`["https://x/1.pdf"`}},
+			fileKey: "files", isList: true,
+			wantErr: "file_urls格式错误",
+		},
+		{
+			name:    "file_urls包含无效URL",
+			values:  map[string][]string{"file_value": {"docs"}, "file_urls": {`[1]`}},
+			fileKey: "files", isList: true,
+			wantErr: "file_urls中包含无效URL",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.values["domain"] = []string{"https://api.dify.ai"}
+			form := buildMultipartForm(t, tt.values, tt.files, 1<<20)
+
+			_, variables, err := BuildFormWorkflowRequest(form, tt.fileKey, tt.isList)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describe(variables); got != tt.want {
+				t.Errorf("variables = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"dify-upload-workflow/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// streamAggregator 消费Dify的流式事件，汇总为与blocking模式结构相同的响应（aggregate模式）
+type streamAggregator struct {
+	taskID        string
+	workflowRunID string
+	data          map[string]interface{}   // workflow_finished事件的data
+	nodes         []map[string]interface{} // 按开始顺序排列的节点耗时
+	nodeIndex     map[string]int           // 节点执行ID到nodes下标
+	errorMessage  string
+}
+
+// newStreamAggregator 创建流式事件汇总
+func newStreamAggregator() *streamAggregator {
+	return &streamAggregator{nodeIndex: make(map[string]int)}
+}
+
+// observe 记录一个Dify事件
+func (a *streamAggregator) observe(event *utils.SSEEvent) {
+	var payload struct {
+		Event         string                 `json:"event"`
+		TaskID        string                 `json:"task_id"`
+		WorkflowRunID string                 `json:"workflow_run_id"`
+		Data          map[string]interface{} `json:"data"`
+		Message       string                 `json:"message"`
+	}
+	if event.Data == "" || json.Unmarshal([]byte(event.Data), &payload) != nil {
+		return
+	}
+
+	if a.taskID == "" {
+		a.taskID = payload.TaskID
+	}
+	if a.workflowRunID == "" {
+		a.workflowRunID = payload.WorkflowRunID
+	}
+
+	switch payload.Event {
+	case "node_started":
+		a.node(payload.Data)["status"] = "running"
+	case "node_finished":
+		node := a.node(payload.Data)
+		for _, key := range []string{"status", "elapsed_time", "error"} {
+			if value, ok := payload.Data[key]; ok && value != nil {
+				node[key] = value
+			}
+		}
+		if metadata, ok := payload.Data["execution_metadata"].(map[string]interface{}); ok {
+			for _, key := range []string{"total_tokens", "total_price", "currency"} {
+				if value, ok := metadata[key]; ok {
+					node[key] = value
+				}
+			}
+		}
+	case "workflow_finished":
+		a.data = payload.Data
+	case "error":
+		a.errorMessage = payload.Message
+	}
+}
+
+// node 获取或创建节点耗时记录，以节点执行ID区分（同一节点在迭代中可能执行多次）
+func (a *streamAggregator) node(data map[string]interface{}) map[string]interface{} {
+	id, _ := data["id"].(string)
+	if idx, ok := a.nodeIndex[id]; ok && id != "" {
+		return a.nodes[idx]
+	}
+
+	node := make(map[string]interface{})
+	for _, key := range []string{"id", "node_id", "node_type", "title", "index"} {
+		if value, ok := data[key]; ok {
+			node[key] = value
+		}
+	}
+	a.nodeIndex[id] = len(a.nodes)
+	a.nodes = append(a.nodes, node)
+	return node
+}
+
+// response 构建与blocking模式相同结构的响应：task_id、workflow_run_id 和 data（含outputs、elapsed_time、total_tokens等），
+// data中额外包含 nodes 节点耗时列表
+func (a *streamAggregator) response() (map[string]interface{}, error) {
+	if a.errorMessage != "" {
+		return nil, errors.New(a.errorMessage)
+	}
+	if a.data == nil {
+		return nil, fmt.Errorf("流式响应中没有workflow_finished事件，已完成节点数: %d", len(a.nodes))
+	}
+
+	data := make(map[string]interface{}, len(a.data)+1)
+	for key, value := range a.data {
+		data[key] = value
+	}
+	nodes := a.nodes
+	if nodes == nil {
+		nodes = []map[string]interface{}{}
+	}
+	data["nodes"] = nodes
+
+	return map[string]interface{}{
+		"task_id":         a.taskID,
+		"workflow_run_id": a.workflowRunID,
+		"data":            data,
+	}, nil
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"dify-upload-workflow/utils"
+	"strings"
+	"testing"
+)
+
+// aggregateEvents 依次汇总事件
+func aggregateEvents(t *testing.T, stream string) (map[string]interface{}, error) {
+	t.Helper()
+
+	aggregator := newStreamAggregator()
+	reader := utils.NewSSEReader(strings.NewReader(stream))
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			break
+		}
+		aggregator.observe(event)
+	}
+	return aggregator.response()
+}
+
+func TestStreamAggregator(t *testing.T) {
+	stream := `event: ping
+
+data: {"event":"workflow_started","task_id":"t1","workflow_run_id":"r1","data":{"id":"r1"}}
+
+data: {"event":"node_started","task_id":"t1","data":{"id":"e1","node_id":"start","node_type":"start","title":"开始","index":1}}
+
+data: {"event":"node_finished","task_id":"t1","data":{"id":"e1","node_id":"start","node_type":"start","title":"开始","index":1,"status":"succeeded","elapsed_time":0.01}}
+
+data: {"event":"node_started","task_id":"t1","data":{"id":"e2","node_id":"llm","node_type":"llm","title":"LLM","index":2}}
+
+data: {"event":"text_chunk","task_id":"t1","data":{"text":"hi"}}
+
+data: {"event":"node_finished","task_id":"t1","data":{"id":"e2","node_id":"llm","node_type":"llm","title":"LLM","index":2,"status":"succeeded","elapsed_time":2.5,"execution_metadata":{"total_tokens":120}}}
+
+data: {"event":"workflow_finished","task_id":"t1","workflow_run_id":"r1","data":{"id":"r1","status":"succeeded","outputs":{"text":"hi"},"elapsed_time":2.6,"total_tokens":120,"total_steps":2}}
+
+`
+	resp, err := aggregateEvents(t, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp["task_id"] != "t1" || resp["workflow_run_id"] != "r1" {
+		t.Errorf("resp = %v", resp)
+	}
+
+	data := resp["data"].(map[string]interface{})
+	if data["status"] != "succeeded" || data["total_tokens"] != float64(120) || data["elapsed_time"] != 2.6 {
+		t.Errorf("data = %v", data)
+	}
+	if outputs := data["outputs"].(map[string]interface{}); outputs["text"] != "hi" {
+		t.Errorf("outputs = %v", outputs)
+	}
+
+	nodes := data["nodes"].([]map[string]interface{})
+	if len(nodes) != 2 {
+		t.Fatalf("nodes = %v", nodes)
+	}
+	if nodes[1]["node_id"] != "llm" || nodes[1]["elapsed_time"] != 2.5 || nodes[1]["total_tokens"] != float64(120) || nodes[1]["status"] != "succeeded" {
+		t.Errorf("nodes[1] = %v", nodes[1])
+	}
+}
+
+func TestStreamAggregatorErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		wantErr string
+	}{
+		{
+			name:    "错误事件",
+			stream:  "data: {\"event\":\"error\",\"task_id\":\"t1\",\"status\":400,\"code\":\"invalid_param\",\"message\":\"参数错误\"}\n\n",
+			wantErr: "参数错误",
+		},
+		{
+			name:    "流提前结束",
+			stream:  "data: {\"event\":\"node_started\",\"task_id\":\"t1\",\"data\":{\"id\":\"e1\",\"node_id\":\"start\"}}\n\n",
+			wantErr: "没有workflow_finished事件",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := aggregateEvents(t, tt.stream); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
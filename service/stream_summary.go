@@ -0,0 +1,141 @@
+package service
+
+import (
+	"dify-upload-workflow/model"
+	"dify-upload-workflow/utils"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// streamSummary 流式执行过程中收集的汇总信息，流结束时作为 summary 事件发送，
+// 同时累积工作流输出和文本，作为流式请求的执行结果记录
+type streamSummary struct {
+	TaskID        string
+	WorkflowRunID string
+	Status        string
+	Error         string
+	FileCount     int
+	EventCount    int
+	TextLength    int
+	StartedAt     time.Time
+	Outputs       interface{}
+	text          strings.Builder
+
+	// 用量：Token数和耗时取自workflow_finished事件，费用合计node_finished事件执行元数据中的价格
+	totalTokens int64
+	elapsedTime float64
+	totalPrice  float64
+	currency    string
+}
+
+// newStreamSummary 创建流式汇总
+func newStreamSummary(fileCount int) *streamSummary {
+	return &streamSummary{FileCount: fileCount, StartedAt: time.Now()}
+}
+
+// observe 记录一个Dify事件
+func (s *streamSummary) observe(event *utils.SSEEvent) {
+	s.EventCount++
+
+	var payload struct {
+		Event         string `json:"event"`
+		TaskID        string `json:"task_id"`
+		WorkflowRunID string `json:"workflow_run_id"`
+		Data          struct {
+			Text    string      `json:"text"`
+			Status  string      `json:"status"`
+			Error   string      `json:"error"`
+			Outputs interface{} `json:"outputs"`
+		} `json:"data"`
+		Message string `json:"message"`
+	}
+	if event.Data == "" || json.Unmarshal([]byte(event.Data), &payload) != nil {
+		return
+	}
+
+	if s.TaskID == "" {
+		s.TaskID = payload.TaskID
+	}
+	if s.WorkflowRunID == "" {
+		s.WorkflowRunID = payload.WorkflowRunID
+	}
+
+	switch payload.Event {
+	case "text_chunk":
+		s.TextLength += len([]rune(payload.Data.Text))
+		s.text.WriteString(payload.Data.Text)
+	case "node_finished":
+		// 价格可能是数字或字符串
+		metadata := gjson.Get(event.Data, "data.execution_metadata")
+		s.totalPrice += metadata.Get("total_price").Float()
+		if s.currency == "" {
+			s.currency = metadata.Get("currency").String()
+		}
+	case "workflow_finished":
+		s.Status = payload.Data.Status
+		s.Outputs = payload.Data.Outputs
+		s.totalTokens = gjson.Get(event.Data, "data.total_tokens").Int()
+		s.elapsedTime = gjson.Get(event.Data, "data.elapsed_time").Float()
+		if payload.Data.Error != "" {
+			s.Error = payload.Data.Error
+		}
+	case "error":
+		s.Status = "failed"
+		s.Error = payload.Message
+	}
+}
+
+// payload 构建 summary 事件内容
+func (s *streamSummary) payload() map[string]interface{} {
+	data := map[string]interface{}{
+		"status":       s.Status,
+		"file_count":   s.FileCount,
+		"event_count":  s.EventCount,
+		"text_length":  s.TextLength,
+		"elapsed_time": time.Since(s.StartedAt).Seconds(),
+	}
+	if s.Error != "" {
+		data["error"] = s.Error
+	}
+
+	return map[string]interface{}{
+		"event":           "summary",
+		"task_id":         s.TaskID,
+		"workflow_run_id": s.WorkflowRunID,
+		"data":            data,
+	}
+}
+
+// usage 流式执行的用量，工作流未结束时耗时为从开始到现在的时间
+func (s *streamSummary) usage() model.WorkflowUsage {
+	elapsed := s.elapsedTime
+	if elapsed == 0 {
+		elapsed = time.Since(s.StartedAt).Seconds()
+	}
+	return model.WorkflowUsage{
+		Status:      s.Status,
+		TotalTokens: s.totalTokens,
+		TotalPrice:  s.totalPrice,
+		Currency:    s.currency,
+		ElapsedTime: elapsed,
+	}
+}
+
+// result 构建流式请求的执行结果记录
+func (s *streamSummary) result() map[string]interface{} {
+	result := map[string]interface{}{
+		"task_id":         s.TaskID,
+		"workflow_run_id": s.WorkflowRunID,
+		"status":          s.Status,
+		"outputs":         s.Outputs,
+		"text":            s.text.String(),
+		"elapsed_time":    time.Since(s.StartedAt).Seconds(),
+	}
+	if s.Error != "" {
+		result["error"] = s.Error
+	}
+	return result
+}
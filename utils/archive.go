@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ArchiveEntryHandler 处理解压出的单个文件，返回错误时停止解压
+type ArchiveEntryHandler func(entry *model.DownloadedFile) error
+
+// IsArchive 判断文件是否为支持展开的压缩包（zip、tar、tar.gz）
+func IsArchive(file *model.DownloadedFile) bool {
+	return archiveFormat(file) != ""
+}
+
+// archiveFormat 根据检测到的MIME类型判断压缩包格式
+func archiveFormat(file *model.DownloadedFile) string {
+	switch file.DetectedMimeType {
+	case "application/zip":
+		return "zip"
+	case "application/x-tar":
+		return "tar"
+	case "application/gzip", "application/x-gzip":
+		// 只处理gzip压缩的tar包
+		if isGzippedTar(file.Content) {
+			return "tar.gz"
+		}
+	}
+	return ""
+}
+
+// ResolveArchiveOptions 合并请求级和全局配置的压缩包限制，请求只能收紧限制
+func ResolveArchiveOptions(opts *model.ArchiveOptions) *model.ArchiveOptions {
+	resolved := &model.ArchiveOptions{
+		Enabled:      opts != nil && opts.Enabled,
+		MaxEntries:   config.Config.ArchiveMaxEntries,
+		MaxTotalSize: config.Config.ArchiveMaxTotalSize,
+		MaxRatio:     config.Config.ArchiveMaxRatio,
+	}
+	if opts == nil {
+		return resolved
+	}
+
+	resolved.Include = opts.Include
+	resolved.Types = opts.Types
+	if opts.MaxEntries > 0 && opts.MaxEntries < resolved.MaxEntries {
+		resolved.MaxEntries = opts.MaxEntries
+	}
+	if opts.MaxTotalSize > 0 && opts.MaxTotalSize < resolved.MaxTotalSize {
+		resolved.MaxTotalSize = opts.MaxTotalSize
+	}
+	if opts.MaxRatio > 0 && opts.MaxRatio < resolved.MaxRatio {
+		resolved.MaxRatio = opts.MaxRatio
+	}
+	return resolved
+}
+
+// ExpandArchive 逐个解压压缩包中的文件并交给handler处理，不会一次性解压全部内容
+// 按opts过滤条目（glob、文件类型），并限制条目数、解压总大小和压缩比以防范压缩炸弹；
+// typeOpts为判断条目文件类型、补全扩展名时使用的请求级文件类型选项（可为nil）
+func ExpandArchive(file *model.DownloadedFile, opts *model.ArchiveOptions, typeOpts *model.FileTypeOptions, handler ArchiveEntryHandler) error {
+	limiter := &archiveLimiter{opts: opts, typeOpts: typeOpts, archiveSize: int64(len(file.Content))}
+
+	switch archiveFormat(file) {
+	case "zip":
+		return expandZip(file.Content, limiter, handler)
+	case "tar":
+		return expandTar(bytes.NewReader(file.Content), limiter, handler)
+	case "tar.gz":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(file.Content))
+		if err != nil {
+			return fmt.Errorf("打开gzip失败: %w", err)
+		}
+		defer gzipReader.Close()
+		return expandTar(gzipReader, limiter, handler)
+	default:
+		return errors.New("不支持的压缩包格式")
+	}
+}
+
+// archiveLimiter 跟踪解压过程中的条目数和总大小
+type archiveLimiter struct {
+	opts        *model.ArchiveOptions
+	typeOpts    *model.FileTypeOptions
+	archiveSize int64
+	entries     int
+	totalSize   int64
+}
+
+// addEntry 登记一个条目，超过条目数限制时返回错误
+func (l *archiveLimiter) addEntry() error {
+	l.entries++
+	if l.opts.MaxEntries > 0 && l.entries > l.opts.MaxEntries {
+		return fmt.Errorf("压缩包条目数超过限制 %d", l.opts.MaxEntries)
+	}
+	return nil
+}
+
+// readEntry 读取单个条目内容，同时检查解压总大小和整体压缩比
+func (l *archiveLimiter) readEntry(reader io.Reader) ([]byte, error) {
+	remaining := l.opts.MaxTotalSize - l.totalSize
+	content, err := io.ReadAll(io.LimitReader(reader, remaining+1))
+	if err != nil {
+		return nil, err
+	}
+
+	l.totalSize += int64(len(content))
+	if l.totalSize > l.opts.MaxTotalSize {
+		return nil, fmt.Errorf("压缩包解压总大小超过限制 %d 字节", l.opts.MaxTotalSize)
+	}
+	if l.opts.MaxRatio > 0 && l.archiveSize > 0 && float64(l.totalSize)/float64(l.archiveSize) > l.opts.MaxRatio {
+		return nil, fmt.Errorf("压缩包压缩比超过限制 %.0f", l.opts.MaxRatio)
+	}
+	return content, nil
+}
+
+// expandZip 展开zip压缩包
+func expandZip(content []byte, limiter *archiveLimiter, handler ArchiveEntryHandler) error {
+	opts := limiter.opts
+	zipReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return fmt.Errorf("打开zip失败: %w", err)
+	}
+
+	for _, zipFile := range zipReader.File {
+		if zipFile.FileInfo().IsDir() || !zipFile.Mode().IsRegular() || !matchArchiveEntry(zipFile.Name, opts, limiter.typeOpts) {
+			continue
+		}
+		if err := limiter.addEntry(); err != nil {
+			return err
+		}
+
+		// 根据头信息预先检查单个条目的压缩比，头信息可能被伪造，读取时仍会实际校验
+		if opts.MaxRatio > 0 && zipFile.CompressedSize64 > 0 &&
+			float64(zipFile.UncompressedSize64)/float64(zipFile.CompressedSize64) > opts.MaxRatio {
+			return fmt.Errorf("压缩包条目 %s 压缩比超过限制 %.0f", zipFile.Name, opts.MaxRatio)
+		}
+
+		entryReader, err := zipFile.Open()
+		if err != nil {
+			return fmt.Errorf("读取压缩包条目 %s 失败: %w", zipFile.Name, err)
+		}
+		entryContent, err := limiter.readEntry(entryReader)
+		entryReader.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := handler(buildLocalFile(entryContent, path.Base(zipFile.Name), "", limiter.typeOpts)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandTar 展开tar压缩包（顺序读取）
+func expandTar(reader io.Reader, limiter *archiveLimiter, handler ArchiveEntryHandler) error {
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("读取tar失败: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg || !matchArchiveEntry(header.Name, limiter.opts, limiter.typeOpts) {
+			continue
+		}
+		if err := limiter.addEntry(); err != nil {
+			return err
+		}
+
+		entryContent, err := limiter.readEntry(tarReader)
+		if err != nil {
+			return err
+		}
+
+		if err := handler(buildLocalFile(entryContent, path.Base(header.Name), "", limiter.typeOpts)); err != nil {
+			return err
+		}
+	}
+}
+
+// matchArchiveEntry 按glob和文件类型过滤条目，并忽略系统生成的隐藏文件
+func matchArchiveEntry(name string, opts *model.ArchiveOptions, typeOpts *model.FileTypeOptions) bool {
+	name = strings.ReplaceAll(name, "\\", "/")
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/") || strings.Contains(name, "/__MACOSX/") {
+		return false
+	}
+
+	if len(opts.Include) > 0 {
+		matched := false
+		for _, pattern := range opts.Include {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = true
+				break
+			}
+			if ok, _ := path.Match(pattern, base); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(opts.Types) > 0 && !containsString(opts.Types, ResolveFileType(GetFileExtension(base), typeOpts)) {
+		return false
+	}
+
+	return true
+}
+
+// isGzippedTar 判断gzip内容是否为tar包（检查解压后头部的ustar标记）
+func isGzippedTar(content []byte) bool {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return false
+	}
+	defer gzipReader.Close()
+
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(gzipReader, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header[257:262], []byte("ustar"))
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"dify-upload-workflow/model"
+	"strings"
+	"testing"
+)
+
+// archiveEntry 测试用压缩包条目
+type archiveEntry struct {
+	name    string
+	content string
+}
+
+// buildZip 在内存中构建zip压缩包
+func buildZip(t *testing.T, entries []archiveEntry) *model.DownloadedFile {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := writer.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry.content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &model.DownloadedFile{Content: buf.Bytes(), Filename: "a.zip", DetectedMimeType: "application/zip"}
+}
+
+// buildTarGz 在内存中构建tar.gz压缩包
+func buildTarGz(t *testing.T, entries []archiveEntry) *model.DownloadedFile {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write([]byte(entry.content))
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &model.DownloadedFile{Content: buf.Bytes(), Filename: "a.tar.gz", DetectedMimeType: "application/gzip"}
+}
+
+func TestExpandArchive(t *testing.T) {
+	small := []archiveEntry{{"a.pdf", "aaaa"}, {"b.pdf", "bbbb"}, {"c.pdf", "cccc"}}
+	zeros := []archiveEntry{{"zeros.txt", strings.Repeat("0", 100000)}}
+	unlimited := model.ArchiveOptions{MaxEntries: 100, MaxTotalSize: 1 << 20, MaxRatio: 1000}
+
+	tests := []struct {
+		name      string
+		build     func(*testing.T, []archiveEntry) *model.DownloadedFile
+		entries   []archiveEntry
+		opts      model.ArchiveOptions
+		typeOpts  *model.FileTypeOptions
+		wantFiles string // 展开的文件名，逗号分隔
+		wantErr   string
+	}{
+		{
+			name: "zip", build: buildZip, entries: small, opts: unlimited,
+			wantFiles: "a.pdf,b.pdf,c.pdf",
+		},
+		{
+			name: "tar.gz", build: buildTarGz, entries: small, opts: unlimited,
+			wantFiles: "a.pdf,b.pdf,c.pdf",
+		},
+		{
+			name: "zip条目数超过限制", build: buildZip, entries: small,
+			opts:    model.ArchiveOptions{MaxEntries: 2, MaxTotalSize: 1 << 20},
+			wantErr: "条目数超过限制 2",
+		},
+		{
+			name: "tar.gz条目数超过限制", build: buildTarGz, entries: small,
+			opts:    model.ArchiveOptions{MaxEntries: 2, MaxTotalSize: 1 << 20},
+			wantErr: "条目数超过限制 2",
+		},
+		{
+			name: "zip解压总大小超过限制", build: buildZip, entries: small,
+			opts:    model.ArchiveOptions{MaxEntries: 100, MaxTotalSize: 10},
+			wantErr: "解压总大小超过限制 10",
+		},
+		{
+			name: "tar.gz解压总大小超过限制", build: buildTarGz, entries: small,
+			opts:    model.ArchiveOptions{MaxEntries: 100, MaxTotalSize: 10},
+			wantErr: "解压总大小超过限制 10",
+		},
+		{
+			name: "zip条目头信息压缩比预检查", build: buildZip, entries: zeros,
+			opts:    model.ArchiveOptions{MaxEntries: 100, MaxTotalSize: 1 << 20, MaxRatio: 10},
+			wantErr: "压缩包条目 zeros.txt 压缩比超过限制",
+		},
+		{
+			name: "tar.gz整体压缩比超过限制", build: buildTarGz, entries: zeros,
+			opts:    model.ArchiveOptions{MaxEntries: 100, MaxTotalSize: 1 << 20, MaxRatio: 10},
+			wantErr: "压缩包压缩比超过限制",
+		},
+		{
+			name: "按glob和文件类型过滤", build: buildZip,
+			entries: []archiveEntry{
+				{"docs/a.pdf", "a"}, {"docs/b.png", "b"}, {"other/c.pdf", "c"}, {"docs/.hidden.pdf", "d"}, {"__MACOSX/docs/._a.pdf", "e"},
+			},
+			opts:      model.ArchiveOptions{MaxEntries: 100, MaxTotalSize: 1 << 20, Include: []string{"docs/*"}, Types: []string{"document"}},
+			wantFiles: "a.pdf",
+		},
+		{
+			name: "过滤掉的条目不计入条目数", build: buildTarGz,
+			entries:   []archiveEntry{{"a.txt", "a"}, {"b.txt", "b"}, {"c.pdf", "c"}},
+			opts:      model.ArchiveOptions{MaxEntries: 1, MaxTotalSize: 1 << 20, Include: []string{"*.pdf"}},
+			wantFiles: "c.pdf",
+		},
+		{
+			name: "文件类型过滤使用请求级映射", build: buildZip,
+			entries:   []archiveEntry{{"drawing.dwg", "a"}, {"notes.txt", "b"}},
+			opts:      model.ArchiveOptions{MaxEntries: 100, MaxTotalSize: 1 << 20, Types: []string{"document"}},
+			typeOpts:  &model.FileTypeOptions{Mapping: map[string]string{"dwg": "document", "txt": "custom"}},
+			wantFiles: "drawing.dwg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			err := ExpandArchive(tt.build(t, tt.entries), &tt.opts, tt.typeOpts, func(entry *model.DownloadedFile) error {
+				names = append(names, entry.Filename)
+				return nil
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(names, ","); got != tt.wantFiles {
+				t.Errorf("files = %s, want %s", got, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestIsGzippedTar(t *testing.T) {
+	var plain bytes.Buffer
+	gzipWriter := gzip.NewWriter(&plain)
+	gzipWriter.Write([]byte(strings.Repeat("not a tar ", 100)))
+	gzipWriter.Close()
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{"tar.gz", buildTarGz(t, []archiveEntry{{"a.txt", "a"}}).Content, true},
+		{"普通gzip", plain.Bytes(), false},
+		{"不是gzip", []byte("plain text"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isGzippedTar(tt.content); got != tt.want {
+				t.Errorf("isGzippedTar() = %v, want %v", got, tt.want)
+			}
+			file := &model.DownloadedFile{Content: tt.content, DetectedMimeType: "application/gzip"}
+			if got := IsArchive(file); got != tt.want {
+				t.Errorf("IsArchive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"dify-upload-workflow/model"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// difyFileIdentity Dify文件对象的 dify_model_identity 字段值
+const difyFileIdentity = "__dify__file__"
+
+// RehostOutputFiles 转存blocking模式工作流响应中 data.outputs 内的Dify文件对象（可嵌套在数组和对象中）
+// 下载文件对象的url（相对地址按Dify域名补全）并保存到存储，将url改写为固定地址并增加artifact_id字段。
+// 直接修改workflowData；已转存的文件对象跳过；单个文件失败时保留原地址并继续处理其余文件，返回合并的错误
+func RehostOutputFiles(workflowData interface{}, difyBaseURL string, store ArtifactStore) ([]model.Artifact, error) {
+	resp, _ := workflowData.(map[string]interface{})
+	data, _ := resp["data"].(map[string]interface{})
+
+	var files []map[string]interface{}
+	collectDifyFiles(data["outputs"], &files)
+
+	var artifacts []model.Artifact
+	var errs []error
+	for _, file := range files {
+		if _, ok := file["artifact_id"]; ok {
+			continue
+		}
+		artifact, err := rehostDifyFile(file, difyBaseURL, store)
+		if err != nil {
+			name, _ := file["filename"].(string)
+			errs = append(errs, fmt.Errorf("转存输出文件 %s 失败: %w", name, err))
+			continue
+		}
+		file["url"] = artifact.URL
+		file["artifact_id"] = artifact.ID
+		artifacts = append(artifacts, *artifact)
+	}
+	return artifacts, errors.Join(errs...)
+}
+
+// HasPendingOutputFiles 判断工作流响应中是否有尚未转存的Dify文件对象
+func HasPendingOutputFiles(workflowData interface{}) bool {
+	resp, _ := workflowData.(map[string]interface{})
+	data, _ := resp["data"].(map[string]interface{})
+
+	var files []map[string]interface{}
+	collectDifyFiles(data["outputs"], &files)
+	for _, file := range files {
+		if _, ok := file["artifact_id"]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectDifyFiles 递归查找Dify文件对象
+func collectDifyFiles(value interface{}, files *[]map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v["dify_model_identity"] == difyFileIdentity {
+			*files = append(*files, v)
+			return
+		}
+		for _, item := range v {
+			collectDifyFiles(item, files)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectDifyFiles(item, files)
+		}
+	}
+}
+
+// rehostDifyFile 下载并保存单个文件对象
+func rehostDifyFile(file map[string]interface{}, difyBaseURL string, store ArtifactStore) (*model.Artifact, error) {
+	fileURL, _ := file["url"].(string)
+	if fileURL == "" {
+		fileURL, _ = file["remote_url"].(string)
+	}
+	if fileURL == "" {
+		return nil, errors.New("文件对象缺少下载地址")
+	}
+	// Dify未配置FILES_URL时返回相对地址
+	if strings.HasPrefix(fileURL, "/") {
+		fileURL = difyBaseURL + fileURL
+	}
+
+	downloaded, err := DownloadFile(model.FileSource{URL: fileURL})
+	if err != nil {
+		return nil, err
+	}
+
+	filename := downloaded.Filename
+	if name, _ := file["filename"].(string); name != "" {
+		filename = SanitizeFilename(name)
+	}
+	mimeType, _ := file["mime_type"].(string)
+	if mimeType == "" {
+		mimeType = downloaded.DetectedMimeType
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	id := NewArtifactID()
+	artifact := &model.Artifact{
+		ID:        id,
+		Filename:  filename,
+		MimeType:  mimeType,
+		Size:      int64(len(downloaded.Content)),
+		URL:       ArtifactURL(id),
+		CreatedAt: time.Now(),
+	}
+	if err = store.Save(artifact, downloaded.Content); err != nil {
+		return nil, fmt.Errorf("保存文件失败: %w", err)
+	}
+	return artifact, nil
+}
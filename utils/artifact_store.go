@@ -0,0 +1,332 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrArtifactNotFound 转存文件不存在
+var ErrArtifactNotFound = errors.New("文件不存在")
+
+// ArtifactStore 工作流输出文件的转存存储
+type ArtifactStore interface {
+	// Save 保存文件内容，artifact中的ID由调用方生成
+	Save(artifact *model.Artifact, content []byte) error
+	// Open 读取文件信息和内容，不存在时返回ErrArtifactNotFound
+	Open(id string) (*model.Artifact, io.ReadCloser, error)
+}
+
+var (
+	artifactStoreMu sync.Mutex
+	artifactStore   ArtifactStore
+	artifactStoreOK bool
+)
+
+// GetArtifactStore 按配置获取转存存储，首次调用时初始化，配置错误时返回nil
+func GetArtifactStore() ArtifactStore {
+	artifactStoreMu.Lock()
+	defer artifactStoreMu.Unlock()
+
+	if artifactStoreOK {
+		return artifactStore
+	}
+	artifactStoreOK = true
+
+	var err error
+	ttl := time.Duration(config.Config.ArtifactTTL) * time.Second
+	switch strings.ToLower(config.Config.ArtifactStore) {
+	case "local":
+		artifactStore, err = NewLocalArtifactStore(config.Config.ArtifactDir, ttl)
+	case "s3":
+		artifactStore, err = NewS3ArtifactStore(config.Config.ArtifactS3Endpoint, config.Config.ArtifactS3Bucket,
+			config.Config.ArtifactS3Prefix, config.Config.ArtifactS3AccessKey, config.Config.ArtifactS3SecretKey, config.Config.ArtifactS3Region, config.Config.ArtifactS3UseSSL, ttl)
+	case "", "none", "off":
+	default:
+		err = fmt.Errorf("未知的转存存储类型 %s", config.Config.ArtifactStore)
+	}
+	if err != nil {
+		log.Printf("初始化输出文件转存存储失败，已禁用文件转存: %v", err)
+		artifactStore = nil
+	}
+	return artifactStore
+}
+
+// SetArtifactStore 替换当前使用的转存存储（用于测试或自定义存储）
+func SetArtifactStore(store ArtifactStore) {
+	artifactStoreMu.Lock()
+	defer artifactStoreMu.Unlock()
+
+	artifactStore = store
+	artifactStoreOK = true
+}
+
+// NewArtifactID 生成转存文件ID
+func NewArtifactID() string {
+	return uuid.New().String()
+}
+
+// IsValidArtifactID 校验转存文件ID格式，避免路径穿越
+func IsValidArtifactID(id string) bool {
+	parsed, err := uuid.Parse(id)
+	return err == nil && parsed.String() == id
+}
+
+// ArtifactURL 转存文件的固定访问地址
+func ArtifactURL(id string) string {
+	return config.Config.ArtifactBaseURL + "/dify/artifacts/" + id
+}
+
+// artifactSweeper 按TTL判断和清理过期的转存文件，ttl为0时不清理
+type artifactSweeper struct {
+	ttl time.Duration
+}
+
+// expired 判断保存于createdAt的文件是否已过期
+func (s artifactSweeper) expired(createdAt time.Time) bool {
+	return s.ttl > 0 && time.Since(createdAt) > s.ttl
+}
+
+// start 在后台定期调用removeExpired清理过期文件，每小时（TTL更短时按TTL）清理一次
+func (s artifactSweeper) start(removeExpired func()) {
+	if s.ttl <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(min(time.Hour, s.ttl))
+		defer ticker.Stop()
+		for range ticker.C {
+			removeExpired()
+		}
+	}()
+}
+
+// LocalArtifactStore 本地目录存储，每个文件保存为 ID 和 ID.json（文件信息）两个文件
+// 设置TTL时，过期的文件不能再读取，并由后台定期清理
+type LocalArtifactStore struct {
+	dir     string
+	sweeper artifactSweeper
+}
+
+// NewLocalArtifactStore 创建本地目录存储，ttl为0时永久保留
+func NewLocalArtifactStore(dir string, ttl time.Duration) (*LocalArtifactStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	store := &LocalArtifactStore{dir: dir, sweeper: artifactSweeper{ttl: ttl}}
+	store.sweeper.start(store.removeExpired)
+	return store, nil
+}
+
+// Save 保存文件，先写文件内容再写文件信息，文件信息存在即表示保存完成
+func (s *LocalArtifactStore) Save(artifact *model.Artifact, content []byte) error {
+	if !IsValidArtifactID(artifact.ID) {
+		return fmt.Errorf("文件ID格式错误: %s", artifact.ID)
+	}
+	meta, err := json.Marshal(artifact)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, artifact.ID)
+	if err = os.WriteFile(path, content, 0o644); err != nil {
+		return err
+	}
+	tmp := path + ".json.tmp"
+	if err = os.WriteFile(tmp, meta, 0o644); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err = os.Rename(tmp, path+".json"); err != nil {
+		os.Remove(tmp)
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// removeExpired 删除过期的文件，按文件信息的修改时间（即保存时间）判断
+func (s *LocalArtifactStore) removeExpired() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("清理过期转存文件失败: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !IsValidArtifactID(id) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !s.sweeper.expired(info.ModTime()) {
+			continue
+		}
+		s.remove(id)
+	}
+}
+
+// remove 删除文件信息和文件内容
+func (s *LocalArtifactStore) remove(id string) {
+	path := filepath.Join(s.dir, id)
+	if err := os.Remove(path + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("删除转存文件失败: %v", err)
+		return
+	}
+	os.Remove(path)
+}
+
+// Open 读取文件
+func (s *LocalArtifactStore) Open(id string) (*model.Artifact, io.ReadCloser, error) {
+	if !IsValidArtifactID(id) {
+		return nil, nil, ErrArtifactNotFound
+	}
+
+	path := filepath.Join(s.dir, id)
+	meta, err := os.ReadFile(path + ".json")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, ErrArtifactNotFound
+		}
+		return nil, nil, err
+	}
+	var artifact model.Artifact
+	if err = json.Unmarshal(meta, &artifact); err != nil {
+		return nil, nil, fmt.Errorf("文件信息格式错误: %w", err)
+	}
+	if s.sweeper.expired(artifact.CreatedAt) {
+		s.remove(id)
+		return nil, nil, ErrArtifactNotFound
+	}
+	artifact.URL = ArtifactURL(id)
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, ErrArtifactNotFound
+		}
+		return nil, nil, err
+	}
+	return &artifact, file, nil
+}
+
+// S3ArtifactStore S3兼容的对象存储（AWS S3、MinIO、OSS等），对象保存为 prefix/ID，文件名保存在对象的用户元数据中
+// 设置TTL时，过期的对象不能再读取，并由后台定期清理（只清理prefix下的对象）；也可以在存储桶上配置生命周期规则
+type S3ArtifactStore struct {
+	client  *minio.Client
+	bucket  string
+	prefix  string
+	sweeper artifactSweeper
+}
+
+// NewS3ArtifactStore 创建S3兼容存储，endpoint为 host:port，prefix为对象键的前缀目录，ttl为0时永久保留
+func NewS3ArtifactStore(endpoint string, bucket string, prefix string, accessKey string, secretKey string, region string, useSSL bool, ttl time.Duration) (*S3ArtifactStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("S3存储需要配置ARTIFACT_S3_ENDPOINT和ARTIFACT_S3_BUCKET")
+	}
+	// 转存文件必须放在独立的前缀下，清理时不会删除存储桶中的其他对象
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return nil, errors.New("S3存储需要配置ARTIFACT_S3_PREFIX")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	store := &S3ArtifactStore{client: client, bucket: bucket, prefix: prefix + "/", sweeper: artifactSweeper{ttl: ttl}}
+	store.sweeper.start(store.removeExpired)
+	return store, nil
+}
+
+// key 转存文件在存储桶中的对象键
+func (s *S3ArtifactStore) key(id string) string {
+	return s.prefix + id
+}
+
+// Save 上传文件到存储桶
+func (s *S3ArtifactStore) Save(artifact *model.Artifact, content []byte) error {
+	if !IsValidArtifactID(artifact.ID) {
+		return fmt.Errorf("文件ID格式错误: %s", artifact.ID)
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(artifact.ID), bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{
+		ContentType: artifact.MimeType,
+		// 用户元数据只能包含ASCII字符，文件名需要编码
+		UserMetadata: map[string]string{"Filename": url.QueryEscape(artifact.Filename)},
+	})
+	return err
+}
+
+// removeExpired 删除前缀目录下过期的转存文件
+func (s *S3ArtifactStore) removeExpired() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if object.Err != nil {
+			log.Printf("清理过期转存文件失败: %v", object.Err)
+			return
+		}
+		id := strings.TrimPrefix(object.Key, s.prefix)
+		if !IsValidArtifactID(id) || !s.sweeper.expired(object.LastModified) {
+			continue
+		}
+		if err := s.client.RemoveObject(ctx, s.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			log.Printf("删除转存文件失败: %v", err)
+		}
+	}
+}
+
+// Open 从存储桶读取文件
+func (s *S3ArtifactStore) Open(id string) (*model.Artifact, io.ReadCloser, error) {
+	if !IsValidArtifactID(id) {
+		return nil, nil, ErrArtifactNotFound
+	}
+
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.key(id), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil, ErrArtifactNotFound
+		}
+		return nil, nil, err
+	}
+	if s.sweeper.expired(info.LastModified) {
+		object.Close()
+		if err = s.client.RemoveObject(context.Background(), s.bucket, s.key(id), minio.RemoveObjectOptions{}); err != nil {
+			log.Printf("删除转存文件失败: %v", err)
+		}
+		return nil, nil, ErrArtifactNotFound
+	}
+
+	filename, _ := url.QueryUnescape(info.UserMetadata["Filename"])
+	return &model.Artifact{
+		ID:        id,
+		Filename:  filename,
+		MimeType:  info.ContentType,
+		Size:      info.Size,
+		URL:       ArtifactURL(id),
+		CreatedAt: info.LastModified,
+	}, object, nil
+}
@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"bytes"
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRehostOutputFiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/files/missing.pdf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	store, err := NewLocalArtifactStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var workflowData interface{}
+	raw := `{"data":{"status":"succeeded","outputs":{
+		"report":{"dify_model_identity":"__dify__file__","filename":"报告.txt","url":"/files/report.txt?sign=abc"},
+		"nested":{"items":[{"dify_model_identity":"__dify__file__","url":"` + server.URL + `/files/b.txt"}]},
+		"missing":{"dify_model_identity":"__dify__file__","filename":"missing.pdf","url":"/files/missing.pdf?sign=abc"},
+		"done":{"dify_model_identity":"__dify__file__","url":"/dify/artifacts/x","artifact_id":"x"},
+		"text":"hello"}}}`
+	if err = json.Unmarshal([]byte(raw), &workflowData); err != nil {
+		t.Fatal(err)
+	}
+
+	artifacts, err := RehostOutputFiles(workflowData, server.URL, store)
+	if err == nil || !strings.Contains(err.Error(), "missing.pdf") || strings.Contains(err.Error(), "abc") {
+		t.Errorf("err = %v, 应包含失败的文件名且不包含签名", err)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("artifacts = %+v", artifacts)
+	}
+
+	outputs := workflowData.(map[string]interface{})["data"].(map[string]interface{})["outputs"].(map[string]interface{})
+	report := outputs["report"].(map[string]interface{})
+	if report["url"] != ArtifactURL(report["artifact_id"].(string)) {
+		t.Errorf("report = %v", report)
+	}
+	if missing := outputs["missing"].(map[string]interface{}); missing["url"] != "/files/missing.pdf?sign=abc" || missing["artifact_id"] != nil {
+		t.Errorf("转存失败的文件应保留原地址: %v", missing)
+	}
+	if !HasPendingOutputFiles(workflowData) {
+		t.Error("转存失败的文件应视为未转存")
+	}
+
+	artifact, reader, err := store.Open(report["artifact_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, _ := io.ReadAll(reader)
+	if string(content) != "content of /files/report.txt" || artifact.Filename != "报告.txt" || artifact.Size != int64(len(content)) {
+		t.Errorf("artifact = %+v, content = %q", artifact, content)
+	}
+}
+
+// TestLocalArtifactStoreTTL 过期的文件不能再读取，并在定期清理时删除
+func TestLocalArtifactStoreTTL(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalArtifactStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save := func(createdAt time.Time) string {
+		t.Helper()
+		id := NewArtifactID()
+		if err := store.Save(&model.Artifact{ID: id, Filename: "a.txt", CreatedAt: createdAt}, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	old := time.Now().Add(-2 * time.Hour)
+
+	// 过期的文件读取时返回不存在
+	expired := save(old)
+	if _, _, err = store.Open(expired); err != ErrArtifactNotFound {
+		t.Errorf("err = %v, want ErrArtifactNotFound", err)
+	}
+
+	// 过期的文件在定期清理时删除
+	stale := save(old)
+	for _, name := range []string{stale, stale + ".json"} {
+		if err = os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fresh := save(time.Now())
+	store.removeExpired()
+	if _, err = os.Stat(filepath.Join(dir, stale)); !os.IsNotExist(err) {
+		t.Errorf("过期文件未清理: %v", err)
+	}
+	if _, reader, err := store.Open(fresh); err != nil {
+		t.Errorf("未过期的文件应可读取: %v", err)
+	} else {
+		reader.Close()
+	}
+}
+
+// fakeS3 按路径 /bucket/key 保存对象的S3接口
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	headers  map[string]http.Header
+	modified map[string]time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}, modified: map[string]time.Time{}}
+}
+
+// s3ListResult ListObjectsV2的响应
+type s3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []s3ListObject
+}
+
+type s3ListObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 列出存储桶中的对象：GET /bucket/?list-type=2&prefix=...
+	if bucket, ok := strings.CutSuffix(r.URL.Path, "/"); ok && r.Method == http.MethodGet && strings.Count(bucket, "/") == 1 {
+		prefix := r.URL.Query().Get("prefix")
+		result := s3ListResult{Name: strings.TrimPrefix(bucket, "/"), Prefix: prefix, MaxKeys: 1000}
+		for path, body := range s.objects {
+			key, ok := strings.CutPrefix(path, bucket+"/")
+			if !ok || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			result.Contents = append(result.Contents, s3ListObject{
+				Key:          key,
+				LastModified: s.modified[path].UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         `"etag"`,
+				Size:         len(body),
+			})
+		}
+		result.KeyCount = len(result.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeAWSChunked(body)
+		}
+		s.objects[r.URL.Path] = body
+		s.headers[r.URL.Path] = r.Header.Clone()
+		s.modified[r.URL.Path] = time.Now()
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		body, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`))
+			}
+			return
+		}
+		header := s.headers[r.URL.Path]
+		w.Header().Set("Content-Type", header.Get("Content-Type"))
+		w.Header().Set("X-Amz-Meta-Filename", header.Get("X-Amz-Meta-Filename"))
+		w.Header().Set("Last-Modified", s.modified[r.URL.Path].UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, "", s.modified[r.URL.Path], bytes.NewReader(body))
+	}
+}
+
+// decodeAWSChunked 解码aws-chunked格式的请求体（每块为 长度;chunk-signature=...\r\n数据\r\n）
+func decodeAWSChunked(body []byte) []byte {
+	var decoded []byte
+	for len(body) > 0 {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			break
+		}
+		sizeHex, _, _ := strings.Cut(string(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size == 0 || int64(len(rest)) < size {
+			break
+		}
+		decoded = append(decoded, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+	return decoded
+}
+
+func TestS3ArtifactStore(t *testing.T) {
+	s3 := newFakeS3()
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	store, err := NewS3ArtifactStore(strings.TrimPrefix(server.URL, "http://"), "artifacts", "/dify-artifacts/", "ak", "sk", "us-east-1", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := NewArtifactID()
+	if err = store.Save(&model.Artifact{ID: id, Filename: "图表 1.png", MimeType: "image/png"}, []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact, reader, err := store.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, _ := io.ReadAll(reader)
+	if string(content) != "png" || artifact.Filename != "图表 1.png" || artifact.MimeType != "image/png" || artifact.Size != 3 {
+		t.Errorf("artifact = %+v, content = %q", artifact, content)
+	}
+
+	if _, ok := s3.objects["/artifacts/dify-artifacts/"+id]; !ok {
+		t.Errorf("对象未保存在前缀目录下: %v", s3.objects)
+	}
+
+	if _, _, err = store.Open(NewArtifactID()); err != ErrArtifactNotFound {
+		t.Errorf("err = %v, want ErrArtifactNotFound", err)
+	}
+
+	if _, err = NewS3ArtifactStore("s3.example.com", "artifacts", "/", "ak", "sk", "", true, 0); err == nil {
+		t.Error("前缀为空时应返回错误")
+	}
+}
+
+// TestS3ArtifactStoreRemoveExpired 定期清理只删除前缀目录下过期的转存文件
+func TestS3ArtifactStoreRemoveExpired(t *testing.T) {
+	s3 := newFakeS3()
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	store, err := NewS3ArtifactStore(strings.TrimPrefix(server.URL, "http://"), "artifacts", "dify-artifacts", "ak", "sk", "us-east-1", false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, fresh, other := NewArtifactID(), NewArtifactID(), NewArtifactID()
+	for _, id := range []string{stale, fresh} {
+		if err = store.Save(&model.Artifact{ID: id, Filename: "a.txt"}, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 前缀外同样以UUID命名的对象不属于本服务，不能删除
+	old := time.Now().Add(-2 * time.Hour)
+	s3.objects["/artifacts/"+other] = []byte("other")
+	s3.modified["/artifacts/"+other] = old
+	s3.modified["/artifacts/dify-artifacts/"+stale] = old
+
+	store.removeExpired()
+
+	if _, ok := s3.objects["/artifacts/dify-artifacts/"+stale]; ok {
+		t.Error("过期文件未清理")
+	}
+	if _, ok := s3.objects["/artifacts/dify-artifacts/"+fresh]; !ok {
+		t.Error("未过期的文件不应删除")
+	}
+	if _, ok := s3.objects["/artifacts/"+other]; !ok {
+		t.Error("前缀外的对象不应删除")
+	}
+}
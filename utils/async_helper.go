@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"dify-upload-workflow/model"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -26,13 +28,18 @@ func GenerateRequestID() string {
 	return uuid.New().String()
 }
 
-// InitAsyncRequest 初始化异步请求并返回响应
-func InitAsyncRequest(asyncReq *model.AsyncRequest) model.AsyncResponse {
+// ErrRequestIDConflict 指定的请求ID已被其他API密钥的请求使用
+var ErrRequestIDConflict = errors.New("请求ID已被其他应用的请求使用")
+
+// InitAsyncRequest 初始化异步请求并返回响应，记录API密钥哈希用于查询时校验
+// 指定的请求ID已存在且属于其他API密钥时返回ErrRequestIDConflict，同一API密钥可以重复使用请求ID
+func InitAsyncRequest(asyncReq *model.AsyncRequest, apiKey string) (model.AsyncResponse, error) {
 	requestID := asyncReq.RequestID
 	if requestID == "" {
 		// 如果没有提供请求ID，则生成一个
 		requestID = GenerateRequestID()
 	}
+	apiKeyHash := HashAPIKey(apiKey)
 
 	// 创建响应
 	response := model.AsyncResponse{
@@ -42,11 +49,16 @@ func InitAsyncRequest(asyncReq *model.AsyncRequest) model.AsyncResponse {
 	}
 
 	// 保存到存储
+	stored := response
+	stored.APIKeyHash = apiKeyHash
 	AsyncRequestStore.Lock()
-	AsyncRequestStore.requests[requestID] = response
-	AsyncRequestStore.Unlock()
+	defer AsyncRequestStore.Unlock()
+	if existing, exists := AsyncRequestStore.requests[requestID]; exists && existing.APIKeyHash != apiKeyHash {
+		return model.AsyncResponse{}, ErrRequestIDConflict
+	}
+	AsyncRequestStore.requests[requestID] = stored
 
-	return response
+	return response, nil
 }
 
 // UpdateAsyncRequestStatus 更新异步请求状态
@@ -61,6 +73,65 @@ func UpdateAsyncRequestStatus(requestID string, status string, message string) {
 	}
 }
 
+// InitStreamRequest 为流式请求创建处理记录，结果可通过异步状态接口查询（需提供同一API密钥）
+// 记录在流式事件记录过期时一起清理（见 NewStreamRecord）
+func InitStreamRequest(requestID string, apiKey string) {
+	AsyncRequestStore.Lock()
+	defer AsyncRequestStore.Unlock()
+
+	AsyncRequestStore.requests[requestID] = model.AsyncResponse{
+		RequestID:  requestID,
+		Status:     "processing",
+		Message:    "流式请求处理中",
+		APIKeyHash: HashAPIKey(apiKey),
+		Streaming:  true,
+	}
+}
+
+// removeStreamRequest 删除流式请求创建的处理记录，同一ID已被异步请求使用时保留
+func removeStreamRequest(requestID string) {
+	AsyncRequestStore.Lock()
+	defer AsyncRequestStore.Unlock()
+
+	if resp, exists := AsyncRequestStore.requests[requestID]; exists && resp.Streaming {
+		delete(AsyncRequestStore.requests, requestID)
+	}
+}
+
+// UpdateAsyncRequestResult 更新请求状态并记录执行结果
+func UpdateAsyncRequestResult(requestID string, status string, message string, result interface{}) {
+	AsyncRequestStore.Lock()
+	defer AsyncRequestStore.Unlock()
+
+	if resp, exists := AsyncRequestStore.requests[requestID]; exists {
+		resp.Status = status
+		resp.Message = message
+		resp.Result = result
+		AsyncRequestStore.requests[requestID] = resp
+	}
+}
+
+// LinkAsyncWorkflowRun 将异步请求关联到Dify工作流执行ID，便于之后直接从Dify查询执行状态
+// 同一请求多次执行工作流时（按Schema重新执行）保留每次的执行ID，查询详情使用最近一次
+// API密钥哈希在创建请求时记录，关联时不会改变
+func LinkAsyncWorkflowRun(requestID string, workflowRunID string, taskID string, domain string) {
+	AsyncRequestStore.Lock()
+	defer AsyncRequestStore.Unlock()
+
+	if resp, exists := AsyncRequestStore.requests[requestID]; exists {
+		resp.WorkflowRunID = workflowRunID
+		if !slices.Contains(resp.WorkflowRunIDs, workflowRunID) {
+			// 追加时复制底层数组，避免修改已返回给调用方的状态
+			resp.WorkflowRunIDs = append(slices.Clip(resp.WorkflowRunIDs), workflowRunID)
+		}
+		if taskID != "" {
+			resp.TaskID = taskID
+		}
+		resp.Domain = domain
+		AsyncRequestStore.requests[requestID] = resp
+	}
+}
+
 // GetAsyncRequestStatus 获取异步请求状态
 func GetAsyncRequestStatus(requestID string) (model.AsyncResponse, bool) {
 	AsyncRequestStore.RLock()
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"mime"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// genericMimeTypes 无法据此判断具体文件类型的通用MIME
+var genericMimeTypes = map[string]bool{
+	"":                           true,
+	"application/octet-stream":   true,
+	"binary/octet-stream":        true,
+	"application/unknown":        true,
+	"application/download":       true,
+	"application/force-download": true,
+}
+
+// DetectFileType 根据文件内容和声明的Content-Type检测文件类型
+// 返回检测结果，其中Filename为补全扩展名后的文件名；opts中的请求级扩展名映射与全局映射一样视为可识别的扩展名
+func DetectFileType(fileContent []byte, filename string, declaredContentType string, opts *model.FileTypeOptions) model.FileTypeDetection {
+	result := model.FileTypeDetection{
+		Filename:         filename,
+		DeclaredMimeType: normalizeMimeType(declaredContentType),
+	}
+
+	// 通过魔数嗅探内容类型
+	detected := mimetype.Detect(fileContent)
+	result.DetectedMimeType = normalizeMimeType(detected.String())
+
+	// 文件名已带有可识别的扩展名时保持不变
+	if ext := strings.TrimPrefix(GetFileExtension(filename), "."); ext != "" {
+		if _, ok := config.LookupFileType(ext); ok {
+			return result
+		}
+		if opts != nil && opts.Mapping[ext] != "" {
+			return result
+		}
+	}
+
+	// 优先使用嗅探出的具体类型，其次使用响应头声明的类型，最后退回到文本类型
+	ext := ""
+	if !isGenericMimeType(result.DetectedMimeType) {
+		ext = detected.Extension()
+	}
+	if ext == "" && !isGenericMimeType(result.DeclaredMimeType) {
+		if declared := mimetype.Lookup(result.DeclaredMimeType); declared != nil {
+			ext = declared.Extension()
+		}
+	}
+	if ext == "" && result.DetectedMimeType == "text/plain" {
+		ext = detected.Extension()
+	}
+
+	if ext != "" && !strings.HasSuffix(strings.ToLower(filename), ext) {
+		result.Filename = filename + ext
+	}
+
+	return result
+}
+
+// normalizeMimeType 去掉MIME中的参数部分（如charset）并转为小写
+func normalizeMimeType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	return mediaType
+}
+
+// isGenericMimeType 判断是否为通用MIME（无法据此推断扩展名）
+func isGenericMimeType(mimeType string) bool {
+	return genericMimeTypes[mimeType] || mimeType == "text/plain"
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"context"
+	"dify-upload-workflow/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestDetectFileTypeRequestMapping 请求级映射中的扩展名视为可识别，不再补全扩展名
+func TestDetectFileTypeRequestMapping(t *testing.T) {
+	mapping := &model.FileTypeOptions{Mapping: map[string]string{"dwg": "document"}}
+
+	tests := []struct {
+		name         string
+		filename     string
+		opts         *model.FileTypeOptions
+		wantFilename string
+	}{
+		{"全局映射中没有的扩展名", "drawing.dwg", nil, "drawing.dwg.txt"},
+		{"请求级映射中的扩展名", "drawing.dwg", mapping, "drawing.dwg"},
+		{"全局映射中的扩展名", "notes.pdf", nil, "notes.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFileType([]byte("plain text"), tt.filename, "", tt.opts); got.Filename != tt.wantFilename {
+				t.Errorf("Filename = %s, want %s", got.Filename, tt.wantFilename)
+			}
+		})
+	}
+
+	// 下载的文件同样使用请求级映射
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("plain text"))
+	}))
+	defer server.Close()
+
+	downloaded, err := DownloadFileWithProgress(context.Background(), model.FileSource{URL: server.URL + "/drawing.dwg"}, mapping, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downloaded.Filename != "drawing.dwg" {
+		t.Errorf("Filename = %s, want drawing.dwg", downloaded.Filename)
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"sort"
+	"strings"
+)
+
+// ParseFileVariable 解析单个文件变量描述
+// 支持 file_url / file_base64 / upload_file_id（单文件）和 file_urls / upload_file_ids（文件列表）；
+// defaultValue在描述中未给出file_value时使用
+func ParseFileVariable(spec map[string]interface{}, defaultValue string) (model.FileVariable, error) {
+	variable := model.FileVariable{FileValue: defaultValue}
+
+	if fileValue, ok := spec["file_value"].(string); ok && fileValue != "" {
+		variable.FileValue = fileValue
+	}
+	if variable.FileValue == "" {
+		return variable, errors.New("文件映射键不能为空")
+	}
+
+	// 可选：强制指定文件类型
+	if fileType, ok := spec["type"].(string); ok {
+		variable.Type = fileType
+	}
+
+	if rawURLs, exists := spec["file_urls"]; exists {
+		fileURLs, ok := rawURLs.([]interface{})
+		if !ok || len(fileURLs) == 0 {
+			return variable, fmt.Errorf("%s: 文件URL列表不能为空", variable.FileValue)
+		}
+		variable.IsList = true
+		for _, rawURL := range fileURLs {
+			source, err := ParseFileSource(rawURL)
+			if err != nil {
+				return variable, fmt.Errorf("%s: 文件URL列表中包含无效URL: %w", variable.FileValue, err)
+			}
+			variable.Sources = append(variable.Sources, source)
+		}
+		return variable, nil
+	}
+
+	if rawIDs, exists := spec["upload_file_ids"]; exists {
+		fileIDs, ok := rawIDs.([]interface{})
+		if !ok || len(fileIDs) == 0 {
+			return variable, fmt.Errorf("%s: 文件ID列表不能为空", variable.FileValue)
+		}
+		variable.IsList = true
+		for _, rawID := range fileIDs {
+			fileID, ok := rawID.(string)
+			if !ok || fileID == "" {
+				return variable, fmt.Errorf("%s: 文件ID列表中包含无效ID", variable.FileValue)
+			}
+			variable.Sources = append(variable.Sources, model.FileSource{UploadFileID: fileID})
+		}
+		return variable, nil
+	}
+
+	source, err := ParseSingleFileSource(spec)
+	if err != nil {
+		return variable, fmt.Errorf("%s: %w", variable.FileValue, err)
+	}
+	variable.Sources = []model.FileSource{source}
+	return variable, nil
+}
+
+// ParseFilesSpec 解析 inputs.files 中的多个文件变量
+// 支持以变量名为键的对象（值为URL字符串、URL列表或文件描述对象），
+// 也支持由 {file_value, file_url|file_urls} 组成的数组
+func ParseFilesSpec(raw interface{}) ([]model.FileVariable, error) {
+	var variables []model.FileVariable
+
+	switch spec := raw.(type) {
+	case map[string]interface{}:
+		// 按变量名排序，保证上传顺序稳定
+		names := make([]string, 0, len(spec))
+		for name := range spec {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			variable, err := parseNamedFileSpec(name, spec[name])
+			if err != nil {
+				return nil, err
+			}
+			variables = append(variables, variable)
+		}
+	case []interface{}:
+		for i, item := range spec {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("files[%d] 格式错误", i)
+			}
+			variable, err := ParseFileVariable(itemMap, "")
+			if err != nil {
+				return nil, fmt.Errorf("files[%d]: %w", i, err)
+			}
+			variables = append(variables, variable)
+		}
+	default:
+		return nil, errors.New("files字段格式错误，应为对象或数组")
+	}
+
+	return variables, nil
+}
+
+// parseNamedFileSpec 解析以变量名为键的文件描述
+func parseNamedFileSpec(name string, raw interface{}) (model.FileVariable, error) {
+	switch value := raw.(type) {
+	case string:
+		// 单个URL或data URI
+		return ParseFileVariable(map[string]interface{}{"file_url": value}, name)
+	case []interface{}:
+		// URL列表
+		return ParseFileVariable(map[string]interface{}{"file_urls": value}, name)
+	case map[string]interface{}:
+		if _, hasURL := value["url"]; hasURL {
+			// 带请求参数的单个文件来源
+			return ParseFileVariable(map[string]interface{}{"file_url": value}, name)
+		}
+		return ParseFileVariable(value, name)
+	default:
+		return model.FileVariable{}, fmt.Errorf("%s: 文件描述格式错误", name)
+	}
+}
+
+// ValidateFileVariables 校验文件变量：变量名不能重复，文件总数不能超过上限
+func ValidateFileVariables(variables []model.FileVariable) error {
+	if len(variables) == 0 {
+		return errors.New("未找到file字段")
+	}
+
+	seen := make(map[string]bool, len(variables))
+	total := 0
+	for _, variable := range variables {
+		if seen[variable.FileValue] {
+			return fmt.Errorf("文件映射键重复: %s", variable.FileValue)
+		}
+		seen[variable.FileValue] = true
+		total += len(variable.Sources)
+	}
+
+	if total > config.Config.MaxUploadFiles {
+		return fmt.Errorf("文件数量超过限制，最多 %d 个", config.Config.MaxUploadFiles)
+	}
+	return nil
+}
+
+// ReadFormFileSource 读取表单上传的文件，转换为文件来源
+func ReadFormFileSource(fileHeader *multipart.FileHeader) (model.FileSource, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return model.FileSource{}, fmt.Errorf("打开文件失败: %w", err)
+	}
+	defer file.Close()
+
+	// 使用io.ReadAll完整读取，避免单次Read读取不完整
+	fileContent, err := io.ReadAll(file)
+	if err != nil {
+		return model.FileSource{}, fmt.Errorf("读取文件内容失败: %w", err)
+	}
+	if fileContent == nil {
+		fileContent = []byte{}
+	}
+
+	return model.FileSource{
+		Content:     fileContent,
+		Filename:    fileHeader.Filename,
+		ContentType: fileHeader.Header.Get("Content-Type"),
+	}, nil
+}
+
+// ParseFormFileVariables 解析表单中以 file[变量名]（单文件）和 files[变量名]（文件列表）命名的文件
+func ParseFormFileVariables(form *multipart.Form) ([]model.FileVariable, error) {
+	if form == nil || form.File == nil {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(form.File))
+	for key := range form.File {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var variables []model.FileVariable
+	for _, key := range keys {
+		name, isList, ok := parseFormFileKey(key)
+		if !ok {
+			continue
+		}
+
+		headers := form.File[key]
+		if !isList && len(headers) > 1 {
+			return nil, fmt.Errorf("%s: 单文件变量只支持上传一个文件", key)
+		}
+
+		variable := model.FileVariable{FileValue: name, IsList: isList}
+		if values := form.Value["type["+name+"]"]; len(values) > 0 {
+			variable.Type = values[0]
+		}
+		for _, fileHeader := range headers {
+			source, err := ReadFormFileSource(fileHeader)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			variable.Sources = append(variable.Sources, source)
+		}
+		variables = append(variables, variable)
+	}
+
+	return variables, nil
+}
+
+// parseFormFileKey 解析 file[name] / files[name] 格式的表单字段名
+func parseFormFileKey(key string) (name string, isList bool, ok bool) {
+	switch {
+	case strings.HasPrefix(key, "file[") && strings.HasSuffix(key, "]"):
+		name = key[len("file[") : len(key)-1]
+	case strings.HasPrefix(key, "files[") && strings.HasSuffix(key, "]"):
+		name = key[len("files[") : len(key)-1]
+		isList = true
+	default:
+		return "", false, false
+	}
+	return name, isList, name != ""
+}
+
+// IsFormFileTypeField 判断是否为 type[变量名] 格式的文件类型字段
+func IsFormFileTypeField(key string) bool {
+	return strings.HasPrefix(key, "type[") && strings.HasSuffix(key, "]")
+}
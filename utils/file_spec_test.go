@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"bytes"
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+// describeVariables 将文件变量描述为便于比较的字符串，如 "docs[]:a.pdf,b.pdf;img(image):c.png"
+func describeVariables(variables []model.FileVariable) string {
+	var parts []string
+	for _, variable := range variables {
+		name := variable.FileValue
+		if variable.IsList {
+			name += "[]"
+		}
+		if variable.Type != "" {
+			name += "(" + variable.Type + ")"
+		}
+		var sources []string
+		for _, source := range variable.Sources {
+			switch {
+			case source.UploadFileID != "":
+				sources = append(sources, "id:"+source.UploadFileID)
+			case source.Content != nil:
+				sources = append(sources, fmt.Sprintf("%s=%s", source.Filename, source.Content))
+			default:
+				sources = append(sources, source.URL)
+			}
+		}
+		parts = append(parts, name+":"+strings.Join(sources, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+func TestParseFilesSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "对象：URL字符串、URL列表和描述对象，按变量名排序",
+			spec: `{"report":"https://x/a.pdf","docs":["https://x/b.pdf","https://x/c.pdf"],
+				"img":{"file_url":"https://x/d.png","type":"image"},"auth":{"url":"https://x/e.pdf","headers":{"Cookie":"s=1"}}}`,
+			want: "auth:https://x/e.pdf;docs[]:https://x/b.pdf,https://x/c.pdf;img(image):https://x/d.png;report:https://x/a.pdf",
+		},
+		{
+			name: "对象：引用已上传文件",
+			spec: `{"docs":{"upload_file_ids":["f1","f2"]},"one":{"upload_file_id":"f3","type":"document"}}`,
+			want: "docs[]:id:f1,id:f2;one(document):id:f3",
+		},
+		{
+			name: "数组",
+			spec: `[{"file_value":"a","file_url":"https://x/a.pdf"},{"file_value":"b","file_urls":["https://x/b.pdf"]}]`,
+			want: "a:https://x/a.pdf;b[]:https://x/b.pdf",
+		},
+		{name: "格式错误", spec: `"https://x/a.pdf"`, wantErr: "files字段格式错误"},
+		{name: "数组元素不是对象", spec: `["https://x/a.pdf"]`, wantErr: "files[0] 格式错误"},
+		{name: "数组元素缺少file_value", spec: `[{"file_url":"https://x/a.pdf"}]`, wantErr: "files[0]: 文件映射键不能为空"},
+		{name: "URL列表为空", spec: `{"docs":[]}`, wantErr: "docs: 文件URL列表不能为空"},
+		{name: "文件ID列表包含无效ID", spec: `{"docs":{"upload_file_ids":["f1",""]}}`, wantErr: "docs: 文件ID列表中包含无效ID"},
+		{name: "描述格式错误", spec: `{"docs":1}`, wantErr: "docs: 文件描述格式错误"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw interface{}
+			if err := json.Unmarshal([]byte(tt.spec), &raw); err != nil {
+				t.Fatal(err)
+			}
+			variables, err := ParseFilesSpec(raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describeVariables(variables); got != tt.want {
+				t.Errorf("variables = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFormFileVariables(t *testing.T) {
+	type formFile struct {
+		key, filename, content string
+	}
+	tests := []struct {
+		name    string
+		files   []formFile
+		fields  map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "单文件和文件列表，按字段名排序",
+			files: []formFile{
+				{"file[report]", "a.pdf", "A"},
+				{"files[docs]", "b.pdf", "B"},
+				{"files[docs]", "c.pdf", "C"},
+				{"file", "main.pdf", "M"}, // 主文件字段由请求构建处理
+			},
+			fields: map[string]string{"type[report]": "document"},
+			want:   "report(document):a.pdf=A;docs[]:b.pdf=B,c.pdf=C",
+		},
+		{
+			name:    "单文件变量上传多个文件",
+			files:   []formFile{{"file[report]", "a.pdf", "A"}, {"file[report]", "b.pdf", "B"}},
+			wantErr: "file[report]: 单文件变量只支持上传一个文件",
+		},
+		{
+			name:  "变量名为空时忽略",
+			files: []formFile{{"file[]", "a.pdf", "A"}, {"files[]", "b.pdf", "B"}},
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			for key, value := range tt.fields {
+				writer.WriteField(key, value)
+			}
+			for _, file := range tt.files {
+				part, _ := writer.CreateFormFile(file.key, file.filename)
+				part.Write([]byte(file.content))
+			}
+			writer.Close()
+			form, err := multipart.NewReader(body, writer.Boundary()).ReadForm(1 << 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer form.RemoveAll()
+
+			variables, err := ParseFormFileVariables(form)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describeVariables(variables); got != tt.want {
+				t.Errorf("variables = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if variables, err := ParseFormFileVariables(nil); err != nil || variables != nil {
+		t.Errorf("ParseFormFileVariables(nil) = %v, %v", variables, err)
+	}
+}
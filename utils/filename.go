@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilenameBytes 文件名最大字节数（常见文件系统限制为255字节）
+const maxFilenameBytes = 255
+
+// invalidFilenameChars 文件系统中不允许的字符: / \ : * ? " < > |
+var invalidFilenameChars = regexp.MustCompile(`[/\\:\*\?"<>|]`)
+
+// percentEncoded 判断字符串是否包含百分号编码
+var percentEncoded = regexp.MustCompile(`%[0-9A-Fa-f]{2}`)
+
+// SanitizeFilename 处理文件名，移除不允许的字符，并按字符边界截断长度
+func SanitizeFilename(filename string) string {
+	// 移除查询参数
+	if idx := strings.Index(filename, "?"); idx > 0 {
+		filename = filename[:idx]
+	}
+
+	// 修复非法UTF-8序列，移除控制字符
+	filename = strings.ToValidUTF8(filename, "_")
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+
+	// 只过滤掉文件系统中绝对不允许的字符
+	filename = invalidFilenameChars.ReplaceAllString(filename, "_")
+	filename = strings.TrimSpace(filename)
+
+	// 确保文件名不为空
+	if filename == "" || filename == "." || filename == ".." {
+		filename = "file_" + time.Now().Format("20060102150405")
+	}
+
+	// 确保文件名长度不超过255字节，截断时保留扩展名且不拆分多字节字符
+	if len(filename) > maxFilenameBytes {
+		ext := filepath.Ext(filename)
+		if len(ext) >= maxFilenameBytes/2 {
+			ext = ""
+		}
+		filename = truncateUTF8(strings.TrimSuffix(filename, ext), maxFilenameBytes-len(ext)) + ext
+	}
+
+	return filename
+}
+
+// truncateUTF8 将字符串截断到不超过maxBytes字节，且不拆分多字节字符
+func truncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	// 从maxBytes处向前找到字符起始位置，保证截断点落在字符边界上
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// getFilenameFromURL 从URL路径的最后一段获取文件名，并进行URL解码
+func getFilenameFromURL(rawURL string) string {
+	urlPath := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		urlPath = parsed.EscapedPath()
+	} else if idx := strings.IndexAny(rawURL, "?#"); idx > 0 {
+		// 移除查询参数
+		urlPath = rawURL[:idx]
+	}
+
+	segment := path.Base(urlPath)
+	if segment == "/" || segment == "." {
+		return ""
+	}
+
+	if decoded, err := url.PathUnescape(segment); err == nil {
+		segment = decoded
+	}
+	return segment
+}
+
+// getFilenameFromHeader 按 RFC 6266 / RFC 5987 从Content-Disposition头获取文件名
+// filename* 优先于 filename；无法按标准解析时退回到宽松解析
+func getFilenameFromHeader(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	// mime包已处理 filename* 的RFC 5987解码（仅支持UTF-8字符集）
+	if _, params, err := mime.ParseMediaType(header); err == nil && params["filename"] != "" {
+		return decodePercentFilename(params["filename"])
+	}
+
+	params := parseDispositionParams(header)
+	if encoded, ok := params["filename*"]; ok {
+		if filename := decodeExtValue(encoded); filename != "" {
+			return filename
+		}
+	}
+	return decodePercentFilename(params["filename"])
+}
+
+// parseDispositionParams 宽松解析Content-Disposition参数，支持引号内的分号和转义
+func parseDispositionParams(header string) map[string]string {
+	params := make(map[string]string)
+
+	// 跳过disposition类型
+	idx := strings.Index(header, ";")
+	if idx < 0 {
+		return params
+	}
+	rest := header[idx+1:]
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " \t;")
+		if rest == "" {
+			break
+		}
+
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// 引号字符串，处理反斜杠转义
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest); i++ {
+				ch := rest[i]
+				if ch == '\\' && i+1 < len(rest) {
+					i++
+					b.WriteByte(rest[i])
+					continue
+				}
+				if ch == '"' {
+					break
+				}
+				b.WriteByte(ch)
+			}
+			value = b.String()
+			if i < len(rest) {
+				rest = rest[i+1:]
+			} else {
+				rest = ""
+			}
+			if semi := strings.Index(rest, ";"); semi >= 0 {
+				rest = rest[semi+1:]
+			} else {
+				rest = ""
+			}
+		} else {
+			if semi := strings.Index(rest, ";"); semi >= 0 {
+				value = rest[:semi]
+				rest = rest[semi+1:]
+			} else {
+				value = rest
+				rest = ""
+			}
+			value = strings.Trim(strings.TrimSpace(value), `'`)
+		}
+
+		if _, exists := params[key]; !exists && key != "" {
+			params[key] = value
+		}
+	}
+
+	return params
+}
+
+// decodeExtValue 解码RFC 5987扩展参数值，格式为 charset'language'percent-encoded
+func decodeExtValue(value string) string {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	charset := strings.ToLower(parts[0])
+
+	decoded, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return ""
+	}
+
+	switch charset {
+	case "utf-8", "":
+		if !utf8.ValidString(decoded) {
+			return ""
+		}
+		return decoded
+	case "iso-8859-1", "latin1":
+		// ISO-8859-1每个字节对应同值的Unicode码点
+		runes := make([]rune, 0, len(decoded))
+		for i := 0; i < len(decoded); i++ {
+			runes = append(runes, rune(decoded[i]))
+		}
+		return string(runes)
+	default:
+		return ""
+	}
+}
+
+// decodePercentFilename 部分服务端会在filename中直接使用百分号编码，解码后为合法UTF-8时采用解码结果
+func decodePercentFilename(filename string) string {
+	if !percentEncoded.MatchString(filename) {
+		return filename
+	}
+	if decoded, err := url.PathUnescape(filename); err == nil && utf8.ValidString(decoded) {
+		return decoded
+	}
+	return filename
+}
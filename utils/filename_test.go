@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestGetFilenameFromHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"空头", "", ""},
+		{"无文件名", "inline", ""},
+		{"普通文件名", `attachment; filename=report.pdf`, "report.pdf"},
+		{"带引号", `attachment; filename="report.pdf"`, "report.pdf"},
+		{"后续参数", `attachment; filename="report.pdf"; size=1024`, "report.pdf"},
+		{"引号内分号", `attachment; filename="a;b.pdf"; size=3`, "a;b.pdf"},
+		{"RFC5987编码", `attachment; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`, "报告.pdf"},
+		{"filename*优先", `attachment; filename="fallback.pdf"; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`, "报告.pdf"},
+		{"filename*在前", `attachment; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf; filename="fallback.pdf"`, "报告.pdf"},
+		{"带语言标记", `attachment; filename*=utf-8'zh-CN'%E6%8A%A5%E5%91%8A.docx`, "报告.docx"},
+		{"ISO-8859-1编码", `attachment; filename*=ISO-8859-1''caf%E9.txt`, "café.txt"},
+		{"未加引号的中文", `attachment; filename=报告.pdf`, "报告.pdf"},
+		{"带引号的中文", `attachment; filename="报告.pdf"`, "报告.pdf"},
+		{"未加引号含空格", `inline;filename=a b.pdf`, "a b.pdf"},
+		{"filename中的百分号编码", `attachment; filename="%E6%8A%A5%E5%91%8A.pdf"`, "报告.pdf"},
+		{"宽松解析单引号", `attachment; filename='报告 v2.pdf'; size=1`, "报告 v2.pdf"},
+		{"转义引号", `attachment; filename="a\"b.pdf"`, `a"b.pdf`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getFilenameFromHeader(tt.header); got != tt.want {
+				t.Errorf("getFilenameFromHeader(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFilenameFromURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"普通路径", "https://example.com/files/report.pdf", "report.pdf"},
+		{"查询参数", "https://example.com/files/report.pdf?token=abc", "report.pdf"},
+		{"片段", "https://example.com/files/report.pdf#page=2", "report.pdf"},
+		{"百分号编码中文", "https://example.com/files/%E6%8A%A5%E5%91%8A.pdf", "报告.pdf"},
+		{"编码空格", "https://example.com/files/my%20report.pdf", "my report.pdf"},
+		{"编码斜杠", "https://example.com/files/a%2Fb.pdf", "a/b.pdf"},
+		{"无扩展名", "https://example.com/download?id=123", "download"},
+		{"根路径", "https://example.com/", ""},
+		{"无路径", "https://example.com", ""},
+		{"预签名S3", "https://bucket.s3.amazonaws.com/abc123?X-Amz-Signature=xyz", "abc123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getFilenameFromURL(tt.url); got != tt.want {
+				t.Errorf("getFilenameFromURL(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"普通文件名", "report.pdf", "report.pdf"},
+		{"中文文件名", "报告.pdf", "报告.pdf"},
+		{"非法字符", `a/b\c:d*e|f<g>"h.pdf`, "a_b_c_d_e_f_g__h.pdf"},
+		{"查询参数", "report.pdf?x=1", "report.pdf"},
+		{"控制字符", "re\x00po\nrt.pdf", "report.pdf"},
+		{"首尾空白", "  report.pdf  ", "report.pdf"},
+		{"非法UTF-8", "re\xffport.pdf", "re_port.pdf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFilename(tt.filename); got != tt.want {
+				t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameEmpty(t *testing.T) {
+	for _, filename := range []string{"", ".", "..", "   ", "\x00"} {
+		got := SanitizeFilename(filename)
+		if !strings.HasPrefix(got, "file_") {
+			t.Errorf("SanitizeFilename(%q) = %q, want generated name", filename, got)
+		}
+	}
+}
+
+func TestSanitizeFilenameTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		wantExt  string
+	}{
+		{"ASCII超长", strings.Repeat("a", 300) + ".pdf", ".pdf"},
+		{"中文超长", strings.Repeat("报告", 100) + ".docx", ".docx"},
+		{"中文超长奇数边界", "a" + strings.Repeat("报", 100) + ".pdf", ".pdf"},
+		{"emoji超长", strings.Repeat("😀", 80) + ".txt", ".txt"},
+		{"超长扩展名", "a." + strings.Repeat("中", 200), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SanitizeFilename(tt.filename)
+			if len(got) > maxFilenameBytes {
+				t.Errorf("长度 %d 超过 %d 字节", len(got), maxFilenameBytes)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("截断后不是合法UTF-8: %q", got)
+			}
+			if tt.wantExt != "" && !strings.HasSuffix(got, tt.wantExt) {
+				t.Errorf("截断后丢失扩展名 %s: %q", tt.wantExt, got)
+			}
+		})
+	}
+}
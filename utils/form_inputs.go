@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"strconv"
+	"strings"
+)
+
+// BuildFormInputs 将表单中的非文件字段转换为工作流inputs
+// 字段名可带类型后缀：name:number、name:bool、name:json、name:string、name:array，或 name[] 表示数组；
+// 同名字段重复出现时作为数组传递；JSON格式的 inputs 字段会合并进来并覆盖同名字段。
+// 同时返回已显式指定类型的变量名（带类型后缀或来自inputs字段），这些变量不再按应用参数转换
+func BuildFormInputs(form *multipart.Form) (map[string]interface{}, []string, error) {
+	inputs := make(map[string]interface{})
+	var typed []string
+	if form == nil {
+		return inputs, typed, nil
+	}
+
+	for key, values := range form.Value {
+		if IsReservedFormField(key) || len(values) == 0 {
+			continue
+		}
+
+		name, kind := splitTypedFormKey(key)
+		if name == "" {
+			continue
+		}
+
+		value, err := coerceFormValues(values, kind)
+		if err != nil {
+			return nil, nil, fmt.Errorf("字段 %s %w", name, err)
+		}
+		inputs[name] = value
+		if kind != "" {
+			typed = append(typed, name)
+		}
+	}
+
+	// JSON格式的inputs字段
+	if values := form.Value["inputs"]; len(values) > 0 && strings.TrimSpace(values[0]) != "" {
+		var jsonInputs map[string]interface{}
+		if err := json.Unmarshal([]byte(values[0]), &jsonInputs); err != nil {
+			return nil, nil, fmt.Errorf("inputs字段不是有效的JSON对象: %w", err)
+		}
+		for key, value := range jsonInputs {
+			inputs[key] = value
+			typed = append(typed, key)
+		}
+	}
+
+	return inputs, typed, nil
+}
+
+// splitTypedFormKey 拆分字段名和类型后缀
+func splitTypedFormKey(key string) (name string, kind string) {
+	if strings.HasSuffix(key, "[]") {
+		return strings.TrimSuffix(key, "[]"), "array"
+	}
+	if idx := strings.LastIndex(key, ":"); idx > 0 {
+		switch suffix := strings.ToLower(key[idx+1:]); suffix {
+		case "number", "int", "float", "bool", "boolean", "json", "object", "string", "array":
+			return key[:idx], suffix
+		}
+	}
+	return key, ""
+}
+
+// coerceFormValues 按类型转换表单值，多个值时返回数组
+func coerceFormValues(values []string, kind string) (interface{}, error) {
+	// 数组类型：单个JSON数组值直接解析
+	if kind == "array" {
+		if len(values) == 1 && strings.HasPrefix(strings.TrimSpace(values[0]), "[") {
+			var items []interface{}
+			if err := json.Unmarshal([]byte(values[0]), &items); err != nil {
+				return nil, fmt.Errorf("不是有效的JSON数组: %w", err)
+			}
+			return items, nil
+		}
+		items := make([]interface{}, len(values))
+		for i, value := range values {
+			items[i] = value
+		}
+		return items, nil
+	}
+
+	converted := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		item, err := coerceFormValue(value, kind)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, item)
+	}
+	if len(converted) == 1 {
+		return converted[0], nil
+	}
+	return converted, nil
+}
+
+// coerceFormValue 按类型转换单个表单值
+func coerceFormValue(value string, kind string) (interface{}, error) {
+	switch kind {
+	case "number", "int", "float":
+		number, ok := parseNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("不是有效的数字: %s", value)
+		}
+		return number, nil
+	case "bool", "boolean":
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("不是有效的布尔值: %s", value)
+		}
+		return b, nil
+	case "json", "object":
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return nil, fmt.Errorf("不是有效的JSON: %w", err)
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+// HasUntypedStringInputs 判断inputs中是否有未显式指定类型的字符串值，即是否需要按应用参数转换
+func HasUntypedStringInputs(inputs map[string]interface{}, typed []string) bool {
+	for key, value := range inputs {
+		if _, ok := value.(string); ok && !containsString(typed, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNumber 解析数字，整数保持为整数
+func parseNumber(value string) (interface{}, bool) {
+	value = strings.TrimSpace(value)
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+// CoerceInputsBySchema 按应用参数（/v1/parameters）中的输入类型转换inputs中的字符串值
+// number转为数字，checkbox转为布尔值，json_object解析为JSON；无法转换时保持原值交由Dify校验。
+// skip中的变量（客户端已显式指定类型）保持不变
+func CoerceInputsBySchema(inputs map[string]interface{}, params *model.DifyAppParameters, skip []string) {
+	if params == nil {
+		return
+	}
+
+	for key, value := range inputs {
+		str, ok := value.(string)
+		if !ok || containsString(skip, key) {
+			continue
+		}
+
+		kind, _ := params.FindInput(key)
+		switch kind {
+		case "number":
+			if number, ok := parseNumber(str); ok {
+				inputs[key] = number
+			}
+		case "checkbox":
+			if b, err := strconv.ParseBool(strings.TrimSpace(str)); err == nil {
+				inputs[key] = b
+			}
+		case "json_object":
+			var v interface{}
+			if err := json.Unmarshal([]byte(str), &v); err == nil {
+				inputs[key] = v
+			}
+		}
+	}
+}
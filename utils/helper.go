@@ -1,124 +1,242 @@
 package utils
 
 import (
+	"context"
+	"crypto/sha256"
+	"dify-upload-workflow/config"
 	"dify-upload-workflow/model"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 )
 
 // GetFileType 根据文件扩展名获取类型
 func GetFileType(fileExt string) string {
+	return ResolveFileType(fileExt, nil)
+}
+
+// ResolveFileType 根据扩展名和请求级选项解析Dify文件类型
+// 优先级：强制指定的type > 请求级映射 > 全局配置映射 > custom
+func ResolveFileType(fileExt string, opts *model.FileTypeOptions) string {
+	if opts != nil && opts.Type != "" {
+		return opts.Type
+	}
+
 	ext := strings.TrimPrefix(strings.ToLower(fileExt), ".")
-	if fileType, ok := model.FileTypeMapping[ext]; ok {
-		return fileType
+	fileType := "custom" // 默认为自定义类型
+	if opts != nil && opts.Mapping[ext] != "" {
+		fileType = opts.Mapping[ext]
+	} else if configured, ok := config.LookupFileType(ext); ok {
+		fileType = configured
+	}
+
+	// 目标应用不接受该类型时，尝试退回到custom类型
+	if opts != nil && len(opts.AllowedTypes) > 0 && !containsString(opts.AllowedTypes, fileType) {
+		if containsString(opts.AllowedTypes, "custom") {
+			fileType = "custom"
+		}
+	}
+
+	return fileType
+}
+
+// CheckFileType 检查文件能否传给目标应用的文件变量，只在获取了应用允许的文件类型（refresh_file_types）时检查
+// 解析出的类型不被应用接受，或解析为custom但扩展名不在应用允许的自定义扩展名中时返回错误，避免Dify拒绝执行
+func CheckFileType(fileExt string, opts *model.FileTypeOptions) error {
+	if opts == nil || len(opts.AllowedTypes) == 0 {
+		return nil
+	}
+
+	ext := strings.TrimPrefix(strings.ToLower(fileExt), ".")
+	fileType := ResolveFileType(fileExt, opts)
+	if !containsString(opts.AllowedTypes, fileType) {
+		return fmt.Errorf("目标应用不接受 %s 类型的文件（扩展名 %s），允许的类型: %s", fileType, ext, strings.Join(opts.AllowedTypes, ", "))
+	}
+	if fileType != "custom" || len(opts.AllowedExtensions) == 0 {
+		return nil
+	}
+	for _, allowed := range opts.AllowedExtensions {
+		if strings.TrimPrefix(strings.ToLower(allowed), ".") == ext {
+			return nil
+		}
+	}
+	return fmt.Errorf("目标应用不接受扩展名为 %s 的文件，允许的自定义扩展名: %s", ext, strings.Join(opts.AllowedExtensions, ", "))
+}
+
+// BuildFileMapping 根据Dify上传结果构建工作流文件变量映射
+func BuildFileMapping(fileResp *model.DifyFileUploadResponse, opts *model.FileTypeOptions) map[string]interface{} {
+	return map[string]interface{}{
+		"transfer_method": "local_file",
+		"upload_file_id":  fileResp.ID,
+		"type":            ResolveFileType(fileResp.Extension, opts),
 	}
-	return "custom" // 默认为自定义类型
 }
 
-// SanitizeFilename 处理文件名，移除不允许的字符
-func SanitizeFilename(filename string) string {
-	// 移除查询参数
-	if idx := strings.Index(filename, "?"); idx > 0 {
-		filename = filename[:idx]
+// containsString 判断字符串切片中是否包含指定值
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
 	}
+	return false
+}
+
+// defaultDownloadTimeout 默认下载超时（秒）
+const defaultDownloadTimeout = 60
 
-	// 只过滤掉文件系统中绝对不允许的字符: / \ : * ? " < > |
-	re := regexp.MustCompile(`[/\\:\*\?"<>|]`)
-	filename = re.ReplaceAllString(filename, "_")
+// maxDownloadTimeout 允许请求指定的最大下载超时（秒）
+const maxDownloadTimeout = 600
 
-	// 确保文件名不为空
-	if filename == "" || filename == "." {
-		filename = "file_" + time.Now().Format("20060102150405")
+// ParseFileSource 将JSON解析出的值（URL字符串、data URI或对象）转换为文件来源
+func ParseFileSource(raw interface{}) (model.FileSource, error) {
+	var source model.FileSource
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return source, err
+	}
+	if err = json.Unmarshal(data, &source); err != nil {
+		return source, errors.New("文件来源格式错误，应为URL字符串或包含url/file_base64/upload_file_id的对象")
 	}
+	if strings.TrimSpace(source.URL) == "" && source.Base64 == "" && source.UploadFileID == "" {
+		return source, errors.New("文件URL不能为空")
+	}
+	return source, nil
+}
 
-	// 确保文件名长度不超过255个字符
-	if len(filename) > 255 {
-		ext := filepath.Ext(filename)
-		filename = filename[:255-len(ext)] + ext
+// ParseSingleFileSource 从单文件输入（inputs.file）中解析文件来源
+// 支持 file_url（URL字符串、data URI或对象）、file_base64 + filename，以及已上传的 upload_file_id
+func ParseSingleFileSource(fileInputMap map[string]interface{}) (model.FileSource, error) {
+	if fileID, ok := fileInputMap["upload_file_id"].(string); ok && fileID != "" {
+		return model.FileSource{UploadFileID: fileID}, nil
 	}
+	if encoded, ok := fileInputMap["file_base64"].(string); ok && encoded != "" {
+		filename, _ := fileInputMap["filename"].(string)
+		return model.FileSource{Base64: encoded, Filename: filename}, nil
+	}
+	return ParseFileSource(fileInputMap["file_url"])
+}
 
-	return filename
+// DownloadFile 按文件来源下载文件，并根据内容检测文件类型
+// 返回的错误已对URL、请求头和认证信息脱敏
+func DownloadFile(source model.FileSource) (*model.DownloadedFile, error) {
+	return DownloadFileWithProgress(context.Background(), source, nil, nil)
 }
 
-// DownloadFile 从URL下载文件
-func DownloadFile(url string) ([]byte, string, error) {
+// DownloadFileWithProgress 下载文件并回调下载进度，ctx取消时中止下载，typeOpts为补全扩展名时使用的请求级文件类型选项（可为nil）
+func DownloadFileWithProgress(ctx context.Context, source model.FileSource, typeOpts *model.FileTypeOptions, onProgress ProgressFunc) (*model.DownloadedFile, error) {
+	downloaded, err := downloadFile(ctx, source, typeOpts, onProgress)
+	if err != nil {
+		err = RedactError(err, sourceSecrets(source)...)
+		log.Printf("下载文件失败: %s, 请求头: %v, 错误: %v", RedactURL(source.URL), RedactHeaders(source.Headers), err)
+		return nil, err
+	}
+	return downloaded, nil
+}
+
+// downloadFile 执行下载
+func downloadFile(ctx context.Context, source model.FileSource, typeOpts *model.FileTypeOptions, onProgress ProgressFunc) (*model.DownloadedFile, error) {
 	// 设置超时时间
+	timeout := defaultDownloadTimeout
+	if source.Timeout > 0 {
+		timeout = source.Timeout
+		if timeout > maxDownloadTimeout {
+			timeout = maxDownloadTimeout
+		}
+	}
 	client := &http.Client{
-		Timeout: 60 * time.Second,
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+
+	// 请求方法，仅允许GET和POST
+	method := strings.ToUpper(source.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodPost {
+		return nil, errors.New("不支持的下载请求方法: " + method)
 	}
 
-	// 发起GET请求
-	resp, err := client.Get(url)
+	// 创建请求
+	req, err := http.NewRequestWithContext(ctx, method, source.URL, nil)
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+	for key, value := range source.Headers {
+		req.Header.Set(key, value)
+	}
+	if source.BasicAuth != nil {
+		req.SetBasicAuth(source.BasicAuth.Username, source.BasicAuth.Password)
+	}
+
+	// 发起请求
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// 检查状态码
 	if resp.StatusCode != http.StatusOK {
-		return nil, "", errors.New("下载文件失败，HTTP状态码: " + resp.Status)
+		return nil, errors.New("下载文件失败，HTTP状态码: " + resp.Status)
 	}
 
-	// 获取文件名
-	filename := getFilenameFromURL(url)
-	if filename == "" {
-		// 尝试从Content-Disposition获取
-		filename = getFilenameFromHeader(resp.Header.Get("Content-Disposition"))
-		if filename == "" {
-			// 生成随机文件名
-			filename = "download_" + time.Now().Format("20060102150405")
+	// 获取文件名，URL中没有扩展名时优先使用Content-Disposition中的文件名
+	filename := getFilenameFromURL(source.URL)
+	if filename == "" || filepath.Ext(filename) == "" {
+		if headerFilename := getFilenameFromHeader(resp.Header.Get("Content-Disposition")); headerFilename != "" {
+			filename = headerFilename
 		}
 	}
+	if filename == "" {
+		// 生成随机文件名
+		filename = "download_" + time.Now().Format("20060102150405")
+	}
 
 	// 规范化文件名
 	filename = SanitizeFilename(filename)
 
 	// 读取文件内容
-	fileContent, err := io.ReadAll(resp.Body)
+	fileContent, err := io.ReadAll(NewProgressReader(resp.Body, resp.ContentLength, onProgress))
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	return fileContent, filename, nil
-}
-
-// getFilenameFromURL 从URL获取文件名
-func getFilenameFromURL(url string) string {
-	// 移除查询参数
-	if idx := strings.Index(url, "?"); idx > 0 {
-		url = url[:idx]
-	}
+	// 根据内容和Content-Type检测类型，必要时补全扩展名
+	detection := DetectFileType(fileContent, filename, resp.Header.Get("Content-Type"), typeOpts)
 
-	parts := strings.Split(url, "/")
-	if len(parts) > 0 {
-		return parts[len(parts)-1]
-	}
-	return ""
+	return &model.DownloadedFile{
+		Content:          fileContent,
+		Filename:         detection.Filename,
+		DeclaredMimeType: detection.DeclaredMimeType,
+		DetectedMimeType: detection.DetectedMimeType,
+	}, nil
 }
 
-// getFilenameFromHeader 从Content-Disposition头获取文件名
-func getFilenameFromHeader(header string) string {
-	if header == "" {
-		return ""
-	}
-
-	// 检查Content-Disposition头中的filename参数
-	if strings.Contains(header, "filename=") {
-		parts := strings.Split(header, "filename=")
-		if len(parts) > 1 {
-			filename := parts[1]
-			// 处理引号
-			filename = strings.Trim(filename, "\"'")
-			return filename
+// sourceSecrets 收集文件来源中需要从错误信息中隐藏的敏感值
+func sourceSecrets(source model.FileSource) []string {
+	var secrets []string
+	for key, value := range source.Headers {
+		if isSensitiveHeader(key) {
+			secrets = append(secrets, value)
+			// 同时隐藏Bearer等前缀后的令牌本身
+			if idx := strings.LastIndex(value, " "); idx >= 0 {
+				secrets = append(secrets, value[idx+1:])
+			}
 		}
 	}
-	return ""
+	if source.BasicAuth != nil {
+		secrets = append(secrets, source.BasicAuth.Password)
+	}
+	return secrets
 }
 
 // GetFileExtension 获取文件扩展名
@@ -132,6 +250,36 @@ func GetFileReader(fileContent []byte) io.Reader {
 	return strings.NewReader(string(fileContent))
 }
 
+// reservedFormFields 表单中的控制参数，不作为工作流inputs传递
+var reservedFormFields = map[string]bool{
+	"domain":             true,
+	"user":               true,
+	"response_mode":      true,
+	"file_value":         true,
+	"callback_url":       true,
+	"request_id":         true,
+	"file_type":          true,
+	"file_type_mapping":  true,
+	"refresh_file_types": true,
+	"expand_archives":    true,
+	"archive_include":    true,
+	"archive_types":      true,
+	"cache":              true,
+	"file_urls":          true,
+	"file_urls_value":    true,
+	"coerce_inputs":      true,
+	"inputs":             true,
+	"stream_resume":      true,
+	"output":             true,
+	"output_schema":      true,
+	"rehost_files":       true,
+}
+
+// IsReservedFormField 判断表单字段是否为控制参数
+func IsReservedFormField(key string) bool {
+	return reservedFormFields[key] || IsFormFileTypeField(key)
+}
+
 // GetFormFile 从表单获取文件
 func GetFormFile(form *multipart.Form, key string) ([]*multipart.FileHeader, error) {
 	if form.File == nil {
@@ -146,6 +294,12 @@ func GetFormFile(form *multipart.Form, key string) ([]*multipart.FileHeader, err
 	return files, nil
 }
 
+// HashAPIKey 计算API密钥的SHA-256摘要，用于缓存键和日志，避免明文密钥外泄
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
 // BuildAPIResponse 构建统一API响应
 func BuildAPIResponse(code int, message string, data interface{}) model.ApiResponse {
 	return model.ApiResponse{
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"dify-upload-workflow/model"
+	"strings"
+	"testing"
+)
+
+func TestCheckFileType(t *testing.T) {
+	tests := []struct {
+		name    string
+		ext     string
+		opts    *model.FileTypeOptions
+		wantErr string
+	}{
+		{"未获取应用参数", ".dwg", nil, ""},
+		{"类型被允许", ".pdf", &model.FileTypeOptions{AllowedTypes: []string{"document"}}, ""},
+		{
+			name:    "类型不被允许且不接受custom",
+			ext:     ".png",
+			opts:    &model.FileTypeOptions{AllowedTypes: []string{"document"}},
+			wantErr: "目标应用不接受 image 类型的文件",
+		},
+		{
+			name: "custom扩展名被允许",
+			ext:  ".DWG",
+			opts: &model.FileTypeOptions{AllowedTypes: []string{"custom"}, AllowedExtensions: []string{".dwg"}},
+		},
+		{
+			name:    "custom扩展名不被允许",
+			ext:     ".exe",
+			opts:    &model.FileTypeOptions{AllowedTypes: []string{"document", "custom"}, AllowedExtensions: []string{".dwg"}},
+			wantErr: "目标应用不接受扩展名为 exe 的文件",
+		},
+		{
+			name: "退回custom且未限制扩展名",
+			ext:  ".png",
+			opts: &model.FileTypeOptions{AllowedTypes: []string{"document", "custom"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckFileType(tt.ext, tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("err = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"context"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LoadFileSource 获取文件内容：内联文件直接解码，否则从URL下载
+func LoadFileSource(source model.FileSource) (*model.DownloadedFile, error) {
+	return LoadFileSourceWithProgress(context.Background(), source, nil, nil)
+}
+
+// LoadFileSourceWithProgress 获取文件内容，从URL下载时回调下载进度，ctx取消时中止下载
+// typeOpts为检测类型、补全扩展名时使用的请求级文件类型选项（可为nil）
+func LoadFileSourceWithProgress(ctx context.Context, source model.FileSource, typeOpts *model.FileTypeOptions, onProgress ProgressFunc) (*model.DownloadedFile, error) {
+	if source.IsInline() {
+		return DecodeInlineFile(source, typeOpts)
+	}
+	return DownloadFileWithProgress(ctx, source, typeOpts, onProgress)
+}
+
+// DescribeFileSource 返回用于日志和错误信息的文件来源描述（已脱敏）
+func DescribeFileSource(source model.FileSource) string {
+	if source.IsInline() {
+		if source.Filename != "" {
+			return "inline:" + source.Filename
+		}
+		return "inline"
+	}
+	return RedactURL(source.URL)
+}
+
+// DecodeInlineFile 解码内联文件，支持已读取的内容、纯base64和data URI
+// base64和data URI解码后大小受 MaxInlineFileSize 限制
+func DecodeInlineFile(source model.FileSource, typeOpts *model.FileTypeOptions) (*model.DownloadedFile, error) {
+	if source.Content != nil {
+		return buildLocalFile(source.Content, source.Filename, source.ContentType, typeOpts), nil
+	}
+
+	data := source.Base64
+	if data == "" {
+		data = source.URL
+	}
+
+	declaredType := ""
+	isBase64 := true
+	if strings.HasPrefix(strings.ToLower(data), "data:") {
+		// data:[<mediatype>][;base64],<data>
+		comma := strings.Index(data, ",")
+		if comma < 0 {
+			return nil, errors.New("data URI格式错误: 缺少逗号分隔符")
+		}
+		meta := data[len("data:"):comma]
+		data = data[comma+1:]
+
+		isBase64 = false
+		if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+			isBase64 = true
+			meta = meta[:len(meta)-len(";base64")]
+		}
+		declaredType = meta
+	}
+
+	// 解码前按编码长度预估大小，避免超大内容占用内存
+	maxSize := config.Config.MaxInlineFileSize
+	if isBase64 && int64(base64.StdEncoding.DecodedLen(len(data))) > maxSize+3 {
+		return nil, fmt.Errorf("内联文件超过大小限制 %d 字节", maxSize)
+	}
+
+	var fileContent []byte
+	var err error
+	if isBase64 {
+		fileContent, err = decodeBase64(data)
+		if err != nil {
+			return nil, fmt.Errorf("base64解码失败: %w", err)
+		}
+	} else {
+		decoded, err := url.PathUnescape(data)
+		if err != nil {
+			return nil, fmt.Errorf("data URI解码失败: %w", err)
+		}
+		fileContent = []byte(decoded)
+	}
+
+	if int64(len(fileContent)) > maxSize {
+		return nil, fmt.Errorf("内联文件超过大小限制 %d 字节", maxSize)
+	}
+	if len(fileContent) == 0 {
+		return nil, errors.New("内联文件内容为空")
+	}
+
+	return buildLocalFile(fileContent, source.Filename, declaredType, typeOpts), nil
+}
+
+// buildLocalFile 规范化文件名并检测类型，必要时补全扩展名
+func buildLocalFile(fileContent []byte, filename string, declaredType string, typeOpts *model.FileTypeOptions) *model.DownloadedFile {
+	if filename == "" {
+		filename = "inline_" + time.Now().Format("20060102150405")
+	}
+	filename = SanitizeFilename(filename)
+
+	detection := DetectFileType(fileContent, filename, declaredType, typeOpts)
+
+	return &model.DownloadedFile{
+		Content:          fileContent,
+		Filename:         detection.Filename,
+		DeclaredMimeType: detection.DeclaredMimeType,
+		DetectedMimeType: detection.DetectedMimeType,
+	}
+}
+
+// decodeBase64 兼容标准、URL安全及无填充的base64编码，并忽略换行等空白字符
+func decodeBase64(data string) ([]byte, error) {
+	data = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\n', '\r', '\t':
+			return -1
+		}
+		return r
+	}, data)
+
+	encodings := []*base64.Encoding{
+		base64.StdEncoding,
+		base64.RawStdEncoding,
+		base64.URLEncoding,
+		base64.RawURLEncoding,
+	}
+
+	var lastErr error
+	for _, encoding := range encodings {
+		content, err := encoding.DecodeString(data)
+		if err == nil {
+			return content, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bytes"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDecodeInlineFile(t *testing.T) {
+	original := config.Config.MaxInlineFileSize
+	config.Config.MaxInlineFileSize = 64
+	t.Cleanup(func() { config.Config.MaxInlineFileSize = original })
+
+	// 标准编码和URL安全编码结果不同的内容
+	binary := []byte{0xfb, 0xff, 0xfe, 'a'}
+	pdf := []byte("%PDF-1.4 test")
+	tooLarge := bytes.Repeat([]byte("a"), 65)
+
+	tests := []struct {
+		name         string
+		source       model.FileSource
+		want         []byte
+		wantFilename string // 文件名后缀
+		wantErr      string
+	}{
+		{
+			name:   "标准base64",
+			source: model.FileSource{Base64: base64.StdEncoding.EncodeToString(binary)},
+			want:   binary,
+		},
+		{
+			name:   "URL安全base64",
+			source: model.FileSource{Base64: base64.URLEncoding.EncodeToString(binary)},
+			want:   binary,
+		},
+		{
+			name:   "无填充的URL安全base64",
+			source: model.FileSource{Base64: base64.RawURLEncoding.EncodeToString(binary)},
+			want:   binary,
+		},
+		{
+			name:   "忽略换行和空格",
+			source: model.FileSource{Base64: " " + strings.Join(strings.SplitAfter(base64.StdEncoding.EncodeToString(pdf), "PDF"), "\r\n") + "\n"},
+			want:   pdf,
+		},
+		{
+			name:         "base64 data URI按内容补全扩展名",
+			source:       model.FileSource{URL: "data:application/pdf;base64," + base64.StdEncoding.EncodeToString(pdf), Filename: "report"},
+			want:         pdf,
+			wantFilename: "report.pdf",
+		},
+		{
+			name:   "文本data URI",
+			source: model.FileSource{Base64: "data:text/plain,hello%20world", Filename: "a.txt"},
+			want:   []byte("hello world"),
+		},
+		{
+			name:   "已读取的内容",
+			source: model.FileSource{Content: pdf, Filename: "a.pdf"},
+			want:   pdf,
+		},
+		{
+			name:    "解码后超过大小限制",
+			source:  model.FileSource{Base64: base64.StdEncoding.EncodeToString(tooLarge)},
+			wantErr: "内联文件超过大小限制 64 字节",
+		},
+		{
+			name:    "编码长度超过大小限制",
+			source:  model.FileSource{URL: "data:;base64," + base64.StdEncoding.EncodeToString(bytes.Repeat(tooLarge, 2))},
+			wantErr: "内联文件超过大小限制 64 字节",
+		},
+		{
+			name:    "文本data URI超过大小限制",
+			source:  model.FileSource{URL: "data:text/plain," + string(tooLarge)},
+			wantErr: "内联文件超过大小限制 64 字节",
+		},
+		{name: "内容为空", source: model.FileSource{URL: "data:text/plain;base64,"}, wantErr: "内联文件内容为空"},
+		{name: "无效base64", source: model.FileSource{Base64: "not base64!!"}, wantErr: "base64解码失败"},
+		{name: "data URI缺少逗号", source: model.FileSource{URL: "data:text/plain;base64"}, wantErr: "缺少逗号分隔符"},
+		{name: "无效的百分号编码", source: model.FileSource{URL: "data:text/plain,%zz"}, wantErr: "data URI解码失败"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := DecodeInlineFile(tt.source, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(file.Content, tt.want) {
+				t.Errorf("content = %q, want %q", file.Content, tt.want)
+			}
+			if tt.wantFilename != "" && file.Filename != tt.wantFilename {
+				t.Errorf("filename = %s, want %s", file.Filename, tt.wantFilename)
+			}
+		})
+	}
+}
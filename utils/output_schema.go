@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaNamePattern 已注册Schema的名称格式，避免路径穿越
+var schemaNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// maxCachedInlineSchemas 缓存的请求内联Schema最大数量，超过时淘汰任意一个
+const maxCachedInlineSchemas = 256
+
+// OutputSchemaStore 已编译的输出Schema
+// schemas为已注册的Schema（键为名称，数量受Schema目录中的文件限制），inline为请求中的Schema（键为内容的SHA256，数量有上限）
+var OutputSchemaStore = struct {
+	sync.Mutex
+	schemas map[string]*jsonschema.Schema
+	inline  map[string]*jsonschema.Schema
+}{
+	schemas: make(map[string]*jsonschema.Schema),
+	inline:  make(map[string]*jsonschema.Schema),
+}
+
+// CompileOutputSchema 编译请求中的Schema或按名称加载已注册的Schema，编译结果会被缓存
+// 已注册的Schema在首次使用时从 OUTPUT_SCHEMA_DIR 读取，修改文件后需重启服务
+func CompileOutputSchema(spec *model.OutputSchemaSpec) (*jsonschema.Schema, error) {
+	var key string
+	var source []byte
+
+	switch {
+	case spec.SchemaRef != "" && len(spec.Schema) > 0:
+		return nil, errors.New("output_schema中schema和schema_ref只能指定一个")
+	case spec.SchemaRef != "":
+		if !schemaNamePattern.MatchString(spec.SchemaRef) {
+			return nil, fmt.Errorf("Schema名称格式错误: %s", spec.SchemaRef)
+		}
+		key = spec.SchemaRef
+	case len(spec.Schema) > 0:
+		sum := sha256.Sum256(spec.Schema)
+		key = hex.EncodeToString(sum[:])
+		source = spec.Schema
+	default:
+		return nil, errors.New("output_schema中需要指定schema或schema_ref")
+	}
+
+	OutputSchemaStore.Lock()
+	defer OutputSchemaStore.Unlock()
+
+	cache := OutputSchemaStore.schemas
+	if source != nil {
+		cache = OutputSchemaStore.inline
+	}
+	if schema, ok := cache[key]; ok {
+		return schema, nil
+	}
+
+	if source == nil {
+		content, err := os.ReadFile(filepath.Join(config.Config.OutputSchemaDir, spec.SchemaRef+".json"))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("未找到已注册的Schema: %s", spec.SchemaRef)
+			}
+			return nil, fmt.Errorf("读取Schema失败: %w", err)
+		}
+		source = content
+	}
+
+	compiler := jsonschema.NewCompiler()
+	// 不加载Schema中引用的外部文件或URL
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("不支持引用外部Schema: %s", s)
+	}
+	if err := compiler.AddResource("output_schema.json", bytes.NewReader(source)); err != nil {
+		return nil, fmt.Errorf("Schema不是有效的JSON: %w", err)
+	}
+	schema, err := compiler.Compile("output_schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("Schema格式错误: %w", err)
+	}
+
+	if source != nil && len(cache) >= maxCachedInlineSchemas {
+		for old := range cache {
+			delete(cache, old)
+			break
+		}
+	}
+	cache[key] = schema
+	return schema, nil
+}
+
+// ValidateWorkflowOutput 校验blocking模式工作流响应中 data.outputs[field] 是否符合Schema
+// 字符串形式的输出先按JSON解析，不是JSON时按原字符串校验；符合时返回nil
+func ValidateWorkflowOutput(workflowData interface{}, field string, schema *jsonschema.Schema) *model.SchemaViolation {
+	violation := &model.SchemaViolation{Code: "schema_violation", Field: field}
+
+	var outputs map[string]interface{}
+	if resp, ok := workflowData.(map[string]interface{}); ok {
+		if data, ok := resp["data"].(map[string]interface{}); ok {
+			outputs, _ = data["outputs"].(map[string]interface{})
+		}
+	}
+	value, ok := outputs[field]
+	if !ok {
+		violation.Errors = []model.SchemaError{{Location: "", Message: "输出中没有字段 " + field}}
+		return violation
+	}
+
+	if str, ok := value.(string); ok {
+		if parsed, err := ParseJSONOutput(str); err == nil {
+			value = parsed
+		}
+	}
+
+	err := schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		violation.Errors = []model.SchemaError{{Location: "", Message: err.Error()}}
+		return violation
+	}
+	violation.Errors = collectSchemaErrors(validationErr, nil)
+	return violation
+}
+
+// collectSchemaErrors 收集最底层的校验错误
+func collectSchemaErrors(err *jsonschema.ValidationError, errs []model.SchemaError) []model.SchemaError {
+	if len(err.Causes) == 0 {
+		return append(errs, model.SchemaError{Location: err.InstanceLocation, Message: err.Message})
+	}
+	for _, cause := range err.Causes {
+		errs = collectSchemaErrors(cause, errs)
+	}
+	return errs
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{"type":"object","required":["score"],"properties":{"score":{"type":"integer","minimum":0},"tags":{"type":"array","items":{"type":"string"}}}}`
+
+// workflowWithOutput 构建outputs中包含指定字段的工作流响应
+func workflowWithOutput(t *testing.T, value string) interface{} {
+	t.Helper()
+
+	var resp interface{}
+	raw := `{"data":{"status":"succeeded","outputs":{"result":` + value + `}}}`
+	if err := json.Unmarshal([]byte(raw), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestValidateWorkflowOutput(t *testing.T) {
+	schema, err := CompileOutputSchema(&model.OutputSchemaSpec{Field: "result", Schema: json.RawMessage(testSchema)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		value        string
+		wantLocation string // 为空表示校验通过
+		wantMessage  string
+	}{
+		{name: "对象", value: `{"score":3,"tags":["a"]}`},
+		{name: "JSON字符串", value: `"` + "```json\\n{\\\"score\\\": 3}\\n```" + `"`},
+		{name: "类型错误", value: `{"score":"high"}`, wantLocation: "/score"},
+		{name: "数组元素错误", value: `{"score":1,"tags":["a",2]}`, wantLocation: "/tags/1"},
+		{name: "缺少必填字段", value: `{"tags":[]}`, wantMessage: "score"},
+		{name: "非JSON字符串", value: `"分数很高"`, wantMessage: "expected object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violation := ValidateWorkflowOutput(workflowWithOutput(t, tt.value), "result", schema)
+			if tt.wantLocation == "" && tt.wantMessage == "" {
+				if violation != nil {
+					t.Fatalf("violation = %+v", violation)
+				}
+				return
+			}
+			if violation == nil || violation.Code != "schema_violation" || len(violation.Errors) == 0 {
+				t.Fatalf("violation = %+v", violation)
+			}
+			first := violation.Errors[0]
+			if first.Location != tt.wantLocation || !strings.Contains(first.Message, tt.wantMessage) {
+				t.Errorf("errors = %+v", violation.Errors)
+			}
+		})
+	}
+
+	if violation := ValidateWorkflowOutput(workflowWithOutput(t, `1`), "missing", schema); violation == nil {
+		t.Error("缺少输出字段时应返回violation")
+	}
+
+	// 非JSON的文本输出按原字符串校验
+	textSchema, err := CompileOutputSchema(&model.OutputSchemaSpec{Field: "result", Schema: json.RawMessage(`{"type":"string","enum":["高","低"]}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violation := ValidateWorkflowOutput(workflowWithOutput(t, `"高"`), "result", textSchema); violation != nil {
+		t.Errorf("文本输出应校验通过: %+v", violation)
+	}
+	if violation := ValidateWorkflowOutput(workflowWithOutput(t, `"中"`), "result", textSchema); violation == nil {
+		t.Error("不在enum中的文本输出应返回violation")
+	}
+}
+
+func TestCompileOutputSchemaInlineCacheBounded(t *testing.T) {
+	for i := 0; i < maxCachedInlineSchemas+10; i++ {
+		schema := fmt.Sprintf(`{"type":"object","title":"s%d"}`, i)
+		if _, err := CompileOutputSchema(&model.OutputSchemaSpec{Schema: json.RawMessage(schema)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	OutputSchemaStore.Lock()
+	defer OutputSchemaStore.Unlock()
+	if n := len(OutputSchemaStore.inline); n > maxCachedInlineSchemas {
+		t.Errorf("缓存的内联Schema数量 = %d, 上限 %d", n, maxCachedInlineSchemas)
+	}
+}
+
+func TestCompileOutputSchemaRef(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "invoice.json"), []byte(testSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	original := config.Config.OutputSchemaDir
+	config.Config.OutputSchemaDir = dir
+	t.Cleanup(func() { config.Config.OutputSchemaDir = original })
+
+	if _, err := CompileOutputSchema(&model.OutputSchemaSpec{SchemaRef: "invoice"}); err != nil {
+		t.Errorf("加载已注册Schema失败: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		spec    model.OutputSchemaSpec
+		wantErr string
+	}{
+		{"未注册", model.OutputSchemaSpec{SchemaRef: "unknown"}, "未找到已注册的Schema"},
+		{"路径穿越", model.OutputSchemaSpec{SchemaRef: "../invoice"}, "Schema名称格式错误"},
+		{"同时指定", model.OutputSchemaSpec{SchemaRef: "invoice", Schema: json.RawMessage(testSchema)}, "只能指定一个"},
+		{"都未指定", model.OutputSchemaSpec{}, "需要指定schema或schema_ref"},
+		{"无效Schema", model.OutputSchemaSpec{Schema: json.RawMessage(`{"type":1}`)}, "Schema格式错误"},
+		{"外部引用", model.OutputSchemaSpec{Schema: json.RawMessage(`{"$ref":"file:///etc/passwd"}`)}, "Schema格式错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileOutputSchema(&tt.spec); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// ShapeWorkflowOutput 按输出规则处理blocking模式的工作流响应，返回提取的字段和执行元数据
+// 先将 parse_json 指定的输出变量解析为JSON，再按 select 中的路径提取字段；未指定select时返回全部outputs。
+// 处理在响应的副本上进行，不修改workflowData（结果缓存中的数据按引用共享）
+func ShapeWorkflowOutput(workflowData interface{}, spec *model.OutputSpec) (map[string]interface{}, *model.WorkflowMetadata, error) {
+	raw, err := json.Marshal(workflowData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("序列化工作流响应失败: %w", err)
+	}
+	var resp map[string]interface{}
+	if err = json.Unmarshal(raw, &resp); err != nil {
+		return nil, nil, fmt.Errorf("工作流响应格式错误: %w", err)
+	}
+
+	data, _ := resp["data"].(map[string]interface{})
+	metadata := buildWorkflowMetadata(resp, data)
+	outputs, _ := data["outputs"].(map[string]interface{})
+
+	// 解析字符串形式的JSON输出
+	for _, name := range spec.ParseJSON {
+		str, ok := outputs[name].(string)
+		if !ok {
+			continue
+		}
+		parsed, err := ParseJSONOutput(str)
+		if err != nil {
+			return nil, metadata, fmt.Errorf("输出字段 %s 不是有效的JSON: %w", name, err)
+		}
+		outputs[name] = parsed
+	}
+
+	if len(spec.Select) == 0 {
+		return outputs, metadata, nil
+	}
+
+	// 按路径提取字段，路径不存在时为null
+	if raw, err = json.Marshal(resp); err != nil {
+		return nil, metadata, fmt.Errorf("序列化工作流响应失败: %w", err)
+	}
+	selected := make(map[string]interface{}, len(spec.Select))
+	for name, path := range spec.Select {
+		result := gjson.GetBytes(raw, normalizeSelector(path))
+		if result.Exists() {
+			selected[name] = result.Value()
+		} else {
+			selected[name] = nil
+		}
+	}
+	return selected, metadata, nil
+}
+
+// ParseJSONOutput 解析LLM输出的JSON字符串，去掉首尾空白及 ```json 代码块标记
+func ParseJSONOutput(str string) (interface{}, error) {
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(str, "```") {
+		str = strings.TrimPrefix(str, "```")
+		if idx := strings.IndexByte(str, '\n'); idx >= 0 {
+			str = str[idx+1:] // 去掉代码块语言标记
+		} else {
+			str = strings.TrimPrefix(str, "json")
+		}
+		str = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(str), "```"))
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(str), &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// normalizeSelector 去掉JSONPath风格的 $ 前缀，转换为gjson路径
+func normalizeSelector(path string) string {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	return strings.TrimPrefix(path, ".")
+}
+
+// buildWorkflowMetadata 从工作流响应中提取执行元数据
+func buildWorkflowMetadata(resp map[string]interface{}, data map[string]interface{}) *model.WorkflowMetadata {
+	metadata := &model.WorkflowMetadata{}
+	metadata.TaskID, _ = resp["task_id"].(string)
+	metadata.WorkflowRunID, _ = resp["workflow_run_id"].(string)
+	metadata.Status, _ = data["status"].(string)
+	metadata.Error, _ = data["error"].(string)
+	metadata.ElapsedTime, _ = data["elapsed_time"].(float64)
+	if tokens, ok := data["total_tokens"].(float64); ok {
+		metadata.TotalTokens = int64(tokens)
+	}
+	if steps, ok := data["total_steps"].(float64); ok {
+		metadata.TotalSteps = int64(steps)
+	}
+	return metadata
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testWorkflowData 测试用的blocking模式工作流响应
+func testWorkflowData(t *testing.T) interface{} {
+	t.Helper()
+
+	var data interface{}
+	raw := `{"task_id":"t1","workflow_run_id":"r1","data":{"status":"succeeded","elapsed_time":1.5,"total_tokens":320,"total_steps":4,
+		"outputs":{"text":"` + "```json\\n{\\\"score\\\": 90, \\\"tags\\\": [\\\"a\\\", \\\"b\\\"]}\\n```" + `","summary":"ok"}}}`
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestShapeWorkflowOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		spec model.OutputSpec
+		want map[string]interface{}
+	}{
+		{
+			name: "解析JSON输出",
+			spec: model.OutputSpec{ParseJSON: []string{"text"}},
+			want: map[string]interface{}{
+				"text":    map[string]interface{}{"score": float64(90), "tags": []interface{}{"a", "b"}},
+				"summary": "ok",
+			},
+		},
+		{
+			name: "提取字段",
+			spec: model.OutputSpec{
+				ParseJSON: []string{"text"},
+				Select: map[string]string{
+					"score":   "data.outputs.text.score",
+					"tag":     "$.data.outputs.text.tags.0",
+					"summary": "data.outputs.summary",
+					"missing": "data.outputs.none",
+				},
+			},
+			want: map[string]interface{}{"score": float64(90), "tag": "a", "summary": "ok", "missing": nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testWorkflowData(t)
+			before, _ := json.Marshal(data)
+
+			output, metadata, err := ShapeWorkflowOutput(data, &tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(output, tt.want) {
+				t.Errorf("output = %v, want %v", output, tt.want)
+			}
+			want := model.WorkflowMetadata{TaskID: "t1", WorkflowRunID: "r1", Status: "succeeded", ElapsedTime: 1.5, TotalTokens: 320, TotalSteps: 4}
+			if *metadata != want {
+				t.Errorf("metadata = %+v, want %+v", *metadata, want)
+			}
+
+			// 原始响应（可能来自结果缓存）不应被修改
+			if after, _ := json.Marshal(data); string(after) != string(before) {
+				t.Error("ShapeWorkflowOutput修改了原始响应")
+			}
+		})
+	}
+}
+
+func TestShapeWorkflowOutputInvalidJSON(t *testing.T) {
+	_, metadata, err := ShapeWorkflowOutput(testWorkflowData(t), &model.OutputSpec{ParseJSON: []string{"summary"}})
+	if err == nil {
+		t.Fatal("非JSON输出应返回错误")
+	}
+	if metadata == nil || metadata.Status != "succeeded" {
+		t.Errorf("解析失败时仍应返回元数据: %+v", metadata)
+	}
+}
+
+func TestParseJSONOutput(t *testing.T) {
+	for _, input := range []string{`{"a":1}`, " {\"a\":1} \n", "```json\n{\"a\":1}\n```", "```\n{\"a\":1}\n```", "```json {\"a\":1}```"} {
+		value, err := ParseJSONOutput(input)
+		if err != nil {
+			t.Errorf("ParseJSONOutput(%q) error: %v", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, map[string]interface{}{"a": float64(1)}) {
+			t.Errorf("ParseJSONOutput(%q) = %v", input, value)
+		}
+	}
+}
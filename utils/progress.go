@@ -0,0 +1,71 @@
+package utils
+
+import "io"
+
+// ProgressFunc 进度回调，read为已读取字节数，total为总字节数（未知时为-1）
+type ProgressFunc func(read int64, total int64)
+
+// minProgressStep 两次进度回调之间的最小字节数
+const minProgressStep = 64 * 1024
+
+// unknownProgressStep 总大小未知时的进度回调步长
+const unknownProgressStep = 1024 * 1024
+
+// progressReader 统计读取的字节数并按步长回调进度
+type progressReader struct {
+	reader     io.Reader
+	total      int64
+	read       int64
+	reported   int64
+	step       int64
+	done       bool
+	onProgress ProgressFunc
+}
+
+// NewProgressReader 创建带进度回调的Reader，约每5%回调一次，读取完成时必定回调
+// onProgress为nil时直接返回原Reader
+func NewProgressReader(reader io.Reader, total int64, onProgress ProgressFunc) io.Reader {
+	if onProgress == nil {
+		return reader
+	}
+
+	step := int64(unknownProgressStep)
+	if total > 0 {
+		step = total / 20
+		if step < minProgressStep {
+			step = minProgressStep
+		}
+	}
+
+	onProgress(0, total)
+	return &progressReader{reader: reader, total: total, step: step, onProgress: onProgress}
+}
+
+// Read 实现io.Reader
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+
+	if r.done {
+		return n, err
+	}
+	finished := err == io.EOF || (r.total > 0 && r.read >= r.total)
+	if finished || r.read-r.reported >= r.step {
+		r.reported = r.read
+		r.done = finished
+		r.onProgress(r.read, r.total)
+	}
+	return n, err
+}
+
+// ProgressPercentage 计算进度百分比，总大小未知时返回-1
+func ProgressPercentage(read int64, total int64) float64 {
+	if total <= 0 {
+		return -1
+	}
+	percentage := float64(read) * 100 / float64(total)
+	if percentage > 100 {
+		percentage = 100
+	}
+	return float64(int(percentage*10)) / 10
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestProgressReader(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1<<20)
+
+	var reports [][2]int64
+	reader := NewProgressReader(bytes.NewReader(content), int64(len(content)), func(read, total int64) {
+		reports = append(reports, [2]int64{read, total})
+	})
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) < 3 {
+		t.Fatalf("进度回调次数 = %d, 应包含开始、中间和完成", len(reports))
+	}
+	if reports[0][0] != 0 {
+		t.Errorf("第一次回调 = %v, want 0", reports[0])
+	}
+	if last := reports[len(reports)-1]; last[0] != int64(len(content)) || last[1] != int64(len(content)) {
+		t.Errorf("最后一次回调 = %v", last)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i][0] <= reports[i-1][0] {
+			t.Fatalf("进度未递增: %v", reports)
+		}
+	}
+}
+
+func TestProgressPercentage(t *testing.T) {
+	tests := []struct {
+		read, total int64
+		want        float64
+	}{
+		{0, 100, 0},
+		{50, 200, 25},
+		{100, 100, 100},
+		{10, -1, -1},
+		{10, 0, -1},
+	}
+	for _, tt := range tests {
+		if got := ProgressPercentage(tt.read, tt.total); got != tt.want {
+			t.Errorf("ProgressPercentage(%d, %d) = %v, want %v", tt.read, tt.total, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// sensitiveQueryKeys 视为敏感信息的查询参数（小写，包含匹配）
+var sensitiveQueryKeys = []string{
+	"token",
+	"signature",
+	"sig",
+	"key",
+	"secret",
+	"password",
+	"passwd",
+	"auth",
+	"credential",
+	"session",
+}
+
+// redactedValue 脱敏后的占位符
+const redactedValue = "***"
+
+// RedactURL 对URL脱敏：移除用户名密码，并隐藏敏感查询参数的值
+func RedactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		// 无法解析时只保留查询参数之前的部分
+		if idx := strings.IndexAny(rawURL, "?#"); idx >= 0 {
+			return rawURL[:idx]
+		}
+		return rawURL
+	}
+
+	if parsed.User != nil {
+		parsed.User = url.User(redactedValue)
+	}
+
+	if parsed.RawQuery != "" {
+		query := parsed.Query()
+		for key := range query {
+			if isSensitiveKey(key) {
+				query.Set(key, redactedValue)
+			}
+		}
+		parsed.RawQuery = query.Encode()
+	}
+
+	// 占位符保持可读，不做百分号编码
+	return strings.ReplaceAll(parsed.String(), url.QueryEscape(redactedValue), redactedValue)
+}
+
+// RedactError 对错误信息中的URL和已知密钥脱敏
+func RedactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = RedactURL(urlErr.URL)
+	}
+
+	message := err.Error()
+	redacted := message
+	for _, secret := range secrets {
+		if secret != "" {
+			redacted = strings.ReplaceAll(redacted, secret, redactedValue)
+		}
+	}
+	if redacted == message {
+		return err
+	}
+	return errors.New(redacted)
+}
+
+// RedactHeaders 返回脱敏后的请求头副本，用于日志输出
+func RedactHeaders(headers map[string]string) map[string]string {
+	result := make(map[string]string, len(headers))
+	for key, value := range headers {
+		if isSensitiveHeader(key) {
+			result[key] = redactedValue
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// isSensitiveKey 判断查询参数名是否敏感
+func isSensitiveKey(key string) bool {
+	lower := strings.ToLower(key)
+	for _, sensitive := range sensitiveQueryKeys {
+		if strings.Contains(lower, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSensitiveHeader 判断请求头是否敏感
+func isSensitiveHeader(key string) bool {
+	switch strings.ToLower(key) {
+	case "authorization", "proxy-authorization", "cookie", "x-api-key", "x-auth-token":
+		return true
+	}
+	return isSensitiveKey(key)
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"bytes"
+	"dify-upload-workflow/model"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestDownloadFileErrorRedacted 下载失败时返回的错误和日志中不包含请求头、Basic认证和查询参数中的密钥
+func TestDownloadFileErrorRedacted(t *testing.T) {
+	const (
+		bearer   = "bearer-secret-123"
+		password = "basic-pass-456"
+		token    = "query-token-789"
+	)
+
+	// 已关闭的端口，连接会失败
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	// 重定向到已关闭的端口，重定向地址中带有请求中的密钥，出错时会出现在错误信息中
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pass, _ := r.BasicAuth()
+		bearerToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		http.Redirect(w, r, "http://"+closedAddr+"/next?token="+token+"&b="+bearerToken+"&p="+pass, http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"连接失败", "http://user:" + password + "@" + closedAddr + "/file.pdf?token=" + token},
+		{"重定向后失败", redirect.URL + "/file.pdf?token=" + token},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			_, err := DownloadFile(model.FileSource{
+				URL:       tt.url,
+				Headers:   map[string]string{"Authorization": "Bearer " + bearer},
+				BasicAuth: &model.BasicAuth{Username: "user", Password: password},
+			})
+			if err == nil {
+				t.Fatal("下载应失败")
+			}
+			for _, secret := range []string{bearer, password, token} {
+				if strings.Contains(err.Error(), secret) {
+					t.Errorf("错误信息包含密钥 %s: %v", secret, err)
+				}
+				if strings.Contains(logs.String(), secret) {
+					t.Errorf("日志包含密钥 %s: %s", secret, logs.String())
+				}
+			}
+			if !strings.Contains(logs.String(), "Authorization:***") {
+				t.Errorf("日志中的请求头未脱敏: %s", logs.String())
+			}
+		})
+	}
+}
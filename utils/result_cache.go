@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 结果缓存模式（请求参数cache）
+const (
+	ResultCacheDefault = ""        // 命中时直接返回缓存结果
+	ResultCacheBypass  = "bypass"  // 不读取也不写入缓存
+	ResultCacheRefresh = "refresh" // 不读取缓存，执行后写入新结果
+)
+
+// ResultCacheStats 结果缓存统计
+type ResultCacheStats struct {
+	Enabled   bool  `json:"enabled"`
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Stores    int64 `json:"stores"`
+	Evictions int64 `json:"evictions"`
+}
+
+// resultCacheEntry 结果缓存项
+type resultCacheEntry struct {
+	data      interface{}
+	expiresAt time.Time
+}
+
+// ResultCacheStore 工作流结果缓存，键为 应用+用户+inputs+文件内容哈希
+var ResultCacheStore = struct {
+	sync.Mutex
+	entries map[string]resultCacheEntry
+	stats   ResultCacheStats
+}{
+	entries: make(map[string]resultCacheEntry),
+}
+
+// ResultCacheEnabled 是否启用结果缓存（RESULT_CACHE_TTL大于0）
+func ResultCacheEnabled() bool {
+	return config.Config.ResultCacheTTL > 0
+}
+
+// IsValidResultCacheMode 校验请求的cache参数
+func IsValidResultCacheMode(mode string) bool {
+	return mode == ResultCacheDefault || mode == ResultCacheBypass || mode == ResultCacheRefresh
+}
+
+// ResultCacheKey 计算结果缓存键，variables中的文件需已获取内容（见 DifyService.loadFileVariables）
+// 文件按内容的SHA-256和文件名标识，引用的已上传文件按upload_file_id标识，因此同一URL的文件内容变化后不会命中，
+// 不同下载凭据得到的不同内容也不会互相命中；终端用户user同样参与计算。
+// inputs经JSON序列化后键有序，字段顺序不同的请求得到相同的键
+func ResultCacheKey(baseURL string, apiKey string, request *model.SingleFileWorkflowRequest, variables []model.FileVariable) (string, error) {
+	files := make([]interface{}, 0, len(variables))
+	for _, variable := range variables {
+		sources := make([]interface{}, 0, len(variable.Sources))
+		for _, source := range variable.Sources {
+			switch {
+			case source.UploadFileID != "":
+				sources = append(sources, map[string]interface{}{"upload_file_id": source.UploadFileID, "type": source.Type})
+			case source.Content != nil:
+				sum := sha256.Sum256(source.Content)
+				sources = append(sources, map[string]interface{}{"sha256": hex.EncodeToString(sum[:]), "filename": source.Filename})
+			default:
+				return "", fmt.Errorf("文件 %s 尚未获取内容", DescribeFileSource(source))
+			}
+		}
+		files = append(files, map[string]interface{}{
+			"file_value": variable.FileValue,
+			"is_list":    variable.IsList,
+			"type":       variable.Type,
+			"sources":    sources,
+		})
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"app":               baseURL + "|" + HashAPIKey(apiKey),
+		"user":              request.User,
+		"inputs":            request.Inputs,
+		"files":             files,
+		"file_type_mapping": request.FileTypeMapping,
+		"expand_archives":   request.ExpandArchives,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// GetCachedResult 获取缓存的工作流结果
+func GetCachedResult(key string) (interface{}, bool) {
+	ResultCacheStore.Lock()
+	defer ResultCacheStore.Unlock()
+
+	entry, ok := ResultCacheStore.entries[key]
+	if ok && time.Now().After(entry.expiresAt) {
+		delete(ResultCacheStore.entries, key)
+		ResultCacheStore.stats.Evictions++
+		ok = false
+	}
+	if !ok {
+		ResultCacheStore.stats.Misses++
+		return nil, false
+	}
+	ResultCacheStore.stats.Hits++
+	return entry.data, true
+}
+
+// SetCachedResult 缓存工作流结果，超过最大条目数时淘汰最早过期的缓存项
+func SetCachedResult(key string, data interface{}) {
+	ResultCacheStore.Lock()
+	defer ResultCacheStore.Unlock()
+
+	now := time.Now()
+	for k, entry := range ResultCacheStore.entries {
+		if now.After(entry.expiresAt) {
+			delete(ResultCacheStore.entries, k)
+			ResultCacheStore.stats.Evictions++
+		}
+	}
+
+	if _, exists := ResultCacheStore.entries[key]; !exists && len(ResultCacheStore.entries) >= config.Config.ResultCacheMaxEntries {
+		var oldestKey string
+		var oldest time.Time
+		for k, entry := range ResultCacheStore.entries {
+			if oldestKey == "" || entry.expiresAt.Before(oldest) {
+				oldestKey, oldest = k, entry.expiresAt
+			}
+		}
+		delete(ResultCacheStore.entries, oldestKey)
+		ResultCacheStore.stats.Evictions++
+	}
+
+	ResultCacheStore.entries[key] = resultCacheEntry{
+		data:      data,
+		expiresAt: now.Add(time.Duration(config.Config.ResultCacheTTL) * time.Second),
+	}
+	ResultCacheStore.stats.Stores++
+}
+
+// GetResultCacheStats 获取结果缓存统计
+func GetResultCacheStats() ResultCacheStats {
+	ResultCacheStore.Lock()
+	defer ResultCacheStore.Unlock()
+
+	stats := ResultCacheStore.stats
+	stats.Enabled = ResultCacheEnabled()
+	stats.Entries = len(ResultCacheStore.entries)
+	return stats
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// SSEEvent 一个Server-Sent Events事件
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// Name 事件名称：优先使用event字段，否则取data中JSON的event字段（Dify的事件格式）
+func (e *SSEEvent) Name() string {
+	if e.Event != "" {
+		return e.Event
+	}
+	var payload struct {
+		Event string `json:"event"`
+	}
+	if json.Unmarshal([]byte(e.Data), &payload) == nil {
+		return payload.Event
+	}
+	return ""
+}
+
+// SSEReader 逐个事件读取SSE流
+type SSEReader struct {
+	reader *bufio.Reader
+}
+
+// NewSSEReader 创建SSE读取器
+func NewSSEReader(r io.Reader) *SSEReader {
+	return &SSEReader{reader: bufio.NewReader(r)}
+}
+
+// Next 读取下一个事件，流结束时返回io.EOF
+// 使用bufio.Reader按行读取，不受bufio.Scanner单行64KB的限制
+func (r *SSEReader) Next() (*SSEEvent, error) {
+	event := &SSEEvent{}
+	var dataLines []string
+	hasField := false
+
+	for {
+		line, err := r.reader.ReadString('\n')
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			if line == "" {
+				if hasField {
+					// 流结束时最后一个事件没有空行结尾
+					event.Data = strings.Join(dataLines, "\n")
+					return event, nil
+				}
+				return nil, io.EOF
+			}
+			// 最后一行没有换行符，按正常行处理，下次读取时返回EOF
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		// 空行表示一个事件结束
+		if line == "" {
+			if hasField {
+				event.Data = strings.Join(dataLines, "\n")
+				return event, nil
+			}
+			continue
+		}
+
+		// 注释行
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "data":
+			dataLines = append(dataLines, value)
+		case "event":
+			event.Event = value
+		case "id":
+			event.ID = value
+		default:
+			continue
+		}
+		hasField = true
+	}
+}
+
+// SSERecorder 记录写出的事件，可在记录时为事件分配ID
+type SSERecorder interface {
+	Record(event *SSEEvent)
+}
+
+// EventWriter 流式事件输出，SSEWriter和WebSocketWriter都实现该接口
+type EventWriter interface {
+	WriteEvent(event *SSEEvent) error
+	WriteJSON(payload interface{}) error
+	SetRecorder(recorder SSERecorder)
+}
+
+// SSEWriter 写出SSE事件，每个事件写完后立即flush
+// 可在多个goroutine中并发写出（如上传进度在HTTP传输的goroutine中回调）
+type SSEWriter struct {
+	mu       sync.Mutex
+	writer   http.ResponseWriter
+	flusher  http.Flusher
+	started  bool
+	recorder SSERecorder
+	err      error // 写出失败（客户端断开连接）后不再写出，仍继续记录事件
+}
+
+// NewSSEWriter 创建SSE写入器
+func NewSSEWriter(w http.ResponseWriter) *SSEWriter {
+	flusher, _ := w.(http.Flusher)
+	return &SSEWriter{writer: w, flusher: flusher}
+}
+
+// Start 设置SSE响应头并发送响应头，重复调用无副作用
+func (w *SSEWriter) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.start()
+}
+
+// start 发送响应头，调用方需持有锁
+func (w *SSEWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+
+	header := w.writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("X-Accel-Buffering", "no") // 避免nginx等反向代理缓冲
+	w.writer.WriteHeader(http.StatusOK)
+	w.flush()
+}
+
+// SetRecorder 设置事件记录器，之后写出的每个事件都先交给记录器
+func (w *SSEWriter) SetRecorder(recorder SSERecorder) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recorder = recorder
+}
+
+// Started 是否已开始输出SSE响应
+func (w *SSEWriter) Started() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.started
+}
+
+// WriteEvent 写出一个事件，写出失败后再次调用直接返回之前的错误
+func (w *SSEWriter) WriteEvent(event *SSEEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.recorder != nil {
+		recorded := *event
+		w.recorder.Record(&recorded)
+		event = &recorded
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.start()
+
+	var builder strings.Builder
+	if event.ID != "" {
+		builder.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Event != "" {
+		builder.WriteString("event: " + event.Event + "\n")
+	}
+	if event.Data != "" || event.Event == "" {
+		for _, line := range strings.Split(event.Data, "\n") {
+			builder.WriteString("data: " + line + "\n")
+		}
+	}
+	builder.WriteString("\n")
+
+	if _, err := io.WriteString(w.writer, builder.String()); err != nil {
+		w.err = err
+		return err
+	}
+	w.flush()
+	return nil
+}
+
+// WriteJSON 以Dify的事件格式写出一个data为JSON的事件
+func (w *SSEWriter) WriteJSON(payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return w.WriteEvent(&SSEEvent{Data: string(data)})
+}
+
+// flush 刷新缓冲区
+func (w *SSEWriter) flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSSEReader(t *testing.T) {
+	stream := "event: ping\n\n" +
+		": comment\n" +
+		"data: {\"event\":\"text_chunk\",\"data\":{\"text\":\"你好\"}}\n\n" +
+		"id: 3\r\ndata: line1\r\ndata: line2\r\n\r\n" +
+		"data: {\"event\":\"workflow_finished\"}"
+
+	want := []SSEEvent{
+		{Event: "ping"},
+		{Data: `{"event":"text_chunk","data":{"text":"你好"}}`},
+		{ID: "3", Data: "line1\nline2"},
+		{Data: `{"event":"workflow_finished"}`},
+	}
+	wantNames := []string{"ping", "text_chunk", "", "workflow_finished"}
+
+	reader := NewSSEReader(strings.NewReader(stream))
+	for i := range want {
+		event, err := reader.Next()
+		if err != nil {
+			t.Fatalf("事件 %d: %v", i, err)
+		}
+		if *event != want[i] {
+			t.Errorf("事件 %d = %+v, want %+v", i, *event, want[i])
+		}
+		if name := event.Name(); name != wantNames[i] {
+			t.Errorf("事件 %d 名称 = %q, want %q", i, name, wantNames[i])
+		}
+	}
+	if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("流结束后应返回EOF, got %v", err)
+	}
+}
+
+func TestSSEWriterRoundTrip(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := NewSSEWriter(recorder)
+
+	events := []SSEEvent{
+		{Event: "ping"},
+		{ID: "1", Data: "a\nb"},
+	}
+	for i := range events {
+		if err := writer.WriteEvent(&events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := recorder.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if !recorder.Flushed {
+		t.Error("写出事件后应flush")
+	}
+
+	reader := NewSSEReader(recorder.Body)
+	for i := range events {
+		event, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *event != events[i] {
+			t.Errorf("事件 %d = %+v, want %+v", i, *event, events[i])
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"dify-upload-workflow/config"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StreamRecord 流式请求已发送的事件记录，客户端断开后可通过Last-Event-ID续传
+// 事件ID从1开始按发送顺序递增
+type StreamRecord struct {
+	mu         sync.Mutex
+	events     []SSEEvent
+	done       bool
+	finishedAt time.Time
+	updated    chan struct{} // 有新事件或结束时关闭并替换，用于通知等待中的读取方
+	apiKeyHash string        // 执行请求的API密钥哈希，续传时校验
+}
+
+// StreamRecordStore 流式请求事件记录，键为请求ID
+var StreamRecordStore = struct {
+	sync.Mutex
+	records map[string]*StreamRecord
+}{
+	records: make(map[string]*StreamRecord),
+}
+
+// NewStreamRecord 创建流式请求事件记录，同时清理已过期的记录及其对应的处理记录（InitStreamRequest创建）
+func NewStreamRecord(requestID string, apiKey string) *StreamRecord {
+	StreamRecordStore.Lock()
+	defer StreamRecordStore.Unlock()
+
+	ttl := time.Duration(config.Config.StreamRecordTTL) * time.Second
+	for key, record := range StreamRecordStore.records {
+		if record.expired(ttl) {
+			delete(StreamRecordStore.records, key)
+			removeStreamRequest(key)
+		}
+	}
+
+	record := &StreamRecord{updated: make(chan struct{}), apiKeyHash: HashAPIKey(apiKey)}
+	StreamRecordStore.records[requestID] = record
+	return record
+}
+
+// GetStreamRecord 获取流式请求事件记录
+func GetStreamRecord(requestID string) (*StreamRecord, bool) {
+	StreamRecordStore.Lock()
+	defer StreamRecordStore.Unlock()
+
+	record, ok := StreamRecordStore.records[requestID]
+	if !ok || record.expired(time.Duration(config.Config.StreamRecordTTL)*time.Second) {
+		return nil, false
+	}
+	return record, true
+}
+
+// APIKeyHash 执行请求的API密钥哈希
+func (r *StreamRecord) APIKeyHash() string {
+	return r.apiKeyHash
+}
+
+// Record 记录一个事件并为其分配ID，实现SSEWriter的事件记录
+func (r *StreamRecord) Record(event *SSEEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event.ID = strconv.Itoa(len(r.events) + 1)
+	r.events = append(r.events, *event)
+	r.notify()
+}
+
+// Finish 标记流式请求已结束
+func (r *StreamRecord) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return
+	}
+	r.done = true
+	r.finishedAt = time.Now()
+	r.notify()
+}
+
+// EventsAfter 返回ID大于lastEventID的事件、是否已结束，以及有新事件时会被关闭的通知channel
+func (r *StreamRecord) EventsAfter(lastEventID string) ([]SSEEvent, bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start, _ := strconv.Atoi(lastEventID)
+	if start < 0 {
+		start = 0
+	}
+	var events []SSEEvent
+	if start < len(r.events) {
+		events = append(events, r.events[start:]...)
+	}
+	return events, r.done, r.updated
+}
+
+// notify 通知等待中的读取方，调用方需持有锁
+func (r *StreamRecord) notify() {
+	close(r.updated)
+	r.updated = make(chan struct{})
+}
+
+// expired 是否已结束且超过保留时间
+func (r *StreamRecord) expired(ttl time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done && time.Since(r.finishedAt) > ttl
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"testing"
+)
+
+func TestStreamRecord(t *testing.T) {
+	record := NewStreamRecord("stream-record-test", "app-key")
+
+	_, done, updated := record.EventsAfter("")
+	if done {
+		t.Fatal("新记录不应已结束")
+	}
+
+	for _, name := range []string{"ping", "text_chunk", "workflow_finished"} {
+		event := &SSEEvent{Event: name}
+		record.Record(event)
+	}
+	select {
+	case <-updated:
+	default:
+		t.Fatal("记录事件后应通知读取方")
+	}
+
+	events, _, _ := record.EventsAfter("1")
+	if len(events) != 2 || events[0].ID != "2" || events[1].Event != "workflow_finished" {
+		t.Errorf("EventsAfter(1) = %+v", events)
+	}
+	if events, _, _ = record.EventsAfter(""); len(events) != 3 || events[0].ID != "1" {
+		t.Errorf("EventsAfter(\"\") = %+v", events)
+	}
+	if events, _, _ = record.EventsAfter("10"); len(events) != 0 {
+		t.Errorf("EventsAfter(10) = %+v", events)
+	}
+
+	record.Finish()
+	if _, done, _ = record.EventsAfter("3"); !done {
+		t.Error("Finish后应已结束")
+	}
+	if got, ok := GetStreamRecord("stream-record-test"); !ok || got != record {
+		t.Error("未找到记录")
+	}
+}
+
+// TestStreamRecordExpiry 过期的事件记录和流式请求创建的处理记录一起清理，异步请求的记录保留
+func TestStreamRecordExpiry(t *testing.T) {
+	original := config.Config.StreamRecordTTL
+	config.Config.StreamRecordTTL = 0
+	t.Cleanup(func() { config.Config.StreamRecordTTL = original })
+
+	InitStreamRequest("stream-expiry-test", "app-key")
+	NewStreamRecord("stream-expiry-test", "app-key").Finish()
+	if _, err := InitAsyncRequest(&model.AsyncRequest{RequestID: "async-expiry-test"}, "app-key"); err != nil {
+		t.Fatal(err)
+	}
+	running := NewStreamRecord("stream-expiry-running", "app-key")
+	InitStreamRequest("stream-expiry-running", "app-key")
+
+	// 创建新记录时清理
+	NewStreamRecord("stream-expiry-next", "app-key")
+
+	if _, ok := GetAsyncRequestStatus("stream-expiry-test"); ok {
+		t.Error("过期的流式请求处理记录未清理")
+	}
+	if _, ok := GetStreamRecord("stream-expiry-test"); ok {
+		t.Error("过期的事件记录未清理")
+	}
+	if _, ok := GetAsyncRequestStatus("async-expiry-test"); !ok {
+		t.Error("异步请求记录不应被清理")
+	}
+	if _, ok := GetAsyncRequestStatus("stream-expiry-running"); !ok {
+		t.Error("未结束的流式请求记录不应被清理")
+	}
+	running.Finish()
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadCache 上传去重缓存，记录文件内容对应的Dify文件
+type UploadCache interface {
+	// Get 获取缓存的上传结果，不存在或已过期时返回false
+	Get(key string) (*model.DifyFileUploadResponse, bool)
+	// Set 缓存上传结果
+	Set(key string, fileResp *model.DifyFileUploadResponse)
+}
+
+// uploadCacheEntry 缓存项
+type uploadCacheEntry struct {
+	Response  model.DifyFileUploadResponse `json:"response"`
+	ExpiresAt time.Time                    `json:"expires_at"`
+}
+
+var (
+	uploadCache     UploadCache
+	uploadCacheOnce sync.Once
+	uploadCacheMu   sync.RWMutex
+)
+
+// GetUploadCache 按配置获取上传去重缓存，未启用时返回nil
+func GetUploadCache() UploadCache {
+	uploadCacheOnce.Do(func() {
+		ttl := time.Duration(config.Config.UploadCacheTTL) * time.Second
+		switch strings.ToLower(config.Config.UploadCache) {
+		case "memory":
+			uploadCache = NewMemoryUploadCache(ttl)
+		case "disk":
+			cache, err := NewDiskUploadCache(config.Config.UploadCacheDir, ttl)
+			if err != nil {
+				log.Printf("初始化磁盘上传缓存失败，已禁用上传缓存: %v", err)
+				return
+			}
+			uploadCache = cache
+		case "", "none", "off":
+		default:
+			log.Printf("未知的上传缓存类型 %s，已禁用上传缓存", config.Config.UploadCache)
+		}
+	})
+
+	uploadCacheMu.RLock()
+	defer uploadCacheMu.RUnlock()
+	return uploadCache
+}
+
+// SetUploadCache 替换上传去重缓存（nil表示禁用），不再按配置初始化；用于测试或自定义缓存实现
+func SetUploadCache(cache UploadCache) {
+	uploadCacheOnce.Do(func() {})
+
+	uploadCacheMu.Lock()
+	defer uploadCacheMu.Unlock()
+	uploadCache = cache
+}
+
+// UploadCacheKey 计算上传缓存键：域名、API密钥哈希、用户和文件内容的SHA-256
+// 同一Dify应用下同一用户上传相同内容时复用已有的文件ID
+func UploadCacheKey(baseURL string, apiKey string, user string, content []byte) string {
+	contentSum := sha256.Sum256(content)
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		baseURL,
+		HashAPIKey(apiKey),
+		user,
+		hex.EncodeToString(contentSum[:]),
+	}, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryUploadCache 内存上传缓存
+type MemoryUploadCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]uploadCacheEntry
+}
+
+// NewMemoryUploadCache 创建内存上传缓存
+func NewMemoryUploadCache(ttl time.Duration) *MemoryUploadCache {
+	return &MemoryUploadCache{
+		ttl:     ttl,
+		entries: make(map[string]uploadCacheEntry),
+	}
+}
+
+// Get 获取缓存的上传结果
+func (c *MemoryUploadCache) Get(key string) (*model.DifyFileUploadResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	fileResp := entry.Response
+	return &fileResp, true
+}
+
+// Set 缓存上传结果，同时清理已过期的缓存项
+func (c *MemoryUploadCache) Set(key string, fileResp *model.DifyFileUploadResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.ExpiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = uploadCacheEntry{Response: *fileResp, ExpiresAt: now.Add(c.ttl)}
+}
+
+// DiskUploadCache 本地磁盘上传缓存，每个缓存项保存为一个JSON文件，服务重启后仍可复用
+type DiskUploadCache struct {
+	mu  sync.Mutex
+	dir string
+	ttl time.Duration
+}
+
+// NewDiskUploadCache 创建磁盘上传缓存
+func NewDiskUploadCache(dir string, ttl time.Duration) (*DiskUploadCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskUploadCache{dir: dir, ttl: ttl}, nil
+}
+
+// path 缓存项文件路径
+func (c *DiskUploadCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// Get 获取缓存的上传结果
+func (c *DiskUploadCache) Get(key string) (*model.DifyFileUploadResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry uploadCacheEntry
+	if err = json.Unmarshal(data, &entry); err != nil || time.Now().After(entry.ExpiresAt) {
+		os.Remove(c.path(key))
+		return nil, false
+	}
+	return &entry.Response, true
+}
+
+// Set 缓存上传结果，先写临时文件再重命名，避免读到不完整的内容
+func (c *DiskUploadCache) Set(key string, fileResp *model.DifyFileUploadResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.Marshal(uploadCacheEntry{Response: *fileResp, ExpiresAt: time.Now().Add(c.ttl)})
+	if err != nil {
+		log.Printf("序列化上传缓存失败: %v", err)
+		return
+	}
+	tmp := c.path(key) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("写入上传缓存失败: %v", err)
+		return
+	}
+	if err = os.Rename(tmp, c.path(key)); err != nil {
+		log.Printf("写入上传缓存失败: %v", err)
+		os.Remove(tmp)
+	}
+}
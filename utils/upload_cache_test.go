@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"dify-upload-workflow/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testUploadCache 验证缓存的写入、读取和过期
+func testUploadCache(t *testing.T, newCache func(ttl time.Duration) UploadCache) {
+	t.Helper()
+
+	key := UploadCacheKey("https://api.dify.ai", "app-key", "user", []byte("content"))
+	fileResp := &model.DifyFileUploadResponse{ID: "file-1", Name: "a.pdf", Extension: "pdf"}
+
+	cache := newCache(time.Hour)
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("空缓存不应命中")
+	}
+	cache.Set(key, fileResp)
+	got, ok := cache.Get(key)
+	if !ok || got.ID != "file-1" || got.Name != "a.pdf" {
+		t.Fatalf("Get = %+v, %v", got, ok)
+	}
+
+	// 返回的是副本，修改不影响缓存
+	got.CacheHit = true
+	if again, _ := cache.Get(key); again.CacheHit {
+		t.Error("修改返回值影响了缓存内容")
+	}
+
+	if _, ok = cache.Get(UploadCacheKey("https://api.dify.ai", "app-key", "other-user", []byte("content"))); ok {
+		t.Error("不同用户不应命中")
+	}
+
+	expired := newCache(-time.Second)
+	expired.Set(key, fileResp)
+	if _, ok = expired.Get(key); ok {
+		t.Error("过期的缓存项不应命中")
+	}
+}
+
+func TestMemoryUploadCache(t *testing.T) {
+	testUploadCache(t, func(ttl time.Duration) UploadCache { return NewMemoryUploadCache(ttl) })
+}
+
+func TestDiskUploadCache(t *testing.T) {
+	testUploadCache(t, func(ttl time.Duration) UploadCache {
+		cache, err := NewDiskUploadCache(t.TempDir(), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	})
+
+	// 缓存保存在磁盘上，重新创建后仍可读取；过期或损坏的缓存文件被删除
+	dir := filepath.Join(t.TempDir(), "cache")
+	cache, err := NewDiskUploadCache(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("persisted", &model.DifyFileUploadResponse{ID: "file-1"})
+	reopened, err := NewDiskUploadCache(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.Get("persisted"); !ok || got.ID != "file-1" {
+		t.Errorf("重新创建后 Get = %+v, %v", got, ok)
+	}
+
+	expired, _ := NewDiskUploadCache(dir, -time.Second)
+	expired.Set("expired", &model.DifyFileUploadResponse{ID: "file-2"})
+	os.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{"), 0o644)
+	for _, key := range []string{"expired", "corrupt"} {
+		if _, ok := reopened.Get(key); ok {
+			t.Errorf("%s 不应命中", key)
+		}
+		if _, err := os.Stat(filepath.Join(dir, key+".json")); !os.IsNotExist(err) {
+			t.Errorf("%s 的缓存文件未删除: %v", key, err)
+		}
+	}
+}
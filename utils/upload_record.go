@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"sync"
+	"time"
+)
+
+// uploadRecord 上传记录
+type uploadRecord struct {
+	fileResp  model.DifyFileUploadResponse
+	expiresAt time.Time
+}
+
+// UploadRecordStore 已上传文件记录，用于按upload_file_id引用文件时确定文件类型
+// 键为 域名+API密钥哈希+文件ID，不同应用之间互不可见
+var UploadRecordStore = struct {
+	sync.Mutex
+	records map[string]uploadRecord
+}{
+	records: make(map[string]uploadRecord),
+}
+
+// uploadRecordKey 计算上传记录键
+func uploadRecordKey(baseURL string, apiKey string, fileID string) string {
+	return baseURL + "|" + HashAPIKey(apiKey) + "|" + fileID
+}
+
+// SaveUploadRecord 保存上传记录，同时清理已过期的记录
+func SaveUploadRecord(baseURL string, apiKey string, fileResp *model.DifyFileUploadResponse) {
+	UploadRecordStore.Lock()
+	defer UploadRecordStore.Unlock()
+
+	now := time.Now()
+	for key, record := range UploadRecordStore.records {
+		if now.After(record.expiresAt) {
+			delete(UploadRecordStore.records, key)
+		}
+	}
+
+	UploadRecordStore.records[uploadRecordKey(baseURL, apiKey, fileResp.ID)] = uploadRecord{
+		fileResp:  *fileResp,
+		expiresAt: now.Add(time.Duration(config.Config.UploadRecordTTL) * time.Second),
+	}
+}
+
+// GetUploadRecord 获取上传记录
+func GetUploadRecord(baseURL string, apiKey string, fileID string) (*model.DifyFileUploadResponse, bool) {
+	UploadRecordStore.Lock()
+	defer UploadRecordStore.Unlock()
+
+	record, ok := UploadRecordStore.records[uploadRecordKey(baseURL, apiKey, fileID)]
+	if !ok || time.Now().After(record.expiresAt) {
+		return nil, false
+	}
+	fileResp := record.fileResp
+	return &fileResp, true
+}
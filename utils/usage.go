@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// UsageDimensions 用量可汇总的维度
+var UsageDimensions = []string{"date", "user", "api_key_hash", "domain"}
+
+// UsageStore 按日期、终端用户、API密钥和域名汇总的用量
+// 配置USAGE_FILE时每次执行的用量追加到文件（每行一条JSON），首次使用前重放文件中的记录
+var UsageStore = struct {
+	sync.Mutex
+	loaded  bool
+	records map[string]*model.UsageRecord
+	file    *os.File // 以追加方式打开的USAGE_FILE
+}{
+	records: make(map[string]*model.UsageRecord),
+}
+
+// IsUsageDimension 判断是否为可汇总的用量维度
+func IsUsageDimension(dimension string) bool {
+	return containsString(UsageDimensions, dimension)
+}
+
+// usageKey 用量记录的键
+func usageKey(record *model.UsageRecord) string {
+	return strings.Join([]string{record.Date, record.User, record.APIKeyHash, record.Domain}, "|")
+}
+
+// RecordUsage 记录一次工作流执行的用量，计入当天的汇总
+func RecordUsage(domain string, apiKey string, user string, usage model.WorkflowUsage) {
+	run := model.UsageRecord{
+		Date:             time.Now().Format("2006-01-02"),
+		User:             user,
+		APIKeyHash:       HashAPIKey(apiKey),
+		Domain:           domain,
+		Runs:             1,
+		TotalTokens:      usage.TotalTokens,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalPrice:       usage.TotalPrice,
+		Currency:         usage.Currency,
+		ElapsedTime:      usage.ElapsedTime,
+	}
+	if usage.Status != "succeeded" {
+		run.FailedRuns = 1
+	}
+
+	UsageStore.Lock()
+	defer UsageStore.Unlock()
+	loadUsage()
+
+	addUsageRun(&run)
+	appendUsage(&run)
+}
+
+// addUsageRun 将一次执行的用量计入当天的汇总，调用方需持有锁
+func addUsageRun(run *model.UsageRecord) {
+	key := usageKey(run)
+	record, ok := UsageStore.records[key]
+	if !ok {
+		record = &model.UsageRecord{Date: run.Date, User: run.User, APIKeyHash: run.APIKeyHash, Domain: run.Domain}
+		UsageStore.records[key] = record
+	}
+	addUsageRecord(record, run)
+}
+
+// QueryUsage 按条件过滤用量并按指定维度汇总，未参与汇总的维度在结果中为空
+// 结果按日期、域名、API密钥摘要、用户排序
+func QueryUsage(query model.UsageQuery) []model.UsageRecord {
+	groupBy := query.GroupBy
+	if len(groupBy) == 0 {
+		groupBy = UsageDimensions
+	}
+	group := make(map[string]bool, len(groupBy))
+	for _, dimension := range groupBy {
+		group[dimension] = true
+	}
+
+	UsageStore.Lock()
+	defer UsageStore.Unlock()
+	loadUsage()
+
+	grouped := make(map[string]*model.UsageRecord)
+	for _, record := range UsageStore.records {
+		if (query.From != "" && record.Date < query.From) || (query.To != "" && record.Date > query.To) ||
+			(query.User != "" && record.User != query.User) ||
+			(query.APIKeyHash != "" && record.APIKeyHash != query.APIKeyHash) ||
+			(query.Domain != "" && record.Domain != query.Domain) {
+			continue
+		}
+
+		item := model.UsageRecord{}
+		if group["date"] {
+			item.Date = record.Date
+		}
+		if group["user"] {
+			item.User = record.User
+		}
+		if group["api_key_hash"] {
+			item.APIKeyHash = record.APIKeyHash
+		}
+		if group["domain"] {
+			item.Domain = record.Domain
+		}
+		key := usageKey(&item)
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &item
+		}
+		addUsageRecord(grouped[key], record)
+	}
+
+	return sortedUsage(grouped)
+}
+
+// SumUsage 合计多条用量记录
+func SumUsage(records []model.UsageRecord) model.UsageRecord {
+	var total model.UsageRecord
+	for i := range records {
+		addUsageRecord(&total, &records[i])
+	}
+	return total
+}
+
+// WriteUsageCSV 以CSV格式写出用量记录，文本单元格经过公式转义
+func WriteUsageCSV(w io.Writer, records []model.UsageRecord) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"date", "user", "api_key_hash", "domain", "runs", "failed_runs", "total_tokens",
+		"prompt_tokens", "completion_tokens", "total_price", "currency", "elapsed_time"})
+	for _, record := range records {
+		writer.Write([]string{
+			escapeCSVFormula(record.Date),
+			escapeCSVFormula(record.User),
+			escapeCSVFormula(record.APIKeyHash),
+			escapeCSVFormula(record.Domain),
+			strconv.FormatInt(record.Runs, 10),
+			strconv.FormatInt(record.FailedRuns, 10),
+			strconv.FormatInt(record.TotalTokens, 10),
+			strconv.FormatInt(record.PromptTokens, 10),
+			strconv.FormatInt(record.CompletionTokens, 10),
+			strconv.FormatFloat(record.TotalPrice, 'f', -1, 64),
+			escapeCSVFormula(record.Currency),
+			strconv.FormatFloat(record.ElapsedTime, 'f', 3, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// escapeCSVFormula 以 = + - @ 制表符或回车开头的单元格会被Excel等软件当作公式执行，前面加单引号转为文本
+func escapeCSVFormula(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// ExtractWorkflowUsage 从blocking模式（或aggregate模式汇总）的工作流响应中提取用量
+// Token数和耗时取自 data.total_tokens、data.elapsed_time；输入/输出Token数和费用取自响应中的usage
+// （data.usage、metadata.usage 或输出变量 usage），没有usage时合计 data.nodes 中各节点的费用
+func ExtractWorkflowUsage(workflowResp interface{}) model.WorkflowUsage {
+	raw, err := json.Marshal(workflowResp)
+	if err != nil {
+		return model.WorkflowUsage{}
+	}
+	resp := gjson.ParseBytes(raw)
+
+	usage := model.WorkflowUsage{
+		Status:      resp.Get("data.status").String(),
+		TotalTokens: resp.Get("data.total_tokens").Int(),
+		ElapsedTime: resp.Get("data.elapsed_time").Float(),
+	}
+
+	for _, path := range []string{"data.usage", "metadata.usage", "data.outputs.usage"} {
+		item := resp.Get(path)
+		if !item.IsObject() {
+			continue
+		}
+		usage.PromptTokens = item.Get("prompt_tokens").Int()
+		usage.CompletionTokens = item.Get("completion_tokens").Int()
+		usage.TotalPrice = item.Get("total_price").Float()
+		usage.Currency = item.Get("currency").String()
+		if usage.TotalTokens == 0 {
+			usage.TotalTokens = item.Get("total_tokens").Int()
+		}
+		return usage
+	}
+
+	for _, node := range resp.Get("data.nodes").Array() {
+		usage.TotalPrice += node.Get("total_price").Float()
+		if usage.Currency == "" {
+			usage.Currency = node.Get("currency").String()
+		}
+	}
+	return usage
+}
+
+// addUsageRecord 将src的计数累加到dst
+func addUsageRecord(dst *model.UsageRecord, src *model.UsageRecord) {
+	dst.Runs += src.Runs
+	dst.FailedRuns += src.FailedRuns
+	dst.TotalTokens += src.TotalTokens
+	dst.PromptTokens += src.PromptTokens
+	dst.CompletionTokens += src.CompletionTokens
+	dst.TotalPrice += src.TotalPrice
+	dst.ElapsedTime += src.ElapsedTime
+	if dst.Currency == "" {
+		dst.Currency = src.Currency
+	}
+}
+
+// sortedUsage 将用量记录排序为列表
+func sortedUsage(records map[string]*model.UsageRecord) []model.UsageRecord {
+	result := make([]model.UsageRecord, 0, len(records))
+	for _, record := range records {
+		result = append(result, *record)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.APIKeyHash != b.APIKeyHash {
+			return a.APIKeyHash < b.APIKeyHash
+		}
+		return a.User < b.User
+	})
+	return result
+}
+
+// loadUsage 首次使用时重放USAGE_FILE中的执行记录，无法解析的行（如写入中断的最后一行）跳过，调用方需持有锁
+func loadUsage() {
+	if UsageStore.loaded {
+		return
+	}
+	UsageStore.loaded = true
+	if config.Config.UsageFile == "" {
+		return
+	}
+
+	file, err := os.Open(config.Config.UsageFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("读取用量文件失败: %v", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var run model.UsageRecord
+		if err = json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			log.Printf("解析用量文件第%d行失败，已跳过: %v", line, err)
+			continue
+		}
+		addUsageRun(&run)
+	}
+	if err = scanner.Err(); err != nil {
+		log.Printf("读取用量文件失败: %v", err)
+	}
+}
+
+// appendUsage 将一次执行的用量作为一行JSON追加到USAGE_FILE，调用方需持有锁
+func appendUsage(run *model.UsageRecord) {
+	if config.Config.UsageFile == "" {
+		return
+	}
+
+	if UsageStore.file == nil {
+		if err := os.MkdirAll(filepath.Dir(config.Config.UsageFile), 0o755); err != nil {
+			log.Printf("写入用量文件失败: %v", err)
+			return
+		}
+		file, err := os.OpenFile(config.Config.UsageFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Printf("写入用量文件失败: %v", err)
+			return
+		}
+		UsageStore.file = file
+	}
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		log.Printf("序列化用量失败: %v", err)
+		return
+	}
+	if _, err = UsageStore.file.Write(append(data, '\n')); err != nil {
+		log.Printf("写入用量文件失败: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"bytes"
+	"dify-upload-workflow/config"
+	"dify-upload-workflow/model"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractWorkflowUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want model.WorkflowUsage
+	}{
+		{
+			name: "只有Token数",
+			resp: `{"data":{"status":"succeeded","total_tokens":120,"elapsed_time":2.5}}`,
+			want: model.WorkflowUsage{Status: "succeeded", TotalTokens: 120, ElapsedTime: 2.5},
+		},
+		{
+			name: "输出中的usage（价格为字符串）",
+			resp: `{"data":{"status":"succeeded","total_tokens":0,"outputs":{"usage":{"prompt_tokens":80,"completion_tokens":20,"total_tokens":100,"total_price":"0.0012","currency":"USD"}}}}`,
+			want: model.WorkflowUsage{Status: "succeeded", TotalTokens: 100, PromptTokens: 80, CompletionTokens: 20, TotalPrice: 0.0012, Currency: "USD"},
+		},
+		{
+			name: "aggregate模式的节点费用",
+			resp: `{"data":{"status":"failed","total_tokens":50,"nodes":[{"total_price":"0.001","currency":"RMB"},{"total_price":0.002},{}]}}`,
+			want: model.WorkflowUsage{Status: "failed", TotalTokens: 50, TotalPrice: 0.003, Currency: "RMB"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp interface{}
+			if err := json.Unmarshal([]byte(tt.resp), &resp); err != nil {
+				t.Fatal(err)
+			}
+			got := ExtractWorkflowUsage(resp)
+			// 浮点数累加存在误差
+			if diff := got.TotalPrice - tt.want.TotalPrice; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("TotalPrice = %v, want %v", got.TotalPrice, tt.want.TotalPrice)
+			}
+			got.TotalPrice = tt.want.TotalPrice
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUsageStorePersisted 每次执行的用量追加到USAGE_FILE，重放后可按维度汇总查询
+func TestUsageStorePersisted(t *testing.T) {
+	resetUsageStore := func() {
+		UsageStore.Lock()
+		UsageStore.records = make(map[string]*model.UsageRecord)
+		UsageStore.loaded = false
+		if UsageStore.file != nil {
+			UsageStore.file.Close()
+			UsageStore.file = nil
+		}
+		UsageStore.Unlock()
+	}
+	original := config.Config.UsageFile
+	config.Config.UsageFile = filepath.Join(t.TempDir(), "usage", "usage.jsonl")
+	resetUsageStore()
+	t.Cleanup(func() {
+		config.Config.UsageFile = original
+		resetUsageStore()
+	})
+
+	RecordUsage("https://a.example.com", "key-1", "alice", model.WorkflowUsage{Status: "succeeded", TotalTokens: 10, TotalPrice: 0.5, Currency: "USD"})
+	RecordUsage("https://a.example.com", "key-1", "alice", model.WorkflowUsage{Status: "failed", TotalTokens: 5})
+	RecordUsage("https://b.example.com", "key-2", "bob", model.WorkflowUsage{Status: "succeeded", TotalTokens: 7})
+
+	// 每次执行追加一行；模拟写入中断的最后一行
+	data, err := os.ReadFile(config.Config.UsageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("用量文件行数 = %d, want 3", lines)
+	}
+	if err = os.WriteFile(config.Config.UsageFile, append(data, `{"date":"20`...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟服务重启
+	resetUsageStore()
+
+	records := QueryUsage(model.UsageQuery{APIKeyHash: HashAPIKey("key-1")})
+	if len(records) != 1 {
+		t.Fatalf("records = %+v", records)
+	}
+	if r := records[0]; r.Runs != 2 || r.FailedRuns != 1 || r.TotalTokens != 15 || r.TotalPrice != 0.5 || r.Currency != "USD" || r.User != "alice" {
+		t.Errorf("record = %+v", r)
+	}
+
+	records = QueryUsage(model.UsageQuery{GroupBy: []string{"date"}})
+	if len(records) != 1 || records[0].Runs != 3 || records[0].Domain != "" {
+		t.Errorf("按日期汇总 = %+v", records)
+	}
+	if records = QueryUsage(model.UsageQuery{From: "2999-01-01"}); len(records) != 0 {
+		t.Errorf("日期过滤 = %+v", records)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteUsageCSV(&buf, QueryUsage(model.UsageQuery{GroupBy: []string{"user"}})); err != nil {
+		t.Fatal(err)
+	}
+	if want := ",alice,,,2,1,15,0,0,0.5,USD,0.000"; !strings.Contains(buf.String(), want) {
+		t.Errorf("csv = %q, want line %q", buf.String(), want)
+	}
+}
+
+// TestWriteUsageCSVEscapesFormulas 可能被当作公式的文本单元格加单引号前缀
+func TestWriteUsageCSVEscapesFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	records := []model.UsageRecord{{Date: "2026-10-01", User: "=HYPERLINK(\"http://x\")", Domain: "+cmd", Currency: "@SUM(A1)", Runs: 1}}
+	if err := WriteUsageCSV(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"'=HYPERLINK(""http://x"")"`, ",'+cmd,", ",'@SUM(A1),", "2026-10-01,"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("csv = %q, want %q", buf.String(), want)
+		}
+	}
+	if strings.Contains(buf.String(), "'2026") {
+		t.Errorf("普通单元格不应转义: %q", buf.String())
+	}
+}
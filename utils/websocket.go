@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout 单个WebSocket消息的写超时
+const wsWriteTimeout = 10 * time.Second
+
+// WebSocketWriter 以JSON文本帧写出流式事件，事件格式与SSE的data相同
+// 可在多个goroutine中并发写出
+type WebSocketWriter struct {
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	recorder SSERecorder
+	err      error // 写出失败（客户端断开连接）后不再写出，仍继续记录事件
+}
+
+// NewWebSocketWriter 创建WebSocket事件写入器
+func NewWebSocketWriter(conn *websocket.Conn) *WebSocketWriter {
+	return &WebSocketWriter{conn: conn}
+}
+
+// SetRecorder 设置事件记录器，之后写出的每个事件都先交给记录器
+func (w *WebSocketWriter) SetRecorder(recorder SSERecorder) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recorder = recorder
+}
+
+// WriteEvent 写出一个事件：data为JSON对象时原样发送，否则包装为 {"event":"名称","data":"内容"}
+func (w *WebSocketWriter) WriteEvent(event *SSEEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.recorder != nil {
+		recorded := *event
+		w.recorder.Record(&recorded)
+		event = &recorded
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	message := []byte(event.Data)
+	var object map[string]interface{}
+	if json.Unmarshal(message, &object) != nil {
+		wrapped := map[string]interface{}{"event": event.Name()}
+		if event.Data != "" {
+			wrapped["data"] = event.Data
+		}
+		message, _ = json.Marshal(wrapped)
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := w.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// WriteJSON 写出一个JSON事件
+func (w *WebSocketWriter) WriteJSON(payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return w.WriteEvent(&SSEEvent{Data: string(data)})
+}